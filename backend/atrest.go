@@ -0,0 +1,614 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pages, attachments, versions and thumbnails can be encrypted at rest by
+// pointing WIKI_ENCRYPTION_KEY_FILE at a keyring outside the persistence
+// volume. Everything the storage layer writes is then sealed with AES-256-GCM
+// under the keyring's primary key, and everything it reads is opened with
+// whichever key the file names in its header, so plaintext files from before
+// and files under retired keys keep working. The backup copies files as they
+// are, so the persistent mirror only ever holds ciphertext.
+//
+// A sealed file is a header (magic, key id, random nonce prefix) followed by
+// the contents in 64 KiB chunks, each sealed on its own with the chunk number
+// in its nonce and the header and a last-chunk flag as additional data, so
+// chunks can't be reordered, swapped between files or cut off. Reads decrypt
+// only the chunks they need, which keeps seeking, ranges and zip listings
+// cheap.
+//
+// Keys are rotated with POST /api/rekey?rotate=1, which adds a fresh primary
+// key to the keyring and re-encrypts every file with it; plain POST
+// /api/rekey only re-encrypts (after a primary key was changed by hand, or to
+// encrypt a wiki that was stored in plaintext). GET reports which keys are
+// in use. Like /api/fsck it needs the WIKI_ADMIN_TOKEN. Unfinished
+// resumable uploads stay in plaintext until they complete.
+
+// encryptionKeyFile is the keyring; at-rest encryption is off without it
+var encryptionKeyFile = envString("WIKI_ENCRYPTION_KEY_FILE", "")
+
+const (
+	sealMagic       = "WIKIENC1"
+	sealChunkSize   = 64 << 10
+	sealNoncePrefix = 8
+)
+
+var (
+	errUnknownKey = errors.New("File is encrypted with a key that is not in the keyring")
+	errSealBroken = errors.New("Encrypted file is damaged or has been tampered with")
+)
+
+// keyring holds the at-rest keys. The file is JSON with the id of the
+// primary key and every key by id, base64-encoded; a file holding just one
+// base64 or raw 32-byte key also works and is used as key "default".
+type keyring struct {
+	Primary string            `json:"primary"`
+	Keys    map[string]string `json:"keys"`
+	aeads   map[string]cipher.AEAD
+}
+
+// keys is the loaded keyring, nil while at-rest encryption is off
+var keys atomic.Pointer[keyring]
+
+// keyringMu serializes rotations
+var keyringMu sync.Mutex
+
+// loadKeyring reads WIKI_ENCRYPTION_KEY_FILE, creating a keyring with one
+// new key if the file doesn't exist yet. It runs before anything is read
+// from disk.
+func loadKeyring() error {
+	if encryptionKeyFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(encryptionKeyFile)
+	if os.IsNotExist(err) {
+		kr := &keyring{Keys: make(map[string]string)}
+		kr.add(newKeyID())
+		if err := kr.save(); err != nil {
+			return err
+		}
+		log.Printf("Created encryption keyring %s", encryptionKeyFile)
+		return kr.use()
+	}
+	if err != nil {
+		return err
+	}
+
+	kr := &keyring{}
+	if err := json.Unmarshal(data, kr); err != nil {
+		// A bare key
+		key := []byte(strings.TrimSpace(string(data)))
+		if decoded, err := base64.StdEncoding.DecodeString(string(key)); err == nil {
+			key = decoded
+		}
+		kr = &keyring{Primary: "default", Keys: map[string]string{"default": base64.StdEncoding.EncodeToString(key)}}
+	}
+	return kr.use()
+}
+
+// use checks the keyring and makes it the one in force
+func (kr *keyring) use() error {
+	kr.aeads = make(map[string]cipher.AEAD, len(kr.Keys))
+	for id, encoded := range kr.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 || len(id) == 0 || len(id) > 255 {
+			return errors.New("Invalid key " + id + " in " + encryptionKeyFile + ": keys are 32 bytes, base64-encoded")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		if kr.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return err
+		}
+	}
+	if kr.aeads[kr.Primary] == nil {
+		return errors.New("The primary key " + kr.Primary + " is not in " + encryptionKeyFile)
+	}
+	keys.Store(kr)
+	return nil
+}
+
+// newKeyID names a key after when it was made
+func newKeyID() string {
+	return time.Now().UTC().Format("20060102T150405Z")
+}
+
+// add makes a new random key the primary one
+func (kr *keyring) add(id string) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	kr.Keys[id] = base64.StdEncoding.EncodeToString(key)
+	kr.Primary = id
+}
+
+// save writes the keyring back to its file
+func (kr *keyring) save() error {
+	data, err := json.MarshalIndent(kr, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(encryptionKeyFile), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(encryptionKeyFile, data, 0600)
+}
+
+// rotateKey adds a new primary key to the keyring. Files are moved to it by
+// rekey; the old keys stay for reading until they are removed by hand.
+func rotateKey() (string, error) {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	current := keys.Load()
+	if current == nil {
+		return "", errors.New("At-rest encryption is off; set WIKI_ENCRYPTION_KEY_FILE")
+	}
+	kr := &keyring{Keys: make(map[string]string, len(current.Keys)+1)}
+	for id, key := range current.Keys {
+		kr.Keys[id] = key
+	}
+	id := newKeyID()
+	if _, taken := kr.Keys[id]; taken {
+		return "", errors.New("A key was already made this second")
+	}
+	kr.add(id)
+	if err := kr.use(); err != nil {
+		return "", err
+	}
+	if err := kr.save(); err != nil {
+		keys.Store(current)
+		return "", err
+	}
+	log.Printf("Rotated the encryption key to %s", id)
+	return id, nil
+}
+
+// sealHeader starts a file sealed under key id
+func sealHeader(id string) []byte {
+	header := make([]byte, 0, len(sealMagic)+1+len(id)+sealNoncePrefix)
+	header = append(header, sealMagic...)
+	header = append(header, byte(len(id)))
+	header = append(header, id...)
+	prefix := make([]byte, sealNoncePrefix)
+	rand.Read(prefix)
+	return append(header, prefix...)
+}
+
+// sealNonce and sealAAD bind a chunk to its place in its file
+func sealNonce(header []byte, index int64) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header[len(header)-sealNoncePrefix:])
+	binary.BigEndian.PutUint32(nonce[sealNoncePrefix:], uint32(index))
+	return nonce
+}
+
+func sealAAD(header []byte, last bool) []byte {
+	aad := append([]byte(nil), header...)
+	if last {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+// sealWriter encrypts what is written to it into w. Close writes the last
+// chunk, which may be empty.
+type sealWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	index  int64
+}
+
+func newSealWriter(w io.Writer, kr *keyring) (*sealWriter, error) {
+	s := &sealWriter{w: w, aead: kr.aeads[kr.Primary], header: sealHeader(kr.Primary), buf: make([]byte, 0, sealChunkSize)}
+	_, err := w.Write(s.header)
+	return s, err
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data shows it isn't the last
+		if len(s.buf) == sealChunkSize {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):sealChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *sealWriter) Close() error {
+	return s.seal(true)
+}
+
+func (s *sealWriter) seal(last bool) error {
+	if s.index > 1<<32-1 {
+		return errors.New("File is too large to encrypt")
+	}
+	sealed := s.aead.Seal(nil, sealNonce(s.header, s.index), s.buf, sealAAD(s.header, last))
+	s.index++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// storedFile reads a file written by the storage layer, decrypting it if it
+// is sealed. It is an io.ReadSeeker and io.ReaderAt over the plaintext, and
+// Stat reports the plaintext size. It is not safe for concurrent use.
+type storedFile struct {
+	f      *os.File
+	info   os.FileInfo
+	keyID  string // "" for a plaintext file
+	size   int64  // of the plaintext
+	offset int64
+
+	aead       cipher.AEAD
+	header     []byte
+	chunks     int64
+	chunk      []byte // the last chunk decrypted
+	chunkIndex int64
+}
+
+// storedInfo is the FileInfo of a stored file with its plaintext size
+type storedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i storedInfo) Size() int64 { return i.size }
+
+// openStored opens a page file, attachment, version or thumbnail for reading
+func openStored(path string) (*storedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newStoredFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func newStoredFile(f *os.File) (*storedFile, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	s := &storedFile{f: f, info: info, size: info.Size(), chunkIndex: -1}
+	// With at-rest encryption off nothing is sealed, so a plaintext file
+	// that happens to start like a sealed one reads back as it is
+	kr := keys.Load()
+	magic := make([]byte, len(sealMagic)+1)
+	if n, _ := f.ReadAt(magic, 0); kr == nil || n < len(magic) || string(magic[:len(sealMagic)]) != sealMagic {
+		return s, nil
+	}
+
+	// Sealed: read the rest of the header
+	idLen := int(magic[len(sealMagic)])
+	s.header = make([]byte, len(magic)+idLen+sealNoncePrefix)
+	if _, err := f.ReadAt(s.header, 0); err != nil {
+		return nil, errSealBroken
+	}
+	s.keyID = string(s.header[len(magic) : len(magic)+idLen])
+	if s.aead = kr.aeads[s.keyID]; s.aead == nil {
+		return nil, errUnknownKey
+	}
+	body := info.Size() - int64(len(s.header))
+	sealedChunk := int64(sealChunkSize + s.aead.Overhead())
+	s.chunks = (body + sealedChunk - 1) / sealedChunk
+	if s.chunks == 0 || body-(s.chunks-1)*sealedChunk < int64(s.aead.Overhead()) {
+		return nil, errSealBroken
+	}
+	s.size = body - s.chunks*int64(s.aead.Overhead())
+	return s, nil
+}
+
+func (s *storedFile) Stat() (os.FileInfo, error) {
+	return storedInfo{s.info, s.size}, nil
+}
+
+func (s *storedFile) Close() error {
+	return s.f.Close()
+}
+
+func (s *storedFile) ReadAt(p []byte, off int64) (int, error) {
+	if s.keyID == "" {
+		return s.f.ReadAt(p, off)
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) && off < s.size {
+		index := off / sealChunkSize
+		chunk, err := s.openChunk(index)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], chunk[off-index*sealChunkSize:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// openChunk decrypts chunk index, keeping it for the next read
+func (s *storedFile) openChunk(index int64) ([]byte, error) {
+	if index == s.chunkIndex {
+		return s.chunk, nil
+	}
+	sealedChunk := int64(sealChunkSize + s.aead.Overhead())
+	sealed := make([]byte, sealedChunk)
+	n, err := s.f.ReadAt(sealed, int64(len(s.header))+index*sealedChunk)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	chunk, err := s.aead.Open(sealed[:0], sealNonce(s.header, index), sealed[:n], sealAAD(s.header, index == s.chunks-1))
+	if err != nil {
+		return nil, errSealBroken
+	}
+	s.chunk, s.chunkIndex = chunk, index
+	return chunk, nil
+}
+
+func (s *storedFile) Read(p []byte) (int, error) {
+	if s.keyID == "" {
+		return s.f.Read(p)
+	}
+	if s.offset >= s.size {
+		return 0, io.EOF
+	}
+	if max := s.size - s.offset; int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := s.ReadAt(p, s.offset)
+	s.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (s *storedFile) Seek(offset int64, whence int) (int64, error) {
+	if s.keyID == "" {
+		return s.f.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+// readStored is os.ReadFile for files written by the storage layer
+func readStored(path string) ([]byte, error) {
+	s, err := openStored(path)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return io.ReadAll(s)
+}
+
+// storedSize is the plaintext size of a stored file
+func storedSize(path string) (int64, error) {
+	s, err := openStored(path)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	return s.size, nil
+}
+
+// writeStored replaces path with what fill writes, sealed under the primary
+// key when at-rest encryption is on
+func writeStored(path string, perm os.FileMode, fill func(io.Writer) error) error {
+	return writeAtomic(path, perm, func(f *os.File) error {
+		kr := keys.Load()
+		if kr == nil {
+			return fill(f)
+		}
+		w, err := newSealWriter(f, kr)
+		if err != nil {
+			return err
+		}
+		if err := fill(w); err != nil {
+			return err
+		}
+		return w.Close()
+	})
+}
+
+// writeStoredFile is writeFileAtomic through writeStored
+func writeStoredFile(path string, data []byte, perm os.FileMode) error {
+	return writeStored(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// rekeyReport is the outcome of a rekey pass
+type rekeyReport struct {
+	Primary  string         `json:"primary"`
+	Files    int            `json:"files"`
+	ByKey    map[string]int `json:"by_key"` // files per key id, "plaintext" for unencrypted ones
+	Rekeyed  int            `json:"rekeyed"`
+	Errors   []string       `json:"errors"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+}
+
+// rekey goes through everything stored, here and in the persistent mirror,
+// and with apply re-encrypts whatever isn't under the primary key. Each
+// file's page is locked while the file is done.
+func rekey(apply bool) rekeyReport {
+	kr := keys.Load()
+	report := rekeyReport{Primary: kr.Primary, ByKey: make(map[string]int), Errors: []string{}, Started: time.Now()}
+	for _, stored := range storedPaths() {
+		unlock := func() {}
+		if stored.title != "" && apply {
+			unlock = pageLocks.Lock(stored.title)
+		} else if stored.title != "" {
+			unlock = pageLocks.RLock(stored.title)
+		}
+		path := stored.path
+		s, err := openStored(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				report.Errors = append(report.Errors, path+": "+err.Error())
+			}
+			unlock()
+			continue
+		}
+		keyID := s.keyID
+		s.Close()
+		report.Files++
+		if keyID == kr.Primary || !apply {
+			if keyID == "" {
+				keyID = "plaintext"
+			}
+			report.ByKey[keyID]++
+		} else if err := rekeyFile(path); err != nil {
+			report.Errors = append(report.Errors, path+": "+err.Error())
+		} else {
+			report.Rekeyed++
+			report.ByKey[kr.Primary]++
+		}
+		unlock()
+	}
+	report.Finished = time.Now()
+	return report
+}
+
+// storedPath is a file kept by the storage layer and the page it belongs
+// to, "" when that can't be told from its path
+type storedPath struct {
+	path  string
+	title string
+}
+
+// storedPaths lists the files kept for pages, here and in the persistent
+// mirror: page files, attachments, versions and thumbnails. It walks the
+// directories rather than the page list, so it also finds the mirror's
+// copies of pages that are gone here and versions or thumbnails left
+// behind by their attachments. Unfinished uploads are skipped; they stay in
+// plaintext until they complete.
+func storedPaths() []storedPath {
+	var paths []storedPath
+	for _, root := range []string{".", persistentDir} {
+		pageFiles, _ := findPageFiles(root)
+		for _, rel := range pageFiles {
+			title, _ := titleFromPageFile(rel)
+			paths = append(paths, storedPath{filepath.Join(root, rel), title})
+		}
+
+		dir := filepath.Join(root, filesDir)
+		filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if rel != "." && rel != ".versions" && rel != ".thumbs" && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.Type().IsRegular() && !strings.HasPrefix(d.Name(), ".") {
+				paths = append(paths, storedPath{path, attachmentTitle(rel)})
+			}
+			return nil
+		})
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i].path < paths[j].path })
+	return paths
+}
+
+// attachmentTitle is the page a file below filesDir belongs to, given its
+// path relative to filesDir: an attachment, a version or a thumbnail
+func attachmentTitle(rel string) string {
+	dir := filepath.Dir(rel)
+	for _, hidden := range []string{".versions", ".thumbs"} {
+		if rest, ok := strings.CutPrefix(dir, hidden+string(filepath.Separator)); ok {
+			title, _ := decodeTitle(rest)
+			return title
+		}
+	}
+	title, _ := attachmentDirTitle(dir)
+	return title
+}
+
+// rekeyFile rewrites path under the primary key
+func rekeyFile(path string) error {
+	s, err := openStored(path)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return writeStored(path, s.info.Mode().Perm(), func(w io.Writer) error {
+		_, err := io.Copy(w, s)
+		return err
+	})
+}
+
+// apiRekeyHandler reports which keys the stored files are under (GET), or
+// re-encrypts them with the primary key (POST), first adding a new primary
+// key with ?rotate=1
+func apiRekeyHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if keys.Load() == nil {
+		http.Error(w, "At-rest encryption is off; set WIKI_ENCRYPTION_KEY_FILE", http.StatusConflict)
+		return
+	}
+	if r.Method == "POST" && r.URL.Query().Get("rotate") != "" {
+		if _, err := rotateKey(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	report := rekey(r.Method == "POST")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useTestKeys loads a keyring holding ids, each with a fixed key, with
+// primary as its primary key. At-rest encryption is off again after the test.
+func useTestKeys(t *testing.T, primary string, ids ...string) {
+	t.Helper()
+	saved := encryptionKeyFile
+	t.Cleanup(func() {
+		encryptionKeyFile = saved
+		keys.Store(nil)
+	})
+	kr := keyring{Primary: primary, Keys: make(map[string]string)}
+	for _, id := range ids {
+		kr.Keys[id] = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(id[:1]), 32))
+	}
+	data, err := json.Marshal(kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptionKeyFile = filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(encryptionKeyFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadKeyring(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testData is size bytes that differ from chunk to chunk
+func testData(size int) []byte {
+	data := make([]byte, size)
+	r := rand.New(rand.NewPCG(uint64(size), 1))
+	for i := range data {
+		data[i] = byte(r.Uint32())
+	}
+	return data
+}
+
+// storedKey is the key id a stored file is sealed under, "" for plaintext
+func storedKey(t *testing.T, path string) string {
+	t.Helper()
+	s, err := openStored(path)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	defer s.Close()
+	return s.keyID
+}
+
+// TestSealRoundTrip writes files of sizes around the chunk size sealed and
+// reads them back
+func TestSealRoundTrip(t *testing.T) {
+	testWiki(t)
+	useTestKeys(t, "one", "one")
+	for _, size := range []int{0, 1, sealChunkSize - 1, sealChunkSize, sealChunkSize + 1, 2 * sealChunkSize, 3*sealChunkSize + 17} {
+		data := testData(size)
+		path := "sealed.bin"
+		if err := writeStoredFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := os.ReadFile(path)
+		if !bytes.HasPrefix(raw, []byte(sealMagic)) || size >= 16 && bytes.Contains(raw, data[:min(size, 64)]) {
+			t.Errorf("%d bytes were not sealed", size)
+		}
+		got, err := readStored(path)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%d bytes came back as %d, %v", size, len(got), err)
+		}
+		if n, err := storedSize(path); err != nil || n != int64(size) {
+			t.Errorf("stored size of %d bytes = %d, %v", size, n, err)
+		}
+	}
+}
+
+// TestSealRandomAccess reads and seeks across chunk boundaries, in a file
+// that ends inside a chunk and in one that ends exactly on a boundary
+func TestSealRandomAccess(t *testing.T) {
+	testWiki(t)
+	useTestKeys(t, "one", "one")
+	for _, size := range []int{3*sealChunkSize + 100, 2 * sealChunkSize} {
+		data := testData(size)
+		if err := writeStoredFile("sealed.bin", data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		s, err := openStored("sealed.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range []struct{ off, n int }{
+			{0, 10},
+			{sealChunkSize - 10, 20},
+			{sealChunkSize, 10},
+			{2*sealChunkSize - 2, 2},
+			{sealChunkSize / 2, sealChunkSize + 100},
+			{size - 5, 5},
+		} {
+			buf := make([]byte, r.n)
+			n, err := s.ReadAt(buf, int64(r.off))
+			if err != nil || n != r.n || !bytes.Equal(buf, data[r.off:r.off+r.n]) {
+				t.Errorf("%d bytes: ReadAt(%d, %d) = %d, %v", size, r.off, r.n, n, err)
+			}
+		}
+		// Past the end
+		buf := make([]byte, 10)
+		if n, err := s.ReadAt(buf, int64(size-5)); n != 5 || err != io.EOF {
+			t.Errorf("%d bytes: reading over the end = %d, %v", size, n, err)
+		}
+		if n, err := s.ReadAt(buf, int64(size)); n != 0 || err != io.EOF {
+			t.Errorf("%d bytes: reading at the end = %d, %v", size, n, err)
+		}
+
+		for _, seek := range []struct {
+			offset int64
+			whence int
+			want   int
+		}{
+			{sealChunkSize, io.SeekStart, sealChunkSize},
+			{-10, io.SeekEnd, size - 10},
+			{-sealChunkSize, io.SeekCurrent, size - 10 - sealChunkSize + 10},
+		} {
+			pos, err := s.Seek(seek.offset, seek.whence)
+			if err != nil || pos != int64(seek.want) {
+				t.Errorf("%d bytes: Seek(%d, %d) = %d, %v, want %d", size, seek.offset, seek.whence, pos, err, seek.want)
+				continue
+			}
+			got := make([]byte, 10)
+			n, _ := io.ReadFull(s, got)
+			if !bytes.Equal(got[:n], data[seek.want:seek.want+n]) || n != min(10, size-seek.want) {
+				t.Errorf("%d bytes: read after Seek(%d, %d) = %d bytes that don't match", size, seek.offset, seek.whence, n)
+			}
+		}
+		s.Seek(0, io.SeekEnd)
+		rest, err := io.ReadAll(s)
+		if err != nil || len(rest) != 0 {
+			t.Errorf("%d bytes: read at the end = %d bytes, %v", size, len(rest), err)
+		}
+		s.Close()
+	}
+}
+
+// TestSealTampering checks that cut off, reordered and altered files are
+// refused rather than read short or wrong
+func TestSealTampering(t *testing.T) {
+	testWiki(t)
+	useTestKeys(t, "one", "one")
+	headerLen := len(sealMagic) + 1 + len("one") + sealNoncePrefix
+	sealedChunk := sealChunkSize + 16
+
+	seal := func(name string, data []byte) []byte {
+		if err := writeStoredFile(name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := os.ReadFile(name)
+		return raw
+	}
+	refused := func(what string, raw []byte) {
+		t.Helper()
+		os.WriteFile("tampered.bin", raw, 0644)
+		if got, err := readStored("tampered.bin"); !errors.Is(err, errSealBroken) {
+			t.Errorf("%s: read %d bytes, %v", what, len(got), err)
+		}
+	}
+
+	raw := seal("a.bin", testData(2*sealChunkSize+5))
+	refused("cut at a chunk boundary", raw[:headerLen+2*sealedChunk])
+	refused("cut to the header", raw[:headerLen])
+	refused("cut inside a chunk", raw[:len(raw)-3])
+
+	even := seal("b.bin", testData(2*sealChunkSize))
+	refused("file ending on a boundary cut by a chunk", even[:headerLen+sealedChunk])
+
+	swapped := append([]byte(nil), raw...)
+	copy(swapped[headerLen:], raw[headerLen+sealedChunk:headerLen+2*sealedChunk])
+	copy(swapped[headerLen+sealedChunk:], raw[headerLen:headerLen+sealedChunk])
+	refused("chunks swapped", swapped)
+
+	other := seal("c.bin", testData(2*sealChunkSize+5))
+	refused("header of another file", append(append([]byte(nil), other[:headerLen]...), raw[headerLen:]...))
+
+	flipped := append([]byte(nil), raw...)
+	flipped[headerLen+10] ^= 1
+	refused("flipped bit", flipped)
+}
+
+// TestStoredPlaintext reads files that were never sealed, with encryption
+// on and off
+func TestStoredPlaintext(t *testing.T) {
+	testWiki(t)
+	plain := []byte("written before encryption was turned on")
+	lookalike := append([]byte(sealMagic), "\x03one and then just text"...)
+	os.WriteFile("plain.txt", plain, 0644)
+	os.WriteFile("lookalike.txt", lookalike, 0644)
+
+	// Encryption off: both read back as they are
+	for path, want := range map[string][]byte{"plain.txt": plain, "lookalike.txt": lookalike} {
+		if got, err := readStored(path); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s with encryption off = %q, %v", path, got, err)
+		}
+	}
+
+	// Encryption on: the plaintext file still reads, and a write seals it
+	useTestKeys(t, "one", "one")
+	if got, err := readStored("plain.txt"); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("plaintext with encryption on = %q, %v", got, err)
+	}
+	if n, err := storedSize("plain.txt"); err != nil || n != int64(len(plain)) {
+		t.Errorf("plaintext size = %d, %v", n, err)
+	}
+	if err := writeStoredFile("plain.txt", plain, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if key := storedKey(t, "plain.txt"); key != "one" {
+		t.Errorf("rewritten plaintext is under key %q", key)
+	}
+}
+
+// TestRekey moves every stored file to a new primary key, including
+// files that only the directory tree knows about: the backup of a page
+// that is gone here and versions and thumbnails their attachments left
+func TestRekey(t *testing.T) {
+	testWiki(t)
+	useTestKeys(t, "old", "old")
+	title := "Report"
+	writeTestPage(t, title, "figures.txt", "plain before encryption")
+	stamp := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC).Format(versionStampFormat)
+	contents := map[string]string{
+		versionPath(title, "figures.txt", stamp):                       "earlier figures",
+		versionPath(title, "removed.txt", stamp):                       "version left behind",
+		thumbPath(title, "photo.png", 128):                             "thumbnail",
+		thumbPath("Gone", "photo.png", 128):                            "thumbnail left behind",
+		filepath.Join(persistentDir, pageFilename("Mirrored")):         "only in the backup",
+		filepath.Join(persistentDir, metaFilename("Mirrored")):         "{}",
+		filepath.Join(pageFilesDir(title), "sealed.txt"):               "sealed attachment",
+		filepath.Join(persistentDir, pageFilesDir("Gone"), "file.txt"): "backup of a gone page's file",
+	}
+	for path, content := range contents {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := writeStoredFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	useTestKeys(t, "new", "old", "new")
+	before := rekey(false)
+	if before.ByKey["new"] != 0 || before.ByKey["old"] == 0 || before.ByKey["plaintext"] == 0 {
+		t.Errorf("before rekeying: %v", before.ByKey)
+	}
+	report := rekey(true)
+	if len(report.Errors) != 0 || report.Rekeyed != before.Files || report.Files != before.Files {
+		t.Errorf("rekeying: %+v, before %+v", report, before)
+	}
+	after := rekey(false)
+	if !maps.Equal(after.ByKey, map[string]int{"new": before.Files}) {
+		t.Errorf("after rekeying: %v", after.ByKey)
+	}
+
+	// Everything reads with the old key gone
+	useTestKeys(t, "new", "new")
+	for _, stored := range storedPaths() {
+		if _, err := readStored(stored.path); err != nil {
+			t.Errorf("%s without the old key: %v", stored.path, err)
+		}
+	}
+	for path, content := range contents {
+		if key := storedKey(t, path); key != "new" {
+			t.Errorf("%s is under key %q", path, key)
+		}
+		if got, err := readStored(path); err != nil || string(got) != content {
+			t.Errorf("%s = %q, %v", path, got, err)
+		}
+	}
+	if got, err := readStored(filepath.Join(pageFilesDir(title), "figures.txt")); err != nil || string(got) != "plain before encryption" {
+		t.Errorf("attachment written in plaintext = %q, %v", got, err)
+	}
+}
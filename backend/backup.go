@@ -1,11 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
-	"io"
+	"sync"
 )
 
 // persistentDir is declared in wiki.go
@@ -16,17 +18,31 @@ func init() {
 	}
 }
 
+// backupMu serializes backup runs; handlers start one after every change
+var backupMu sync.Mutex
+
+// backups tracks the runs handlers start in the background
+var backups sync.WaitGroup
+
+// backupInBackground starts a backup run without waiting for it
+func backupInBackground() {
+	backups.Go(BackupWikiFiles)
+}
+
 // BackupWikiFiles copies all wiki text files and uploaded files to the persistent storage directory
 func BackupWikiFiles() {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+
 	// Create the persistent directory if it doesn't exist
 	if err := os.MkdirAll(persistentDir, 0755); err != nil {
 		log.Printf("Error creating persistent directory: %v", err)
 		return
 	}
 
-	// 1. Backup text files and .files.txt metadata files
-	// Get all txt files in the current directory
-	textFiles, err := filepath.Glob("*.txt")
+	// 1. Backup text files and their .files.txt and .meta.json sidecars
+	// Get all txt files in the current directory and its namespace directories
+	textFiles, err := findPageFiles(".")
 	if err != nil {
 		log.Printf("Error finding wiki text files: %v", err)
 		return
@@ -34,16 +50,25 @@ func BackupWikiFiles() {
 
 	// Copy each file to the persistent directory
 	for _, file := range textFiles {
-		// Read the source file
+		// Read the source file, without racing a save of the same page
+		unlock := func() {}
+		if title, ok := titleFromPageFile(file); ok {
+			unlock = pageLocks.RLock(title)
+		}
 		content, err := os.ReadFile(file)
+		unlock()
 		if err != nil {
 			log.Printf("Error reading file %s: %v", file, err)
 			continue
 		}
 
-		// Write to the destination file
+		// Write to the destination file, creating namespace directories as needed
 		destPath := filepath.Join(persistentDir, file)
-		if err := os.WriteFile(destPath, content, 0600); err != nil {
+		if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+			log.Printf("Error creating persistent directory for %s: %v", file, err)
+			continue
+		}
+		if err := writeFileAtomic(destPath, content, 0600); err != nil {
 			log.Printf("Error writing to persistent storage %s: %v", destPath, err)
 		} else {
 			log.Printf("Backed up %s to %s", file, destPath)
@@ -56,16 +81,40 @@ func BackupWikiFiles() {
 	}
 }
 
-// backupUploadedFiles copies all uploaded files to the persistent storage
-func backupUploadedFiles() error {
-	// Get all directories in the filesDir (each directory is named after a page title)
-	dirs, err := os.ReadDir(filesDir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// If the directory doesn't exist yet, there's nothing to backup
+// findPageFiles returns the paths, relative to root, of all page files
+// (.txt, .files.txt and .meta.json) under root, descending into namespace
+// directories
+func findPageFiles(root string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			// Namespace directories only; skip uploads, icons and persistence
+			if rel != "." && (reservedNamespaces[rel] || !isEncodedSegment(d.Name())) {
+				return filepath.SkipDir
+			}
 			return nil
 		}
-		return err
+		if strings.HasSuffix(rel, ".txt") || strings.HasSuffix(rel, ".meta.json") {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// backupUploadedFiles copies all uploaded files to the persistent storage,
+// mirroring the nested files/<namespace>/<page>/ layout
+func backupUploadedFiles() error {
+	// If the directory doesn't exist yet, there's nothing to backup
+	if _, err := os.Stat(filesDir); os.IsNotExist(err) {
+		return nil
 	}
 
 	// Create the persistent files directory
@@ -74,74 +123,71 @@ func backupUploadedFiles() error {
 		return err
 	}
 
-	// For each page directory
-	for _, dir := range dirs {
-		if !dir.IsDir() {
-			continue
-		}
-
-		pageName := dir.Name()
-		pageDir := filepath.Join(filesDir, pageName)
-		
-		// Create corresponding directory in persistent storage
-		persistentPageDir := filepath.Join(persistentFilesDir, pageName)
-		if err := os.MkdirAll(persistentPageDir, 0755); err != nil {
-			log.Printf("Error creating persistent directory for page %s: %v", pageName, err)
-			continue
+	return filepath.WalkDir(filesDir, func(srcPath string, d os.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Error reading %s: %v", srcPath, err)
+			return nil
 		}
-
-		// Copy all files from this page directory
-		files, err := os.ReadDir(pageDir)
+		rel, err := filepath.Rel(filesDir, srcPath)
 		if err != nil {
-			log.Printf("Error reading files for page %s: %v", pageName, err)
-			continue
+			return err
 		}
+		destPath := filepath.Join(persistentFilesDir, rel)
 
-		for _, fileInfo := range files {
-			if fileInfo.IsDir() {
-				continue // Skip subdirectories
+		// Create corresponding directory in persistent storage. Dot
+		// directories hold working state such as unfinished uploads, except
+		// for the attachment versions, which are kept like attachments.
+		if d.IsDir() {
+			if rel != "." && rel != ".versions" && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if err := os.MkdirAll(destPath, 0755); err != nil {
+				log.Printf("Error creating persistent directory %s: %v", destPath, err)
+				return filepath.SkipDir
 			}
+			return nil
+		}
 
-			fileName := fileInfo.Name()
-			srcPath := filepath.Join(pageDir, fileName)
-			destPath := filepath.Join(persistentPageDir, fileName)
+		// Skip temporary files of writes still in progress
+		if strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
 
-			// Copy the file
-			if err := copyFile(srcPath, destPath); err != nil {
-				log.Printf("Error copying file %s: %v", srcPath, err)
-			} else {
-				log.Printf("Backed up attachment %s to %s", srcPath, destPath)
+		// Versions never change once written, so each is copied only once
+		if strings.HasPrefix(rel, ".versions"+string(filepath.Separator)) {
+			if _, err := os.Stat(destPath); err == nil {
+				return nil
 			}
 		}
-	}
 
-	return nil
+		// Copy the file while its page is not being modified. An
+		// attachment that no longer matches its digest has gone bad here,
+		// and the mirror's copy is what fsck repairs it from.
+		unlock := func() {}
+		title, ok := attachmentDirTitle(filepath.Dir(rel))
+		if ok {
+			unlock = pageLocks.RLock(title)
+			if !intactAttachment(title, d.Name(), srcPath) {
+				unlock()
+				log.Printf("Not backing up %s, which doesn't match its recorded digest", srcPath)
+				return nil
+			}
+		}
+		err = copyFile(srcPath, destPath)
+		unlock()
+		if err != nil {
+			log.Printf("Error copying file %s: %v", srcPath, err)
+		} else {
+			log.Printf("Backed up attachment %s to %s", srcPath, destPath)
+		}
+		return nil
+	})
 }
 
-// copyFile copies a single file from src to dst
+// copyFile copies a single file from src to dst, replacing dst atomically
+// so an interrupted copy never leaves a truncated file behind
 func copyFile(src, dst string) error {
-	// Open source file
-	sourceFile, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer sourceFile.Close()
-
-	// Create destination file
-	destFile, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer destFile.Close()
-
-	// Copy the content
-	_, err = io.Copy(destFile, sourceFile)
-	if err != nil {
-		return err
-	}
-
-	// Sync to ensure write is complete
-	return destFile.Sync()
+	return copyFileAtomic(src, dst, 0644)
 }
 
 // RestoreAllFiles restores all wiki files and attachments from persistent storage
@@ -154,8 +200,8 @@ func RestoreAllFiles() {
 		return
 	}
 	
-	// Get all files from persistent directory (both .txt and .files.txt)
-	allFiles, err := filepath.Glob(filepath.Join(persistentDir, "*.txt"))
+	// Get all files from persistent directory (.txt, .files.txt and .meta.json)
+	allFiles, err := findPageFiles(persistentDir)
 	if err != nil {
 		log.Printf("Error finding persistent files: %v", err)
 		return
@@ -165,34 +211,8 @@ func RestoreAllFiles() {
 	restoredPages := make(map[string]bool)
 	
 	// Process all files from persistent storage
-	for _, persistentFile := range allFiles {
-		fileName := filepath.Base(persistentFile)
-		destPath := fileName
-		
-		// Read from persistent storage
-		content, err := os.ReadFile(persistentFile)
-		if err != nil {
-			log.Printf("Error reading persistent file %s: %v", persistentFile, err)
-			continue
-		}
-		
-		// Write to app directory
-		if err := os.WriteFile(destPath, content, 0600); err != nil {
-			log.Printf("Error restoring file %s: %v", fileName, err)
-		} else {
-			log.Printf("Restored %s from persistent storage", fileName)
-			
-			// For regular txt files (not .files.txt), also restore the attachments
-			if !strings.HasSuffix(fileName, ".files.txt") {
-				title := strings.TrimSuffix(fileName, ".txt")
-				restoredPages[title] = true
-				
-				// Restore any uploaded files for this page
-				if err := RestoreUploadedFiles(title); err != nil {
-					log.Printf("Error restoring uploaded files for %s: %v", title, err)
-				}
-			}
-		}
+	for _, fileName := range allFiles {
+		restorePageFile(fileName, restoredPages)
 	}
 	
 	// Now check for pages with attachments but no .files.txt
@@ -210,6 +230,47 @@ func RestoreAllFiles() {
 	}
 }
 
+// restorePageFile copies one page file from persistent storage back into
+// the app directory, holding the page's lock while it does
+func restorePageFile(fileName string, restoredPages map[string]bool) {
+	persistentFile := filepath.Join(persistentDir, fileName)
+	destPath := fileName
+	title, ok := titleFromPageFile(fileName)
+	if !ok {
+		return
+	}
+	unlock := pageLocks.Lock(title)
+	defer unlock()
+	
+	// Read from persistent storage
+	content, err := os.ReadFile(persistentFile)
+	if err != nil {
+		log.Printf("Error reading persistent file %s: %v", persistentFile, err)
+		return
+	}
+	
+	// Write to app directory
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		log.Printf("Error restoring file %s: %v", fileName, err)
+		return
+	}
+	if err := writeFileAtomic(destPath, content, 0600); err != nil {
+		log.Printf("Error restoring file %s: %v", fileName, err)
+	} else {
+		log.Printf("Restored %s from persistent storage", fileName)
+		
+		// For regular txt files (not .files.txt), also restore the attachments
+		if _, ok := titleFromFilename(fileName); ok {
+			restoredPages[title] = true
+			
+			// Restore any uploaded files for this page
+			if err := RestoreUploadedFiles(title); err != nil {
+				log.Printf("Error restoring uploaded files for %s: %v", title, err)
+			}
+		}
+	}
+}
+
 // regenerateAttachmentMetadata ensures all pages with attachments have proper .files.txt metadata files
 func regenerateAttachmentMetadata(restoredPages map[string]bool) {
 	// Check the persistent files directory
@@ -218,84 +279,106 @@ func regenerateAttachmentMetadata(restoredPages map[string]bool) {
 		return
 	}
 	
-	// Get all directories in the persistent files directory
-	dirs, err := os.ReadDir(persistentFilesDir)
-	if err != nil {
-		log.Printf("Error reading persistent files directory: %v", err)
-		return
-	}
-	
-	// For each page directory
-	for _, dir := range dirs {
-		if !dir.IsDir() {
-			continue
+	// Walk the persistent files directory; every attachment directory
+	// belongs to the page at the path above it
+	err := filepath.WalkDir(persistentFilesDir, func(dirPath string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || dirPath == persistentFilesDir {
+			return nil
+		}
+		rel, err := filepath.Rel(persistentFilesDir, dirPath)
+		if err != nil {
+			return nil
+		}
+		pageName, ok := attachmentDirTitle(rel)
+		if !ok {
+			if _, ok := decodeTitle(rel); !ok {
+				return filepath.SkipDir
+			}
+			return nil
 		}
-		
-		pageName := dir.Name()
 		// If we already processed this page, skip it
 		if restoredPages[pageName] {
-			continue
+			return nil
 		}
+		unlock := pageLocks.Lock(pageName)
+		defer unlock()
 		
 		// Check if we have attachments for this page
-		pageDir := filepath.Join(persistentFilesDir, pageName)
-		files, err := os.ReadDir(pageDir)
-		if err != nil || len(files) == 0 {
-			continue
+		files, err := os.ReadDir(dirPath)
+		if err != nil {
+			return nil
+		}
+		
+		// Build the list of attachment filenames
+		var fileNames []string
+		for _, file := range files {
+			if !file.IsDir() {
+				fileNames = append(fileNames, file.Name())
+			}
+		}
+		if len(fileNames) == 0 {
+			return nil
 		}
 		
 		// Create the page .txt file if it doesn't exist (empty content)
-		pageFile := pageName + ".txt"
+		pageFile := pageFilename(pageName)
 		if _, err := os.Stat(pageFile); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(pageFile), 0755); err != nil {
+				log.Printf("Error restoring page file %s: %v", pageFile, err)
+				return nil
+			}
 			// Look for it in persistent storage first
 			persistentPageFile := filepath.Join(persistentDir, pageFile)
 			if _, err := os.Stat(persistentPageFile); err == nil {
 				// File exists in persistent storage, copy it
 				content, err := os.ReadFile(persistentPageFile)
 				if err == nil {
-					if err := os.WriteFile(pageFile, content, 0600); err != nil {
+					if err := writeFileAtomic(pageFile, content, 0600); err != nil {
 						log.Printf("Error restoring page file %s: %v", pageFile, err)
 					}
 				}
 			} else {
 				// Create empty page file
-				if err := os.WriteFile(pageFile, []byte{}, 0600); err != nil {
+				if err := writeStoredFile(pageFile, []byte{}, 0600); err != nil {
 					log.Printf("Error creating empty page file %s: %v", pageFile, err)
-					continue
+					return nil
 				}
 			}
 		}
 		
-		// Build the list of attachment filenames
-		var fileNames []string
-		for _, file := range files {
-			if !file.IsDir() {
-				fileNames = append(fileNames, file.Name())
-			}
+		// Restore the actual files to the app directory first, so the list
+		// only names attachments that are really there
+		if err := RestoreUploadedFiles(pageName); err != nil {
+			log.Printf("Error restoring generated attachment files for %s: %v", pageName, err)
+		}
+		fileNames = slices.DeleteFunc(fileNames, func(name string) bool {
+			_, err := os.Stat(filepath.Join(pageFilesDir(pageName), name))
+			return err != nil
+		})
+		if len(fileNames) == 0 {
+			return nil
 		}
 		
-		if len(fileNames) > 0 {
-			// Create or update the .files.txt metadata file
-			filesListFilename := pageName + ".files.txt"
-			filesContent := strings.Join(fileNames, "\n")
-			if err := os.WriteFile(filesListFilename, []byte(filesContent), 0600); err != nil {
-				log.Printf("Error creating metadata file %s: %v", filesListFilename, err)
-			} else {
-				log.Printf("Generated metadata file for %s with %d attachments", pageName, len(fileNames))
-			}
-			
-			// Also restore the actual files to the app directory
-			if err := RestoreUploadedFiles(pageName); err != nil {
-				log.Printf("Error restoring generated attachment files for %s: %v", pageName, err)
-			}
+		// Create or update the .files.txt metadata file
+		filesListFilename := filesListFilename(pageName)
+		filesContent := strings.Join(fileNames, "\n")
+		if err := writeStoredFile(filesListFilename, []byte(filesContent), 0600); err != nil {
+			log.Printf("Error creating metadata file %s: %v", filesListFilename, err)
+		} else {
+			log.Printf("Generated metadata file for %s with %d attachments", pageName, len(fileNames))
 		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error reading persistent files directory: %v", err)
 	}
 }
 
-// RestoreUploadedFiles restores all uploaded files for a specific page
+// RestoreUploadedFiles restores all uploaded files for a specific page.
+// Callers must hold the page's lock in pageLocks.
 func RestoreUploadedFiles(title string) error {
 	// Source directory in persistent storage
-	srcDir := filepath.Join(persistentDir, "files", title)
+	srcDir, _ := backupAttachmentPath(pageFilesDir(title))
 	
 	// Check if the directory exists in persistent storage
 	if _, err := os.Stat(srcDir); os.IsNotExist(err) {
@@ -304,7 +387,7 @@ func RestoreUploadedFiles(title string) error {
 	}
 	
 	// Destination directory in app
-	destDir := filepath.Join(filesDir, title)
+	destDir := pageFilesDir(title)
 	if err := os.MkdirAll(destDir, 0755); err != nil {
 		return err
 	}
@@ -325,7 +408,6 @@ func RestoreUploadedFiles(title string) error {
 		}
 		
 		fileName := fileInfo.Name()
-		fileNames = append(fileNames, fileName)
 		srcPath := filepath.Join(srcDir, fileName)
 		destPath := filepath.Join(destDir, fileName)
 		
@@ -333,22 +415,26 @@ func RestoreUploadedFiles(title string) error {
 			log.Printf("Error restoring file %s: %v", fileName, err)
 		} else {
 			log.Printf("Restored file %s for page %s", fileName, title)
+			fileNames = append(fileNames, fileName)
 			filesCopied = true
 		}
 	}
 	
+	restoreVersions(title)
+
 	// If we successfully copied files, ensure the metadata file exists
 	if filesCopied && len(fileNames) > 0 {
-		filesListFilename := title + ".files.txt"
+		filesListFilename := filesListFilename(title)
 		// Check if the file exists first
 		_, err := os.Stat(filesListFilename)
 		if os.IsNotExist(err) {
 			// File doesn't exist, create it
 			filesContent := strings.Join(fileNames, "\n")
-			if err := os.WriteFile(filesListFilename, []byte(filesContent), 0600); err != nil {
+			if err := writeStoredFile(filesListFilename, []byte(filesContent), 0600); err != nil {
 				log.Printf("Error creating missing metadata file %s: %v", filesListFilename, err)
 			} else {
 				log.Printf("Created missing metadata file for %s with %d attachments", title, len(fileNames))
+				cache.invalidate(title)
 			}
 		}
 	}
@@ -358,18 +444,34 @@ func RestoreUploadedFiles(title string) error {
 
 // SetupFileWatcher performs initial backup and restoration of wiki files at startup
 func SetupFileWatcher() {
+	// Move pages stored under pre-normalization names to their encoded paths
+	MigrateTitles(persistentDir, filepath.Join(persistentDir, "files"))
+	MigrateTitles(".", filesDir)
+	MigrateAttachmentDirs(filepath.Join(persistentDir, "files"))
+	MigrateAttachmentDirs(filesDir)
+
 	// First restore all files from persistent storage
 	RestoreAllFiles()
 	log.Println("Initial restoration completed.")
 	
+	// Finish any page saves a crash interrupted; they are newer than the backup
+	RecoverJournals()
+
+	// Pages may have been rewritten underneath anything already cached
+	cache.purge()
+
 	// Then backup any new files
 	BackupWikiFiles()
 	log.Println("Initial backup completed. Automatic backups will occur after file modifications.")
 }
 
-// RestoreWikiFile tries to load a file from the persistent directory if it doesn't exist in the app directory
+// RestoreWikiFile tries to load a file from the persistent directory if it doesn't exist in the app directory.
+// It runs from loadPage, so callers must hold the page's lock in pageLocks,
+// read or write; restores of the same page take turns through restoreLocks.
 func RestoreWikiFile(title string) error {
-	filename := title + ".txt"
+	unlock := restoreLocks.Lock(title)
+	defer unlock()
+	filename := pageFilename(title)
 	
 	// Check if the file exists in the app directory
 	if _, err := os.Stat(filename); err == nil {
@@ -391,15 +493,89 @@ func RestoreWikiFile(title string) error {
 	}
 	
 	// Write to app directory
-	if err := os.WriteFile(filename, content, 0600); err != nil {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
 		return err
 	}
+	if err := writeFileAtomic(filename, content, 0600); err != nil {
+		return err
+	}
+	
+	// Restore the page's sidecars (attachment list and metadata)
+	for _, sidecar := range []string{filesListFilename(title), metaFilename(title)} {
+		content, err := os.ReadFile(filepath.Join(persistentDir, sidecar))
+		if err != nil {
+			continue
+		}
+		if err := writeFileAtomic(sidecar, content, 0600); err != nil {
+			log.Printf("Error restoring %s: %v", sidecar, err)
+		}
+	}
 	
 	// Also restore any uploaded files for this page
 	if err := RestoreUploadedFiles(title); err != nil {
 		log.Printf("Error restoring uploaded files for %s: %v", title, err)
 	}
 	
+	catalog.refresh(title)
+	cache.invalidate(title)
+	log.Printf("Restored %s from persistent storage", filename)
+	return nil
+} 
+
+// restoreMeta brings back a page's metadata from persistent storage when
+// the working copy is missing or unreadable, so losing the sidecar can't
+// quietly drop settings such as the page's password. Callers must hold the
+// page's lock in pageLocks.
+func restoreMeta(title string) {
+	unlock := restoreLocks.Lock(title)
+	defer unlock()
+	filename := metaFilename(title)
+	if data, err := readStored(filename); err == nil && json.Valid(data) {
+		return
+	}
+	// The copy is restored as it is stored, encrypted or not
+	backup := filepath.Join(persistentDir, filename)
+	if data, err := readStored(backup); err != nil || !json.Valid(data) {
+		return
+	}
+	content, err := os.ReadFile(backup)
+	if err != nil {
+		return
+	}
+	if err := writeFileAtomic(filename, content, 0600); err != nil {
+		log.Printf("Error restoring %s: %v", filename, err)
+		return
+	}
 	log.Printf("Restored %s from persistent storage", filename)
+}
+
+// backupPage copies one page's body, files list and metadata to persistent
+// storage, for changes that shouldn't wait for a full BackupWikiFiles run.
+// A files list the page no longer has is removed from the backup too.
+// Callers must hold the page's lock in pageLocks.
+func backupPage(title string) error {
+	for _, file := range []string{pageFilename(title), filesListFilename(title), metaFilename(title)} {
+		destPath := filepath.Join(persistentDir, file)
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			os.Remove(destPath)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+			return err
+		}
+		if err := copyFileAtomic(file, destPath, 0600); err != nil {
+			return err
+		}
+	}
 	return nil
-} 
\ No newline at end of file
+}
+
+// backupAttachmentPath is where the backup keeps the file at path, which
+// lies below filesDir
+func backupAttachmentPath(path string) (string, bool) {
+	rel, err := filepath.Rel(filesDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return filepath.Join(persistentDir, "files", rel), true
+}
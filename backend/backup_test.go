@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeTestPage saves a page with one attachment and backs it up
+func writeTestPage(t *testing.T, title, file, content string) {
+	t.Helper()
+	if err := os.MkdirAll(pageFilesDir(title), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pageFilesDir(title), file), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := &Page{Title: title, Body: []byte("body of " + title), Files: []string{file}}
+	if err := os.MkdirAll(filepath.Dir(pageFilename(title)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitPage(p); err != nil {
+		t.Fatal(err)
+	}
+	BackupWikiFiles()
+}
+
+// checkRestored loads title and checks its body and attachment came back
+func checkRestored(t *testing.T, title, file, content string) {
+	t.Helper()
+	cache.purge()
+	unlock := pageLocks.Lock(title)
+	p, err := loadPage(title)
+	unlock()
+	if err != nil {
+		t.Fatalf("loading %q after restore: %v", title, err)
+	}
+	if string(p.Body) != "body of "+title {
+		t.Errorf("body of %q = %q", title, p.Body)
+	}
+	if !slices.Equal(p.Files, []string{file}) {
+		t.Errorf("attachments of %q = %q, want [%s]", title, p.Files, file)
+	}
+	data, err := os.ReadFile(filepath.Join(pageFilesDir(title), file))
+	if err != nil || string(data) != content {
+		t.Errorf("attachment %s of %q = %q, %v", file, title, data, err)
+	}
+}
+
+func TestRestoreMixedCaseTitle(t *testing.T) {
+	for _, title := range []string{"Meeting Notes", "Team/Q3_Plan", "Café"} {
+		t.Run(title, func(t *testing.T) {
+			testWiki(t)
+			writeTestPage(t, title, "Report.txt", "figures")
+
+			// Lose the whole working copy and restore it at startup
+			os.RemoveAll(filesDir)
+			for _, path := range []string{pageFilename(title), filesListFilename(title), metaFilename(title)} {
+				os.Remove(path)
+			}
+			RestoreAllFiles()
+			checkRestored(t, title, "Report.txt", "figures")
+
+			// Lose the attachment list as well, in the backup too, so it has
+			// to be rebuilt from the backed-up files
+			os.RemoveAll(filesDir)
+			os.Remove(filesListFilename(title))
+			os.Remove(filepath.Join(persistentDir, filesListFilename(title)))
+			RestoreAllFiles()
+			checkRestored(t, title, "Report.txt", "figures")
+
+			// Restore on demand when the page is first loaded
+			os.RemoveAll(filesDir)
+			for _, path := range []string{pageFilename(title), filesListFilename(title), metaFilename(title)} {
+				os.Remove(path)
+			}
+			checkRestored(t, title, "Report.txt", "figures")
+		})
+	}
+}
+
+// TestAttachmentNamedLikeNestedPage gives a page an attachment with the
+// name its nested page has on disk, in both orders, and takes the pages
+// through delete, backup and restore
+func TestAttachmentNamedLikeNestedPage(t *testing.T) {
+	testWiki(t)
+	for _, upload := range []struct{ title, file, content string }{
+		{"a/b", "inner.txt", "inner a/b"},
+		{"a", "b", "outer a"},
+		{"c", "d", "outer c"},
+		{"c/d", "inner.txt", "inner c/d"},
+	} {
+		if w := postFile(upload.title, upload.file, upload.content); w.Code != http.StatusOK {
+			t.Fatalf("uploading %s to %q: %d %s", upload.file, upload.title, w.Code, w.Body)
+		}
+	}
+	for path, want := range map[string]string{
+		"/files/a/b":           "outer a",
+		"/files/a/b/inner.txt": "inner a/b",
+		"/files/c/d":           "outer c",
+		"/files/c/d/inner.txt": "inner c/d",
+	} {
+		w := httptest.NewRecorder()
+		filesHandler(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("GET %s = %d %q, want %q", path, w.Code, w.Body, want)
+		}
+	}
+	for _, title := range []string{"a", "a/b", "c", "c/d"} {
+		checkConsistent(t, title)
+	}
+
+	// Deleting the outer page leaves the nested one's files
+	if w := postForm(testDelete, "/delete/a", nil); w.Code != http.StatusFound {
+		t.Fatalf("deleting a: %d %s", w.Code, w.Body)
+	}
+	if got := attachmentContent("a/b", "inner.txt"); got != "inner a/b" {
+		t.Errorf("inner.txt of a/b after deleting a = %q", got)
+	}
+
+	BackupWikiFiles()
+	os.RemoveAll(filesDir)
+	RestoreAllFiles()
+	for _, f := range []struct{ title, file, want string }{
+		{"a/b", "inner.txt", "inner a/b"},
+		{"c", "d", "outer c"},
+		{"c/d", "inner.txt", "inner c/d"},
+	} {
+		if got := attachmentContent(f.title, f.file); got != f.want {
+			t.Errorf("%s of %q after restore = %q, want %q", f.file, f.title, got, f.want)
+		}
+	}
+}
+
+// TestMigrateAttachmentDirs moves attachments from where pages kept them
+// before attachmentsDirName, including one that has its name
+func TestMigrateAttachmentDirs(t *testing.T) {
+	testWiki(t)
+	legacy := map[string]string{
+		"_4eotes/plan.txt":  "plan",
+		"_4eotes/_files":    "named like the directory",
+		"_4eotes/sub/x.txt": "nested page's file",
+	}
+	for rel, content := range legacy {
+		path := filepath.Join(filesDir, filepath.FromSlash(rel))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for range 2 {
+		MigrateAttachmentDirs(filesDir)
+		for _, f := range []struct{ title, file, want string }{
+			{"Notes", "plan.txt", "plan"},
+			{"Notes", "_files", "named like the directory"},
+			{"Notes/sub", "x.txt", "nested page's file"},
+		} {
+			if got := attachmentContent(f.title, f.file); got != f.want {
+				t.Errorf("%s of %q after migrating = %q, want %q", f.file, f.title, got, f.want)
+			}
+		}
+	}
+	entries, _ := os.ReadDir(filepath.Join(filesDir, "_4eotes"))
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !slices.Equal(names, []string{attachmentsDirName, "sub"}) {
+		t.Errorf("page directory after migrating holds %q", names)
+	}
+}
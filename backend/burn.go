@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// A page marked burn-after-reading can be read exactly once, for handing
+// over something like a password. GET and HEAD of /view/{title} or
+// /raw/{title} only show a confirmation page, so link previewers, chat
+// unfurlers and crawlers can't use the read up. POSTing the confirmation
+// returns the page and deletes it along with its attachments, versions and
+// backups, and later requests get 410 Gone. Until then the body is kept
+// out of the editor, the JSON API and collaborative editing.
+
+var errBurnt = errors.New("This page could only be read once and has been read")
+
+// errReadOnce answers requests that would show a burn-after-reading page
+// anywhere but its one read
+var errReadOnce = errors.New("This page can only be read once, by confirming at /view/ or /raw/")
+
+// BurnPage is the data for the burn.html confirmation page
+type BurnPage struct {
+	Title  string
+	Action string // URL the confirmation posts to
+	Files  int    // attachments deleted along with the page
+}
+
+// isBurnPage reports whether title is an unread burn-after-reading page
+func isBurnPage(title string) bool {
+	unlock := pageLocks.RLock(title)
+	defer unlock()
+	p, err := loadPage(title)
+	return err == nil && p.Meta.BurnAfterReading
+}
+
+// burnPage takes the page for its one read and deletes it. The page lock is
+// held from load to delete so only one reader gets it. A page that is no
+// longer burn-after-reading is returned untouched.
+func burnPage(title string) (*Page, error) {
+	// Close any collaborative session first so it can't save the page back
+	collabs.drop(title)
+
+	unlock := pageLocks.Lock(title)
+	defer unlock()
+
+	p, err := loadPage(title)
+	if err != nil {
+		return nil, errBurnt
+	}
+	if !p.Meta.BurnAfterReading {
+		return p, nil
+	}
+	bury(title, "")
+	if err := removePage(title); err != nil {
+		return nil, err
+	}
+	// The attachments went with the page
+	p.Files = nil
+	return p, nil
+}
+
+// serveBurnPage answers /view/{title} and /raw/{title} for a
+// burn-after-reading page p
+func serveBurnPage(w http.ResponseWriter, r *http.Request, p *Page, raw bool) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	if r.Method != "POST" {
+		action := "/view/" + p.Title
+		if raw {
+			action = "/raw/" + p.Title
+		}
+		// Someone let in by a share link confirms with it too
+		if _, ok := sharedLink(r); ok {
+			action += "?share=" + url.QueryEscape(r.URL.Query().Get("share"))
+		}
+		err := templates.ExecuteTemplate(w, "burn.html", &BurnPage{Title: p.Title, Action: action, Files: len(p.Files)})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	p, err := burnPage(p.Title)
+	if errors.Is(err, errBurnt) {
+		goneError(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error reading page: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if raw {
+		serveRaw(w, p)
+		return
+	}
+	if _, ok := sharedLink(r); ok {
+		p.Share = r.URL.Query().Get("share")
+	}
+	renderTemplate(w, "view", p)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// saveBurnPage saves a burn-after-reading page with one attachment
+func saveBurnPage(t *testing.T, title, body string) {
+	t.Helper()
+	if w := postFile(title, "key.txt", "attached secret"); w.Code != http.StatusOK {
+		t.Fatal(w.Body)
+	}
+	if w := postForm(testSave, "/save/"+title, url.Values{"body": {body}, "meta": {"1"}, "burn_after_reading": {"1"}}); w.Code != http.StatusFound {
+		t.Fatalf("saving %s: %d %s", title, w.Code, w.Body)
+	}
+}
+
+// readPage requests /view/ or /raw/ of title with method
+func readPage(method, route, title string) *httptest.ResponseRecorder {
+	handler := makeHandler(viewHandler)
+	if route == "raw" {
+		handler = makeHandler(rawHandler)
+	}
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, "/"+route+"/"+title, nil))
+	return w
+}
+
+func TestBurnAfterReading(t *testing.T) {
+	testWiki(t)
+	saveBurnPage(t, "Handover", "the password is swordfish")
+	t.Cleanup(func() { unbury("Handover", "") })
+
+	// Looking doesn't use the read up
+	for _, method := range []string{"GET", "HEAD"} {
+		for _, route := range []string{"view", "raw"} {
+			w := readPage(method, route, "Handover")
+			if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "swordfish") {
+				t.Errorf("%s /%s/: %d %s", method, route, w.Code, w.Body)
+			}
+			if w.Header().Get("Cache-Control") != "no-store" || w.Header().Get("X-Robots-Tag") == "" {
+				t.Errorf("%s /%s/ headers: %v", method, route, w.Header())
+			}
+		}
+	}
+	if w := readPage("GET", "view", "Handover"); !strings.Contains(w.Body.String(), `action="/view/Handover"`) || !strings.Contains(w.Body.String(), "1 attachment") {
+		t.Errorf("confirmation page: %s", w.Body)
+	}
+	if _, err := os.Stat(pageFilename("Handover")); err != nil {
+		t.Fatalf("the page went before it was read: %v", err)
+	}
+
+	w := readPage("POST", "view", "Handover")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "swordfish") {
+		t.Fatalf("reading: %d %s", w.Code, w.Body)
+	}
+	for _, path := range []string{pageFilename("Handover"), metaFilename("Handover"), filepath.Join(pageFilesDir("Handover"), "key.txt")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s is still there after the read: %v", path, err)
+		}
+	}
+	for _, route := range []string{"view", "raw"} {
+		for _, method := range []string{"GET", "POST"} {
+			if w := readPage(method, route, "Handover"); w.Code != http.StatusGone {
+				t.Errorf("%s /%s/ after the read: %d", method, route, w.Code)
+			}
+		}
+	}
+	if w := getFile("Handover", "key.txt"); w.Code != http.StatusGone {
+		t.Errorf("attachment after the read: %d", w.Code)
+	}
+}
+
+func TestBurnAfterReadingRaw(t *testing.T) {
+	testWiki(t)
+	saveBurnPage(t, "Token", "abc123")
+	t.Cleanup(func() { unbury("Token", "") })
+	w := readPage("POST", "raw", "Token")
+	if w.Code != http.StatusOK || w.Body.String() != "abc123" || w.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("raw read: %d %q %v", w.Code, w.Body, w.Header())
+	}
+	if w := readPage("POST", "raw", "Token"); w.Code != http.StatusGone {
+		t.Errorf("second raw read: %d", w.Code)
+	}
+}
+
+// TestBurnAfterReadingOnce checks that readers racing for the page don't
+// both get it
+func TestBurnAfterReadingOnce(t *testing.T) {
+	testWiki(t)
+	saveBurnPage(t, "Race", "only once")
+	t.Cleanup(func() { unbury("Race", "") })
+	var wg sync.WaitGroup
+	codes := make(chan int, 8)
+	for i := range cap(codes) {
+		route := "raw"
+		if i%2 == 1 {
+			route = "view"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := readPage("POST", route, "Race")
+			if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), "only once") {
+				t.Errorf("read %q", w.Body)
+			}
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	read := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			read++
+		case http.StatusGone:
+		default:
+			t.Errorf("reader got %d", code)
+		}
+	}
+	if read != 1 {
+		t.Errorf("the page was read %d times", read)
+	}
+}
+
+// TestBurnPageHidden checks the places other than its one read that would
+// show a burn-after-reading page
+func TestBurnPageHidden(t *testing.T) {
+	testWiki(t)
+	saveBurnPage(t, "Hidden", "not for the editor")
+
+	w := httptest.NewRecorder()
+	apiGetPageHandler(w, httptest.NewRequest("GET", "/api/page?title=Hidden", nil))
+	if w.Code != http.StatusForbidden || strings.Contains(w.Body.String(), "not for the editor") {
+		t.Errorf("JSON API: %d %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	makeHandler(editHandler)(w, httptest.NewRequest("GET", "/edit/Hidden", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "not for the editor") {
+		t.Errorf("editor: %d", w.Code)
+	}
+
+	// Saving from the editor without typing keeps the text
+	form := url.Values{"body": {""}, "keep_body": {"1"}, "meta": {"1"}, "burn_after_reading": {"1"}}
+	if w := postForm(testSave, "/save/Hidden", form); w.Code != http.StatusFound {
+		t.Fatal(w.Body)
+	}
+	cache.purge()
+	if p, err := loadPage("Hidden"); err != nil || string(p.Body) != "not for the editor" || !p.Meta.BurnAfterReading {
+		t.Errorf("after saving from the editor: %v, %v", p, err)
+	}
+
+	// Once it is no longer burn-after-reading, reading leaves it alone
+	if w := postForm(testSave, "/save/Hidden", url.Values{"body": {"public now"}, "meta": {"1"}}); w.Code != http.StatusFound {
+		t.Fatal(w.Body)
+	}
+	if w := readPage("GET", "raw", "Hidden"); w.Body.String() != "public now" {
+		t.Errorf("raw of the ordinary page: %q", w.Body)
+	}
+	if p, err := burnPage("Hidden"); err != nil || string(p.Body) != "public now" {
+		t.Errorf("burnPage of an ordinary page: %v, %v", p, err)
+	}
+	if _, err := os.Stat(pageFilename("Hidden")); err != nil {
+		t.Errorf("an ordinary page was deleted: %v", err)
+	}
+}
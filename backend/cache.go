@@ -0,0 +1,129 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// pageCache is a bounded LRU of parsed pages so views, edits and API calls
+// don't re-read the same files on every request. Page.save writes through
+// it; every other path that changes a page on disk must invalidate it.
+type pageCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List // front is most recently used
+	items    map[string]*list.Element
+	hits     uint64
+	misses   uint64
+}
+
+// cacheStats is reported by /api/cache
+type cacheStats struct {
+	Enabled  bool   `json:"enabled"`
+	Size     int    `json:"size"`
+	Capacity int    `json:"capacity"`
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+}
+
+// WIKI_PAGE_CACHE=false or WIKI_PAGE_CACHE_SIZE=0 turns the cache off
+var cache = newPageCache(envBool("WIKI_PAGE_CACHE", true), int(envInt("WIKI_PAGE_CACHE_SIZE", 256)))
+
+func newPageCache(enabled bool, capacity int) *pageCache {
+	if !enabled || capacity < 0 {
+		capacity = 0
+	}
+	return &pageCache{capacity: capacity, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+// get returns a private copy of the cached page, if any
+func (c *pageCache) get(title string) (*Page, bool) {
+	if c.capacity == 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[title]; ok {
+		c.hits++
+		c.ll.MoveToFront(el)
+		return el.Value.(*Page).clone(), true
+	}
+	c.misses++
+	return nil, false
+}
+
+// put stores a copy of p, evicting the least recently used page when full
+func (c *pageCache) put(p *Page) {
+	if c.capacity == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[p.Title]; ok {
+		el.Value = p.clone()
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[p.Title] = c.ll.PushFront(p.clone())
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*Page).Title)
+	}
+}
+
+// invalidate drops one page, e.g. after it was deleted or restored
+func (c *pageCache) invalidate(title string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[title]; ok {
+		c.ll.Remove(el)
+		delete(c.items, title)
+	}
+}
+
+// purge drops every page, e.g. after a bulk restore
+func (c *pageCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+func (c *pageCache) stats() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return cacheStats{
+		Enabled:  c.capacity > 0,
+		Size:     c.ll.Len(),
+		Capacity: c.capacity,
+		Hits:     c.hits,
+		Misses:   c.misses,
+	}
+}
+
+// clone deep-copies a page so callers can modify it without touching the
+// cached copy
+func (p *Page) clone() *Page {
+	cp := *p
+	cp.Body = append([]byte(nil), p.Body...)
+	cp.Files = append([]string(nil), p.Files...)
+	cp.Meta.Tags = append([]string(nil), p.Meta.Tags...)
+	cp.Meta.Shares = append([]ShareLink(nil), p.Meta.Shares...)
+	if p.Meta.Attachments != nil {
+		cp.Meta.Attachments = make(map[string]AttachmentMeta, len(p.Meta.Attachments))
+		for name, a := range p.Meta.Attachments {
+			cp.Meta.Attachments[name] = a
+		}
+	}
+	return &cp
+}
+
+// apiCacheHandler reports the page cache counters as JSON
+func apiCacheHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cache.stats())
+}
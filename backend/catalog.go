@@ -0,0 +1,295 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pageCatalog is an in-memory list of every page and the metadata the index
+// needs, so listing the home page never has to walk the disk. It is built
+// once at startup and updated by every code path that writes or removes a
+// page.
+type pageCatalog struct {
+	mu      sync.RWMutex
+	entries map[string]catalogEntry
+}
+
+// catalogEntry is what the catalog knows about one page
+type catalogEntry struct {
+	Title       string
+	Size        int64
+	Modified    time.Time
+	Created     time.Time
+	Tags        []string
+	Pinned      bool
+	Expires     time.Time // when the page expires, zero for never
+	FileExpires time.Time // when the first of its attachments expires
+}
+
+var catalog = &pageCatalog{entries: make(map[string]catalogEntry)}
+
+// Sort keys accepted by ?sort= on the index and /api/pages
+const (
+	sortModified = "modified"
+	sortCreated  = "created"
+	sortName     = "name"
+	sortSize     = "size"
+)
+
+const (
+	defaultPerPage = 50
+	maxPerPage     = 500
+)
+
+// indexQuery describes one listing request
+type indexQuery struct {
+	Namespace string
+	Filter    string // Case-insensitive substring of the title
+	Tag       string
+	Sort      string
+	Desc      bool
+	Page      int // 1-based
+	PerPage   int
+}
+
+// rebuild replaces the catalog with a fresh scan of the working directory
+func (c *pageCatalog) rebuild() {
+	entries := make(map[string]catalogEntry)
+	for _, title := range getAllPages() {
+		if entry, ok := scanCatalogEntry(title); ok {
+			entries[title] = entry
+		}
+	}
+	c.mu.Lock()
+	c.entries = entries
+	c.mu.Unlock()
+}
+
+// refresh re-reads one page from disk, dropping it if it no longer exists
+func (c *pageCatalog) refresh(title string) {
+	entry, ok := scanCatalogEntry(title)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok {
+		c.entries[title] = entry
+	} else {
+		delete(c.entries, title)
+	}
+}
+
+// remove drops a deleted page
+func (c *pageCatalog) remove(title string) {
+	c.mu.Lock()
+	delete(c.entries, title)
+	c.mu.Unlock()
+}
+
+// get returns the entry of one page
+func (c *pageCatalog) get(title string) (catalogEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[title]
+	return entry, ok
+}
+
+// expiring returns the entries of pages that expire or have attachments
+// that do
+func (c *pageCatalog) expiring() []catalogEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var entries []catalogEntry
+	for _, entry := range c.entries {
+		if !entry.Expires.IsZero() || !entry.FileExpires.IsZero() {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// scanCatalogEntry builds the catalog entry of a page from its files
+func scanCatalogEntry(title string) (catalogEntry, bool) {
+	size, err := storedSize(pageFilename(title))
+	if err != nil {
+		return catalogEntry{}, false
+	}
+	meta := loadMeta(title)
+	var fileExpires time.Time
+	for _, a := range meta.Attachments {
+		if !a.Expires.IsZero() && (fileExpires.IsZero() || a.Expires.Before(fileExpires)) {
+			fileExpires = a.Expires
+		}
+	}
+	return catalogEntry{
+		Title:       title,
+		Size:        size,
+		Modified:    meta.Updated,
+		Created:     meta.Created,
+		Tags:        meta.Tags,
+		Pinned:      meta.Pinned,
+		Expires:     meta.Expires,
+		FileExpires: fileExpires,
+	}, true
+}
+
+// query returns one page of the entries matching q, the total number of
+// matches and, when q is a plain namespace listing, the child namespaces.
+// A plain listing holds only the pages directly inside q.Namespace; a
+// filtered one (text or tag) searches everything below it.
+func (c *pageCatalog) query(q indexQuery) ([]catalogEntry, int, []string) {
+	prefix := ""
+	if q.Namespace != "" {
+		prefix = q.Namespace + "/"
+	}
+	search := q.Filter != "" || q.Tag != ""
+	filter := strings.ToLower(q.Filter)
+
+	c.mu.RLock()
+	var matches []catalogEntry
+	childSet := make(map[string]bool)
+	for title, entry := range c.entries {
+		if !strings.HasPrefix(title, prefix) || expired(entry.Expires) {
+			continue
+		}
+		rest := strings.TrimPrefix(title, prefix)
+		if i := strings.Index(rest, "/"); i >= 0 && !search {
+			childSet[rest[:i]] = true
+			continue
+		}
+		if filter != "" && !strings.Contains(strings.ToLower(rest), filter) {
+			continue
+		}
+		if q.Tag != "" && !(PageMeta{Tags: entry.Tags}).HasTag(q.Tag) {
+			continue
+		}
+		matches = append(matches, entry)
+	}
+	c.mu.RUnlock()
+
+	sortEntries(matches, q.Sort, q.Desc)
+
+	children := make([]string, 0, len(childSet))
+	for child := range childSet {
+		children = append(children, child)
+	}
+	sort.Strings(children)
+
+	total := len(matches)
+	// Pages past the end are empty. Checking before multiplying keeps a
+	// huge ?page= from overflowing.
+	start := total
+	if q.Page-1 <= total/q.PerPage {
+		start = (q.Page - 1) * q.PerPage
+	}
+	if start < 0 || start > total {
+		start = total
+	}
+	end := start + q.PerPage
+	if end > total {
+		end = total
+	}
+	return matches[start:end], total, children
+}
+
+// sortEntries orders entries by key, keeping pinned pages first
+func sortEntries(entries []catalogEntry, key string, desc bool) {
+	less := func(a, b catalogEntry) bool {
+		switch key {
+		case sortCreated:
+			return a.Created.Before(b.Created)
+		case sortSize:
+			return a.Size < b.Size
+		case sortName:
+			return a.Title < b.Title
+		default:
+			return a.Modified.Before(b.Modified)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Pinned != b.Pinned {
+			return a.Pinned
+		}
+		if desc {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return entries[i].Title < entries[j].Title
+	})
+}
+
+// parseIndexQuery reads the listing parameters shared by the index page and
+// /api/pages. Unknown sort keys fall back to newest first.
+func parseIndexQuery(v url.Values) indexQuery {
+	q := indexQuery{
+		Namespace: v.Get("ns"),
+		Filter:    strings.TrimSpace(v.Get("q")),
+		Tag:       v.Get("tag"),
+		Sort:      v.Get("sort"),
+		Page:      1,
+		PerPage:   defaultPerPage,
+	}
+	switch q.Sort {
+	case sortName, sortCreated, sortSize, sortModified:
+	default:
+		q.Sort = sortModified
+	}
+	// Names read best A-Z; times and sizes newest/largest first
+	q.Desc = q.Sort != sortName
+	switch v.Get("order") {
+	case "asc":
+		q.Desc = false
+	case "desc":
+		q.Desc = true
+	}
+	if n, err := strconv.Atoi(v.Get("page")); err == nil && n > 0 {
+		q.Page = n
+	}
+	if n, err := strconv.Atoi(v.Get("per_page")); err == nil && n > 0 {
+		q.PerPage = n
+		if q.PerPage > maxPerPage {
+			q.PerPage = maxPerPage
+		}
+	}
+	return q
+}
+
+// values is the inverse of parseIndexQuery, used to build sort and paging
+// links that keep the rest of the query intact
+func (q indexQuery) values() url.Values {
+	v := url.Values{}
+	if q.Namespace != "" {
+		v.Set("ns", q.Namespace)
+	}
+	if q.Filter != "" {
+		v.Set("q", q.Filter)
+	}
+	if q.Tag != "" {
+		v.Set("tag", q.Tag)
+	}
+	if q.Sort != sortModified {
+		v.Set("sort", q.Sort)
+	}
+	if q.Desc != (q.Sort != sortName) {
+		if q.Desc {
+			v.Set("order", "desc")
+		} else {
+			v.Set("order", "asc")
+		}
+	}
+	if q.Page > 1 {
+		v.Set("page", strconv.Itoa(q.Page))
+	}
+	if q.PerPage != defaultPerPage {
+		v.Set("per_page", strconv.Itoa(q.PerPage))
+	}
+	return v
+}
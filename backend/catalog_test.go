@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testCatalog is a catalog of a few pages in two namespaces
+func testCatalog() *pageCatalog {
+	day := func(n int) time.Time { return time.Date(2026, 3, n, 12, 0, 0, 0, time.UTC) }
+	c := &pageCatalog{entries: make(map[string]catalogEntry)}
+	for _, entry := range []catalogEntry{
+		{Title: "Home", Size: 20, Created: day(1), Modified: day(1), Pinned: true},
+		{Title: "Alpha", Size: 10, Created: day(3), Modified: day(5), Tags: []string{"go"}},
+		{Title: "beta", Size: 30, Created: day(2), Modified: day(4)},
+		{Title: "Gamma", Size: 5, Created: day(4), Modified: day(3)},
+		{Title: "Old", Size: 1, Created: day(1), Modified: day(6), Expires: day(1)},
+		{Title: "work/Plan", Size: 8, Created: day(1), Modified: day(2), Tags: []string{"go", "work"}},
+		{Title: "work/aws/keys", Size: 3, Created: day(1), Modified: day(1)},
+	} {
+		c.entries[entry.Title] = entry
+	}
+	return c
+}
+
+func TestCatalogQuery(t *testing.T) {
+	c := testCatalog()
+	tests := []struct {
+		query    string
+		want     []string
+		total    int
+		children []string
+	}{
+		{"", []string{"Home", "Alpha", "beta", "Gamma"}, 4, []string{"work"}},
+		{"sort=name", []string{"Home", "Alpha", "Gamma", "beta"}, 4, []string{"work"}},
+		{"sort=name&order=desc", []string{"Home", "beta", "Gamma", "Alpha"}, 4, []string{"work"}},
+		{"sort=size", []string{"Home", "beta", "Alpha", "Gamma"}, 4, []string{"work"}},
+		{"sort=created&order=asc", []string{"Home", "beta", "Alpha", "Gamma"}, 4, []string{"work"}},
+		{"ns=work", []string{"work/Plan"}, 1, []string{"aws"}},
+		{"ns=work/aws", []string{"work/aws/keys"}, 1, []string{}},
+		// Filters search every namespace below and ignore case
+		{"q=PLAN", []string{"work/Plan"}, 1, []string{}},
+		{"q=a&sort=name", []string{"Alpha", "Gamma", "beta", "work/Plan", "work/aws/keys"}, 5, []string{}},
+		{"tag=go", []string{"Alpha", "work/Plan"}, 2, []string{}},
+		{"ns=work&tag=go", []string{"work/Plan"}, 1, []string{}},
+		{"per_page=2&page=2", []string{"beta", "Gamma"}, 4, []string{"work"}},
+		{"per_page=3&page=2", []string{"Gamma"}, 4, []string{"work"}},
+		{"page=3", []string{}, 4, []string{"work"}},
+		{"page=" + strconv.Itoa(math.MaxInt), []string{}, 4, []string{"work"}},
+	}
+	for _, tt := range tests {
+		v, _ := url.ParseQuery(tt.query)
+		entries, total, children := c.query(parseIndexQuery(v))
+		titles := []string{}
+		for _, entry := range entries {
+			titles = append(titles, entry.Title)
+		}
+		if !slices.Equal(titles, tt.want) || total != tt.total || !slices.Equal(children, tt.children) {
+			t.Errorf("?%s = %q of %d, children %q; want %q of %d, children %q",
+				tt.query, titles, total, children, tt.want, tt.total, tt.children)
+		}
+	}
+}
+
+func TestParseIndexQuery(t *testing.T) {
+	for query, want := range map[string]indexQuery{
+		"":                             {Sort: sortModified, Desc: true, Page: 1, PerPage: defaultPerPage},
+		"sort=name":                    {Sort: sortName, Page: 1, PerPage: defaultPerPage},
+		"sort=bogus&order=asc":         {Sort: sortModified, Page: 1, PerPage: defaultPerPage},
+		"page=-3&per_page=0":           {Sort: sortModified, Desc: true, Page: 1, PerPage: defaultPerPage},
+		"page=x&per_page=100000":       {Sort: sortModified, Desc: true, Page: 1, PerPage: maxPerPage},
+		"ns=work&q=+plan+&tag=go":      {Namespace: "work", Filter: "plan", Tag: "go", Sort: sortModified, Desc: true, Page: 1, PerPage: defaultPerPage},
+		"sort=size&page=4&per_page=20": {Sort: sortSize, Desc: true, Page: 4, PerPage: 20},
+	} {
+		v, _ := url.ParseQuery(query)
+		q := parseIndexQuery(v)
+		if q != want {
+			t.Errorf("?%s = %+v, want %+v", query, q, want)
+		}
+		// Links built from the query lead back to it
+		if again := parseIndexQuery(q.values()); again != q {
+			t.Errorf("?%s comes back from %s as %+v", query, q.values().Encode(), again)
+		}
+	}
+}
+
+// TestCatalogFollowsPages checks that saving and deleting pages keeps the
+// catalog up to date without a rebuild
+func TestCatalogFollowsPages(t *testing.T) {
+	testWiki(t)
+	catalog.rebuild()
+	t.Cleanup(catalog.rebuild)
+
+	if w := postForm(testSave, "/save/Listed", url.Values{"body": {"twelve bytes"}, "meta": {"1"}, "tags": {"news"}}); w.Code != http.StatusFound {
+		t.Fatalf("saving: %d %s", w.Code, w.Body)
+	}
+	entry, ok := catalog.get("Listed")
+	if !ok || entry.Size != 12 || !slices.Equal(entry.Tags, []string{"news"}) || entry.Modified.IsZero() {
+		t.Errorf("catalog entry after saving: %+v, %v", entry, ok)
+	}
+	index, err := buildIndex(indexQuery{Tag: "news", Sort: sortModified, Page: 1, PerPage: defaultPerPage})
+	if err != nil || index.Total != 1 || index.Pages[0].Title != "Listed" {
+		t.Errorf("index of tag news: %+v, %v", index, err)
+	}
+
+	if w := postForm(testDelete, "/delete/Listed", nil); w.Code != http.StatusFound {
+		t.Fatalf("deleting: %d %s", w.Code, w.Body)
+	}
+	if _, ok := catalog.get("Listed"); ok {
+		t.Error("the deleted page is still in the catalog")
+	}
+	if _, err := buildIndex(indexQuery{Namespace: "bad//ns", Page: 1, PerPage: defaultPerPage}); err == nil {
+		t.Error("an index of an invalid namespace was built")
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/net/websocket"
+)
+
+// Collaborative editing: the edit page opens a WebSocket to /collab/{title}
+// and every keystroke is sent as a textOp against the revision the browser
+// last saw. The server keeps one session per page being edited, transforms
+// each incoming op against anything it missed, applies it, acknowledges it
+// and forwards it to the other editors. The merged document is written
+// through savePageBody a moment after the last change and when the last
+// editor leaves, so metadata, backups and events work as for a form save.
+
+// collabSaveDelay is how long a session waits after a change before saving
+const collabSaveDelay = 2 * time.Second
+
+// collabHistory is how many past ops a session keeps for transforming late
+// ops. A client further behind than that has to reload.
+const collabHistory = 500
+
+// collabMaxMessage caps a single WebSocket message
+const collabMaxMessage = 4 << 20
+
+// collabMessage is every message in either direction. Clients send "op";
+// the server sends "init", "ack", "op", "presence" and "error".
+type collabMessage struct {
+	Type    string       `json:"type"`
+	Rev     int          `json:"rev"`
+	Op      textOp       `json:"op,omitempty"`
+	Doc     *string      `json:"doc,omitempty"`
+	ID      string       `json:"id,omitempty"`
+	Client  string       `json:"client,omitempty"`
+	Clients []collabPeer `json:"clients,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// collabPeer is one editor as shown in the presence list
+type collabPeer struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// collabClient is one connected editor
+type collabClient struct {
+	collabPeer
+	conn *websocket.Conn
+	send chan collabMessage
+}
+
+// collabSession is the shared document of one page
+type collabSession struct {
+	title string
+
+	saveMu sync.Mutex // serializes flushes so saves land in revision order
+
+	mu        sync.Mutex
+	doc       []uint16
+	rev       int
+	base      int      // revision that history[0] was applied to
+	history   []textOp // the ops from base to rev
+	clients   map[*collabClient]bool
+	dirty     bool
+	closed    bool
+	saveTimer *time.Timer
+}
+
+// collabHub holds the sessions of pages that are open in an editor
+type collabHub struct {
+	mu       sync.Mutex
+	sessions map[string]*collabSession
+}
+
+var collabs = &collabHub{sessions: make(map[string]*collabSession)}
+
+var collabClientIDs atomic.Int64
+
+// join adds a client to the session of title, starting one from the saved
+// page if nobody is editing it yet
+func (h *collabHub) join(title string, c *collabClient) *collabSession {
+	h.mu.Lock()
+	s, ok := h.sessions[title]
+	h.mu.Unlock()
+	if !ok {
+		// Load outside the hub lock; delete holds the page lock and then
+		// closes sessions, so the two must not nest the other way round
+		var doc []uint16
+		unlock := pageLocks.RLock(title)
+		if p, err := loadPage(title); err == nil {
+			doc = utf16.Encode([]rune(string(p.Body)))
+		}
+		unlock()
+		h.mu.Lock()
+		if s, ok = h.sessions[title]; !ok {
+			s = &collabSession{title: title, doc: doc, clients: make(map[*collabClient]bool)}
+			h.sessions[title] = s
+		}
+		h.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[c] = true
+	doc := string(utf16.Decode(s.doc))
+	c.deliver(collabMessage{Type: "init", Rev: s.rev, Doc: &doc, ID: c.ID, Clients: s.peers()})
+	s.broadcast(collabMessage{Type: "presence", Clients: s.peers()}, c)
+	return s
+}
+
+// leave removes a client. The last editor out saves the document and closes
+// the session.
+func (h *collabHub) leave(s *collabSession, c *collabClient) {
+	s.mu.Lock()
+	if !s.clients[c] {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.clients, c)
+	close(c.send)
+	s.broadcast(collabMessage{Type: "presence", Clients: s.peers()}, nil)
+	last := len(s.clients) == 0
+	s.mu.Unlock()
+	if !last {
+		return
+	}
+
+	s.flush()
+	// Someone may have joined while the document was being saved
+	h.mu.Lock()
+	s.mu.Lock()
+	if len(s.clients) == 0 && !s.dirty && h.sessions[s.title] == s {
+		delete(h.sessions, s.title)
+		if s.saveTimer != nil {
+			s.saveTimer.Stop()
+		}
+	}
+	s.mu.Unlock()
+	h.mu.Unlock()
+}
+
+// reset brings an open session up to date with a page saved through the
+// edit form, sending the difference to everyone editing it
+func (h *collabHub) reset(title, body string) {
+	h.mu.Lock()
+	s, ok := h.sessions[title]
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op := diffOp(s.doc, utf16.Encode([]rune(body)))
+	if len(op) > 1 || (len(op) == 1 && op[0].Retain == 0) {
+		s.commit(op)
+		s.broadcast(collabMessage{Type: "op", Rev: s.rev, Op: op}, nil)
+	}
+	// The form save has already written this state
+	s.dirty = false
+}
+
+// drop disconnects everyone editing title without saving, for a page that
+// is about to be deleted
+func (h *collabHub) drop(title string) {
+	h.mu.Lock()
+	s, ok := h.sessions[title]
+	delete(h.sessions, title)
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
+	// Wait for a save in progress so it can't recreate the page afterwards
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.dirty = false
+	if s.saveTimer != nil {
+		s.saveTimer.Stop()
+	}
+	for c := range s.clients {
+		c.deliver(collabMessage{Type: "error", Error: "page deleted"})
+		c.conn.Close()
+	}
+}
+
+// receive applies an op a client made against revision rev
+func (s *collabSession) receive(c *collabClient, rev int, op textOp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rev < s.base || rev > s.rev {
+		c.deliver(collabMessage{Type: "error", Error: "out of date, please reload"})
+		return
+	}
+	var err error
+	for _, past := range s.history[rev-s.base:] {
+		if op, _, err = transformOps(op, past); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = s.commit(op)
+	}
+	if err != nil {
+		c.deliver(collabMessage{Type: "error", Error: err.Error()})
+		return
+	}
+	c.deliver(collabMessage{Type: "ack", Rev: s.rev})
+	s.broadcast(collabMessage{Type: "op", Rev: s.rev, Op: op, Client: c.ID}, c)
+
+	s.dirty = true
+	if s.saveTimer == nil {
+		s.saveTimer = time.AfterFunc(collabSaveDelay, s.flush)
+	} else {
+		s.saveTimer.Reset(collabSaveDelay)
+	}
+}
+
+// commit applies op to the document and records it. Callers hold s.mu.
+func (s *collabSession) commit(op textOp) error {
+	doc, err := op.apply(s.doc)
+	if err != nil {
+		return err
+	}
+	s.doc = doc
+	s.rev++
+	s.history = append(s.history, op)
+	if len(s.history) > collabHistory {
+		drop := len(s.history) - collabHistory
+		s.history = append([]textOp(nil), s.history[drop:]...)
+		s.base += drop
+	}
+	return nil
+}
+
+// flush saves the document if it changed since the last save
+func (s *collabSession) flush() {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.Lock()
+	if !s.dirty || s.closed {
+		s.mu.Unlock()
+		return
+	}
+	body := string(utf16.Decode(s.doc))
+	s.dirty = false
+	s.mu.Unlock()
+
+	if err := savePageBody(s.title, []byte(body), nil); err != nil {
+		log.Printf("Error saving collaborative edit of %s: %v", s.title, err)
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+}
+
+// peers lists the connected editors. Callers hold s.mu.
+func (s *collabSession) peers() []collabPeer {
+	peers := make([]collabPeer, 0, len(s.clients))
+	for c := range s.clients {
+		peers = append(peers, c.collabPeer)
+	}
+	return peers
+}
+
+// broadcast sends msg to every client except skip. Callers hold s.mu.
+func (s *collabSession) broadcast(msg collabMessage, skip *collabClient) {
+	for c := range s.clients {
+		if c != skip {
+			c.deliver(msg)
+		}
+	}
+}
+
+// deliver queues msg for the client. A client too slow to keep up is
+// disconnected rather than holding up the session; it resyncs on reconnect.
+func (c *collabClient) deliver(msg collabMessage) {
+	select {
+	case c.send <- msg:
+	default:
+		c.conn.Close()
+	}
+}
+
+// writeLoop sends queued messages until the client leaves
+func (c *collabClient) writeLoop() {
+	for msg := range c.send {
+		if err := websocket.JSON.Send(c.conn, msg); err != nil {
+			c.conn.Close()
+		}
+	}
+}
+
+// collabName cleans up the display name a client asked for
+func collabName(name string, id string) string {
+	name = strings.TrimSpace(name)
+	if len([]rune(name)) > 40 {
+		name = string([]rune(name)[:40])
+	}
+	if name == "" {
+		name = "guest-" + id
+	}
+	return name
+}
+
+// checkCollabOrigin only accepts connections from pages of this wiki or of
+// the frontend allowed by enableCORS
+func checkCollabOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || origin.Host == "" {
+		return fmt.Errorf("missing origin")
+	}
+	if origin.Host != r.Host && origin.String() != "https://abaj.ai" {
+		return fmt.Errorf("origin %s not allowed", origin)
+	}
+	config.Origin = origin
+	return nil
+}
+
+// collabHandler upgrades to a WebSocket and runs one editor's connection
+func collabHandler(w http.ResponseWriter, r *http.Request, title string) {
+	// Joining would hand the text of a burn-after-reading page to anyone
+	if isBurnPage(title) {
+		http.Error(w, errReadOnce.Error(), http.StatusForbidden)
+		return
+	}
+	// Operations on an encrypted page would reach the server as plaintext
+	if isEncrypted(title) {
+		http.Error(w, errEncryptedPage.Error(), http.StatusForbidden)
+		return
+	}
+	server := websocket.Server{
+		Handshake: checkCollabOrigin,
+		Handler: func(conn *websocket.Conn) {
+			conn.MaxPayloadBytes = collabMaxMessage
+			id := fmt.Sprint(collabClientIDs.Add(1))
+			c := &collabClient{
+				collabPeer: collabPeer{ID: id, Name: collabName(r.URL.Query().Get("name"), id)},
+				conn:       conn,
+				send:       make(chan collabMessage, 64),
+			}
+			go c.writeLoop()
+			s := collabs.join(title, c)
+			defer collabs.leave(s, c)
+
+			for {
+				var msg collabMessage
+				if err := websocket.JSON.Receive(conn, &msg); err != nil {
+					return
+				}
+				if msg.Type == "op" {
+					s.receive(c, msg.Rev, msg.Op)
+				}
+			}
+		},
+	}
+	server.ServeHTTP(w, r)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Settings are read from WIKI_* environment variables so they can be set in
+// docker-compose.yml without rebuilding the image.
+
+// envString returns the value of the environment variable key, or def when
+// it is unset or empty
+func envString(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt is envString for integer settings; malformed values fall back to def
+func envInt(key string, def int64) int64 {
+	v := envString(key, "")
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return n
+}
+
+// envBool is envString for on/off settings; malformed values fall back to def
+func envBool(key string, def bool) bool {
+	v := envString(key, "")
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return b
+}
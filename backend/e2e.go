@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+)
+
+// End-to-end encrypted pages are encrypted and decrypted in the browser
+// with AES-256-GCM. The key never reaches the server: it travels in the URL
+// fragment (#k=...), so the page link and its QR code carry it. The body is
+// stored as base64 of the 12-byte IV followed by the ciphertext, and each
+// attachment as the raw IV and ciphertext, under its plain file name. The
+// server only keeps the Encrypted marker in the page's metadata, and leaves
+// out everything that would need the plaintext: rendering, previews,
+// thumbnails, archive listings, metadata stripping, folder and resumable
+// uploads, and collaborative editing.
+
+var (
+	errEncryptedPage = errors.New("Not available on end-to-end encrypted pages")
+	errNotCiphertext = errors.New("The body of an encrypted page must be base64 of the IV and ciphertext")
+)
+
+// gcmOverhead is the IV and tag around every ciphertext
+const gcmOverhead = 12 + 16
+
+// isEncrypted reports whether title is an end-to-end encrypted page
+func isEncrypted(title string) bool {
+	unlock := pageLocks.RLock(title)
+	defer unlock()
+	p, err := loadPage(title)
+	return err == nil && p.Meta.Encrypted
+}
+
+// validCiphertext checks that body looks like what the browser stores for
+// an encrypted page, so plaintext isn't kept under the marker by mistake
+func validCiphertext(body []byte) bool {
+	if len(body) == 0 {
+		return true
+	}
+	data, err := base64.StdEncoding.DecodeString(string(body))
+	return err == nil && len(data) >= gcmOverhead
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidCiphertext(t *testing.T) {
+	for body, want := range map[string]bool{
+		"": true,
+		base64.StdEncoding.EncodeToString(make([]byte, gcmOverhead)):     true,
+		base64.StdEncoding.EncodeToString(make([]byte, gcmOverhead+100)): true,
+		base64.StdEncoding.EncodeToString(make([]byte, gcmOverhead-1)):   false,
+		base64.RawURLEncoding.EncodeToString(make([]byte, 40)):           false,
+		"the meeting is at noon": false,
+		"aGVsbG8=":               false,
+	} {
+		if got := validCiphertext([]byte(body)); got != want {
+			t.Errorf("validCiphertext(%q) = %v", body, got)
+		}
+	}
+}
+
+// saveEncrypted saves title as an encrypted page holding ciphertext
+func saveEncrypted(t *testing.T, title, ciphertext string) {
+	t.Helper()
+	w := postForm(testSave, "/save/"+title, url.Values{"body": {ciphertext}, "meta": {"1"}, "encrypted": {"1"}})
+	if w.Code != http.StatusFound {
+		t.Fatalf("saving the encrypted page %s: %d %s", title, w.Code, w.Body)
+	}
+}
+
+func TestEncryptedPage(t *testing.T) {
+	testWiki(t)
+	ciphertext := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("\x10", gcmOverhead+20)))
+	saveEncrypted(t, "Secret", ciphertext)
+	if !isEncrypted("Secret") {
+		t.Fatal("the page isn't marked encrypted")
+	}
+	if w := readPage("GET", "raw", "Secret"); w.Body.String() != ciphertext {
+		t.Errorf("raw of the encrypted page: %q", w.Body)
+	}
+	if w := viewPage("Secret"); !strings.Contains(w.Body.String(), `data-ciphertext="`+ciphertext+`"`) {
+		t.Errorf("the view doesn't hand the ciphertext to the browser: %d", w.Code)
+	}
+
+	// Attachments are kept exactly as the browser sealed them
+	sealed := photoWithMetadata()
+	if w := postFile("Secret", "photo.jpg", sealed); w.Code != http.StatusOK {
+		t.Fatal(w.Body)
+	}
+	if attachmentContent("Secret", "photo.jpg") != sealed {
+		t.Error("the sealed attachment was changed on upload")
+	}
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	zw.Create("inside.txt")
+	zw.Close()
+	postFile("Secret", "bundle.zip", archive.String())
+	cache.purge()
+	p, err := loadPage("Secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Archive("bundle.zip") != nil || p.IsImage("photo.jpg") || p.CanPreview("photo.jpg") {
+		t.Error("the view looks inside the sealed attachments")
+	}
+
+	// The page can be turned back into a plain one from the edit form
+	if w := postForm(testSave, "/save/Secret", url.Values{"body": {"plain again"}, "meta": {"1"}}); w.Code != http.StatusFound {
+		t.Fatalf("saving as a plain page: %d %s", w.Code, w.Body)
+	}
+	if isEncrypted("Secret") {
+		t.Error("the page is still marked encrypted")
+	}
+}
+
+func TestEncryptedPageRefused(t *testing.T) {
+	testWiki(t)
+	ciphertext := base64.StdEncoding.EncodeToString(make([]byte, gcmOverhead+10))
+	saveEncrypted(t, "Secret", ciphertext)
+
+	for what, tt := range map[string]struct {
+		title string
+		form  url.Values
+	}{
+		"plaintext from the edit form":   {"Secret", url.Values{"body": {"the meeting is at noon"}, "meta": {"1"}, "encrypted": {"1"}}},
+		"plaintext from a script":        {"Secret", url.Values{"body": {"the meeting is at noon"}}},
+		"too short to be ciphertext":     {"Secret", url.Values{"body": {base64.StdEncoding.EncodeToString([]byte("short"))}}},
+		"a new page claiming encryption": {"New", url.Values{"body": {"plain"}, "meta": {"1"}, "encrypted": {"1"}}},
+	} {
+		if w := postForm(testSave, "/save/"+tt.title, tt.form); w.Code != http.StatusBadRequest {
+			t.Errorf("saving %s: %d", what, w.Code)
+		}
+	}
+	if w := readPage("GET", "raw", "Secret"); w.Body.String() != ciphertext {
+		t.Errorf("the ciphertext was replaced with %q", w.Body)
+	}
+
+	// Features that would need the plaintext on the server
+	if w, _ := tusCreateUpload("Secret", "a.txt", 10); w.Code != http.StatusBadRequest {
+		t.Errorf("resumable upload: %d %s", w.Code, w.Body)
+	}
+	if w := postFolder("Secret", "", [2]string{"f/a.txt", "plain"}); w.Code != http.StatusBadRequest {
+		t.Errorf("folder upload: %d %s", w.Code, w.Body)
+	}
+	w := httptest.NewRecorder()
+	makeHandler(collabHandler)(w, httptest.NewRequest("GET", "/collab/Secret", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("collaborative editing: %d", w.Code)
+	}
+	postFile("Secret", "notes.txt", string(make([]byte, gcmOverhead+10)))
+	if w := getPreview("/preview/Secret/notes.txt"); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("preview: %d", w.Code)
+	}
+	checkConsistent(t, "Secret")
+}
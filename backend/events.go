@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Handlers publish a pageEvent after every change so that open view and
+// index pages on other devices can refresh themselves over Server-Sent
+// Events: /events/{title} streams the events of one page, /events streams
+// all of them.
+
+// Event types
+const (
+	eventSave       = "save"
+	eventUpload     = "upload"
+	eventFileDelete = "file-delete"
+	eventPageDelete = "page-delete"
+)
+
+// pageEvent is one message on the event streams
+type pageEvent struct {
+	Type  string    `json:"type"`
+	Title string    `json:"title"`
+	File  string    `json:"file,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// eventBroker fans events out to the connected streams
+type eventBroker struct {
+	mu   sync.Mutex
+	subs map[chan pageEvent]string // subscriber -> title filter, "" for all pages
+}
+
+var events = &eventBroker{subs: make(map[chan pageEvent]string)}
+
+// eventHeartbeat keeps idle streams from being closed by proxies
+const eventHeartbeat = 25 * time.Second
+
+// subscribe registers a stream for the events of title ("" for every page)
+func (b *eventBroker) subscribe(title string) chan pageEvent {
+	ch := make(chan pageEvent, 16)
+	b.mu.Lock()
+	b.subs[ch] = title
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan pageEvent) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+}
+
+// publish sends an event to every interested stream. A stream that has
+// fallen behind misses the event rather than blocking the handler.
+func (b *eventBroker) publish(eventType, title, file string) {
+	ev := pageEvent{Type: eventType, Title: title, File: file, Time: time.Now()}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch, filter := range b.subs {
+		if filter != "" && filter != title {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// serveEvents streams events to one client until it disconnects
+func serveEvents(w http.ResponseWriter, r *http.Request, title string) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // don't let nginx buffer the stream
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ch := events.subscribe(title)
+	defer events.unsubscribe(ch)
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// eventsHandler streams the events of every page, for the index
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	serveEvents(w, r, "")
+}
+
+// pageEventsHandler streams the events of a single page, for its view
+func pageEventsHandler(w http.ResponseWriter, r *http.Request, title string) {
+	serveEvents(w, r, title)
+}
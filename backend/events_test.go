@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextEvent reads the next event off a stream, skipping heartbeats
+func nextEvent(t *testing.T, lines *bufio.Scanner) pageEvent {
+	t.Helper()
+	for lines.Scan() {
+		data, ok := strings.CutPrefix(lines.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var ev pageEvent
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			t.Fatalf("event %s: %v", data, err)
+		}
+		return ev
+	}
+	t.Fatalf("the stream ended: %v", lines.Err())
+	return pageEvent{}
+}
+
+func TestEventBroker(t *testing.T) {
+	b := &eventBroker{subs: make(map[chan pageEvent]string)}
+	one := b.subscribe("One")
+	all := b.subscribe("")
+	b.publish(eventSave, "Two", "")
+	b.publish(eventUpload, "One", "a.txt")
+
+	if ev := <-one; ev.Type != eventUpload || ev.Title != "One" || ev.File != "a.txt" {
+		t.Errorf("the page stream got %+v", ev)
+	}
+	if len(one) != 0 {
+		t.Errorf("the page stream got %d events of another page", len(one))
+	}
+	for _, want := range []string{"Two", "One"} {
+		if ev := <-all; ev.Title != want {
+			t.Errorf("the stream of every page got %+v, want %s", ev, want)
+		}
+	}
+
+	// A stream that isn't read doesn't hold up the handlers
+	published := make(chan bool)
+	go func() {
+		for range 100 {
+			b.publish(eventSave, "One", "")
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked on a stream that isn't read")
+	}
+
+	b.unsubscribe(one)
+	b.unsubscribe(all)
+	if len(b.subs) != 0 {
+		t.Errorf("%d subscribers left", len(b.subs))
+	}
+}
+
+func TestPageEventStream(t *testing.T) {
+	testWiki(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", eventsHandler)
+	mux.HandleFunc("/events/", makeHandler(pageEventsHandler))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	open := func(path string) *bufio.Scanner {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("GET %s: %d %s", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		return bufio.NewScanner(resp.Body)
+	}
+	page := open("/events/Watched")
+	everything := open("/events")
+	// The streams are subscribed once their headers are sent
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		events.mu.Lock()
+		n := len(events.subs)
+		events.mu.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+	}
+
+	postForm(testSave, "/save/Other", url.Values{"body": {"elsewhere"}})
+	postForm(testSave, "/save/Watched", url.Values{"body": {"changed"}})
+	postFile("Watched", "a.txt", "attached")
+
+	for _, want := range []pageEvent{{Type: eventSave, Title: "Watched"}, {Type: eventUpload, Title: "Watched", File: "a.txt"}} {
+		if ev := nextEvent(t, page); ev.Type != want.Type || ev.Title != want.Title || ev.File != want.File {
+			t.Errorf("page stream: %+v, want %+v", ev, want)
+		}
+	}
+	for _, want := range []string{"Other", "Watched"} {
+		if ev := nextEvent(t, everything); ev.Type != eventSave || ev.Title != want {
+			t.Errorf("stream of every page: %+v, want a save of %s", ev, want)
+		}
+	}
+}
+
+// TestLockedPageEvents checks that a protected page's stream needs it
+// unlocked first
+func TestLockedPageEvents(t *testing.T) {
+	testWiki(t)
+	if w := postForm(testSave, "/save/Private", url.Values{"body": {"hidden"}, "password": {"hunter2"}}); w.Code != http.StatusFound {
+		t.Fatalf("protecting the page: %d %s", w.Code, w.Body)
+	}
+	w := httptest.NewRecorder()
+	makeHandler(pageEventsHandler)(w, httptest.NewRequest("GET", "/events/Private", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("events of a locked page: %d", w.Code)
+	}
+}
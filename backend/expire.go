@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pages and attachments can be given a lifetime when they are saved or
+// uploaded, with an expires_in field such as "1h" or "7d". A background
+// reaper deletes expired content everywhere it is kept: the working
+// directory, filesDir and persistentDir. Until the reaper gets to it,
+// expired content is reaped on first access instead, and in both cases
+// requests for it are answered with 410 Gone. Pages can be created again
+// under the same title afterwards.
+
+// reapInterval is how often the reaper looks for expired content
+const reapInterval = time.Minute
+
+// tombstoneTTL is how long a reaped page or attachment answers 410 before
+// it is simply not found
+const tombstoneTTL = 7 * 24 * time.Hour
+
+var errBadLifetime = errors.New(`Invalid expires_in value; use "never" or a lifetime such as 30m, 12h, 7d or 2w`)
+
+// Lifetime is one of the choices offered on the edit page
+type Lifetime struct {
+	Value string
+	Label string
+}
+
+var lifetimes = []Lifetime{
+	{"10m", "10 minutes"},
+	{"1h", "1 hour"},
+	{"1d", "1 day"},
+	{"1w", "1 week"},
+	{"30d", "30 days"},
+}
+
+// Lifetimes lists the expiry choices for the edit template
+func (p *Page) Lifetimes() []Lifetime {
+	return lifetimes
+}
+
+// parseLifetime reads a lifetime: a Go duration, or a whole number of days
+// ("7d") or weeks ("2w")
+func parseLifetime(s string) (time.Duration, error) {
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+	if unit != 0 {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil || n <= 0 || n > 3650 {
+			return 0, errBadLifetime
+		}
+		return time.Duration(n) * unit, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errBadLifetime
+	}
+	return d, nil
+}
+
+// expiryFor turns an expires_in value into an expiry time. "" and "never"
+// give the zero time, meaning no expiry.
+func expiryFor(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "never" {
+		return time.Time{}, nil
+	}
+	d, err := parseLifetime(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().Add(d), nil
+}
+
+// readExpiryField reads an expires_in part of a multipart upload
+func readExpiryField(part *multipart.Part) (time.Time, error) {
+	value, _ := io.ReadAll(io.LimitReader(part, 32))
+	part.Close()
+	return expiryFor(string(value))
+}
+
+// expired reports whether t is a set expiry that has passed
+func expired(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+// remaining describes the time left until t, for pages and the index
+func remaining(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	d := time.Until(t)
+	switch {
+	case d < time.Minute:
+		return "under a minute"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh %dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+// ExpiresIn is the remaining lifetime of the page, "" if it doesn't expire
+func (m PageMeta) ExpiresIn() string {
+	return remaining(m.Expires)
+}
+
+// FileExpiresIn is the remaining lifetime of an attachment
+func (p *Page) FileExpiresIn(name string) string {
+	return remaining(p.Meta.Attachments[name].Expires)
+}
+
+// ExpiresIn is the remaining lifetime of an index entry's page
+func (e IndexEntry) ExpiresIn() string {
+	return remaining(e.Expires)
+}
+
+// tombstones remembers recently reaped pages and attachments so requests
+// for them get 410 rather than 404. Keys are titles, or title and file
+// name joined by a NUL byte.
+var tombstones = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+func tombstoneKey(title, file string) string {
+	if file == "" {
+		return title
+	}
+	return title + "\x00" + file
+}
+
+func bury(title, file string) {
+	tombstones.Lock()
+	defer tombstones.Unlock()
+	tombstones.m[tombstoneKey(title, file)] = time.Now()
+	for key, buried := range tombstones.m {
+		if time.Since(buried) > tombstoneTTL {
+			delete(tombstones.m, key)
+		}
+	}
+}
+
+// unbury forgets a tombstone once the page or file is created again
+func unbury(title, file string) {
+	tombstones.Lock()
+	defer tombstones.Unlock()
+	delete(tombstones.m, tombstoneKey(title, file))
+}
+
+func buried(title, file string) bool {
+	tombstones.Lock()
+	defer tombstones.Unlock()
+	buriedAt, ok := tombstones.m[tombstoneKey(title, file)]
+	return ok && time.Since(buriedAt) <= tombstoneTTL
+}
+
+// pageGone reports whether title has expired, reaping it now if the reaper
+// hasn't yet
+func pageGone(title string) bool {
+	if entry, ok := catalog.get(title); ok && expired(entry.Expires) {
+		reapPage(title)
+		return true
+	}
+	return buried(title, "")
+}
+
+// attachmentGone reports whether the page or the attachment has expired,
+// reaping it now if the reaper hasn't yet
+func attachmentGone(title, file string) bool {
+	if pageGone(title) {
+		return true
+	}
+	if entry, ok := catalog.get(title); ok && expired(entry.FileExpires) {
+		reapAttachments(title)
+	}
+	return buried(title, file)
+}
+
+// goneError answers a request for expired content
+func goneError(w http.ResponseWriter) {
+	http.Error(w, "This content has expired", http.StatusGone)
+}
+
+// reapPage deletes an expired page
+func reapPage(title string) {
+	bury(title, "")
+	if err := deletePage(title); err != nil {
+		log.Printf("Error deleting expired page %s: %v", title, err)
+		return
+	}
+	log.Printf("Deleted expired page %s", title)
+}
+
+// reapAttachments deletes the expired attachments of a page
+func reapAttachments(title string) {
+	unlock := pageLocks.RLock(title)
+	p, err := loadPage(title)
+	unlock()
+	if err != nil {
+		return
+	}
+	for name, attachment := range p.Meta.Attachments {
+		if !expired(attachment.Expires) {
+			continue
+		}
+		bury(title, name)
+		if err := deleteAttachment(title, name); err != nil {
+			log.Printf("Error deleting expired attachment %s of %s: %v", name, title, err)
+			continue
+		}
+		log.Printf("Deleted expired attachment %s of %s", name, title)
+	}
+}
+
+// reapExpired deletes everything whose expiry has passed
+func reapExpired() {
+	for _, entry := range catalog.expiring() {
+		if expired(entry.Expires) {
+			reapPage(entry.Title)
+		} else if expired(entry.FileExpires) {
+			reapAttachments(entry.Title)
+		}
+	}
+}
+
+// startReaper runs reapExpired now and then every reapInterval
+func startReaper() {
+	go func() {
+		for {
+			reapExpired()
+			time.Sleep(reapInterval)
+		}
+	}()
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpiryFor(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"":      0,
+		"never": 0,
+		"30m":   30 * time.Minute,
+		" 12h ": 12 * time.Hour,
+		"7d":    7 * 24 * time.Hour,
+		"2w":    14 * 24 * time.Hour,
+		"3650d": 3650 * 24 * time.Hour,
+		"1h30m": 90 * time.Minute,
+	} {
+		got, err := expiryFor(value)
+		if err != nil {
+			t.Errorf("expiryFor(%q): %v", value, err)
+			continue
+		}
+		if want == 0 && !got.IsZero() {
+			t.Errorf("expiryFor(%q) = %v, want no expiry", value, got)
+		}
+		if want != 0 && (time.Until(got) > want || time.Until(got) < want-time.Minute) {
+			t.Errorf("expiryFor(%q) is in %v, want %v", value, time.Until(got), want)
+		}
+	}
+	for _, value := range []string{"0d", "-1h", "0s", "x", "d", "1.5d", "3651d", "1y", "soon", "forever"} {
+		if _, err := expiryFor(value); err != errBadLifetime {
+			t.Errorf("expiryFor(%q) = %v, want errBadLifetime", value, err)
+		}
+	}
+}
+
+// expiringWiki is a test wiki whose catalog lists only its own pages
+func expiringWiki(t *testing.T) {
+	testWiki(t)
+	catalog.rebuild()
+	t.Cleanup(catalog.rebuild)
+}
+
+// viewPage requests /view/{title}
+func viewPage(title string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	makeHandler(viewHandler)(w, httptest.NewRequest("GET", "/view/"+title, nil))
+	return w
+}
+
+func TestPageExpiry(t *testing.T) {
+	expiringWiki(t)
+	if w := postFile("Brief", "a.txt", "attached"); w.Code != http.StatusOK {
+		t.Fatal(w.Body)
+	}
+	if w := postForm(testSave, "/save/Brief", url.Values{"body": {"short-lived"}, "expires_in": {"1h"}}); w.Code != http.StatusFound {
+		t.Fatalf("saving: %d %s", w.Code, w.Body)
+	}
+	BackupWikiFiles()
+	if w := viewPage("Brief"); w.Code != http.StatusOK {
+		t.Fatalf("view before expiry: %d", w.Code)
+	}
+	attachment := filepath.Join(pageFilesDir("Brief"), "a.txt")
+	mirrored, _ := backupAttachmentPath(attachment)
+	stored := []string{pageFilename("Brief"), filepath.Join(persistentDir, pageFilename("Brief")), attachment, mirrored}
+
+	postForm(testSave, "/save/Brief", url.Values{"body": {"short-lived"}, "expires_in": {"50ms"}})
+	time.Sleep(60 * time.Millisecond)
+	// The first request reaps the page
+	if w := viewPage("Brief"); w.Code != http.StatusGone {
+		t.Errorf("view after expiry: %d", w.Code)
+	}
+	for _, path := range stored {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s is still there: %v", path, err)
+		}
+	}
+	if w := getFile("Brief", "a.txt"); w.Code != http.StatusGone {
+		t.Errorf("attachment of the expired page: %d", w.Code)
+	}
+
+	// It can be written again from scratch
+	if w := postForm(testSave, "/save/Brief", url.Values{"body": {"again"}}); w.Code != http.StatusFound {
+		t.Fatalf("saving again: %d %s", w.Code, w.Body)
+	}
+	if w := viewPage("Brief"); w.Code != http.StatusOK {
+		t.Errorf("view of the page written again: %d", w.Code)
+	}
+}
+
+func TestReaper(t *testing.T) {
+	expiringWiki(t)
+	postForm(testSave, "/save/Brief", url.Values{"body": {"short-lived"}, "expires_in": {"50ms"}})
+	postForm(testSave, "/save/Lasting", url.Values{"body": {"stays"}, "expires_in": {"1h"}})
+	time.Sleep(60 * time.Millisecond)
+
+	reapExpired()
+	t.Cleanup(func() { unbury("Brief", "") })
+	if _, err := os.Stat(pageFilename("Brief")); !os.IsNotExist(err) {
+		t.Errorf("the reaper left the expired page: %v", err)
+	}
+	if !pageGone("Brief") {
+		t.Error("the reaped page has no tombstone")
+	}
+	if w := viewPage("Lasting"); w.Code != http.StatusOK {
+		t.Errorf("view of a page that hasn't expired: %d", w.Code)
+	}
+}
+
+func TestPageExpiryChanges(t *testing.T) {
+	expiringWiki(t)
+	save := func(form url.Values) PageMeta {
+		t.Helper()
+		form.Set("body", "text")
+		if w := postForm(testSave, "/save/Changing", form); w.Code != http.StatusFound {
+			t.Fatalf("saving with %v: %d %s", form, w.Code, w.Body)
+		}
+		cache.purge()
+		p, err := loadPage("Changing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.Meta
+	}
+	if m := save(url.Values{"expires_in": {"1h"}}); m.Expires.IsZero() {
+		t.Error("no expiry set")
+	}
+	if m := save(url.Values{}); m.Expires.IsZero() {
+		t.Error("saving without expires_in dropped the expiry")
+	}
+	if m := save(url.Values{"expires_in": {"never"}}); !m.Expires.IsZero() {
+		t.Errorf("never left the expiry at %v", m.Expires)
+	}
+
+	if w := postForm(testSave, "/save/Invalid", url.Values{"body": {"text"}, "expires_in": {"someday"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("saving with an invalid lifetime: %d", w.Code)
+	}
+	if _, err := os.Stat(pageFilename("Invalid")); !os.IsNotExist(err) {
+		t.Errorf("the page was saved with an invalid lifetime: %v", err)
+	}
+}
+
+// postExpiring uploads one file with an expires_in field
+func postExpiring(title, name, content, expiresIn string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("expires_in", expiresIn)
+	part, _ := mw.CreateFormFile("file", name)
+	part.Write([]byte(content))
+	mw.Close()
+	r := httptest.NewRequest("POST", "/upload/"+title, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	testUpload(w, r)
+	return w
+}
+
+func TestAttachmentExpiry(t *testing.T) {
+	expiringWiki(t)
+	if w := postExpiring("Shared", "brief.txt", "short-lived", "1h"); w.Code != http.StatusOK {
+		t.Fatalf("uploading: %d %s", w.Code, w.Body)
+	}
+	if w := postFile("Shared", "kept.txt", "stays"); w.Code != http.StatusOK {
+		t.Fatal(w.Body)
+	}
+	if w := getFile("Shared", "brief.txt"); w.Code != http.StatusOK {
+		t.Fatalf("attachment before expiry: %d", w.Code)
+	}
+	postExpiring("Shared", "brief.txt", "short-lived", "50ms")
+	time.Sleep(60 * time.Millisecond)
+
+	if w := getFile("Shared", "brief.txt"); w.Code != http.StatusGone {
+		t.Errorf("attachment after expiry: %d", w.Code)
+	}
+	if w := getFile("Shared", "kept.txt"); w.Code != http.StatusOK {
+		t.Errorf("attachment that doesn't expire: %d", w.Code)
+	}
+	if w := viewPage("Shared"); w.Code != http.StatusOK {
+		t.Errorf("view of the page: %d", w.Code)
+	}
+	checkConsistent(t, "Shared")
+	if attachmentContent("Shared", "brief.txt") != "" {
+		t.Error("the expired attachment is still stored")
+	}
+
+	// Uploading it again brings it back
+	if w := postFile("Shared", "brief.txt", "back"); w.Code != http.StatusOK {
+		t.Fatal(w.Body)
+	}
+	if w := getFile("Shared", "brief.txt"); w.Code != http.StatusOK || w.Body.String() != "back" {
+		t.Errorf("attachment uploaded again: %d %q", w.Code, w.Body)
+	}
+
+	if w := postExpiring("Shared", "bad.txt", "x", "someday"); w.Code != http.StatusBadRequest {
+		t.Errorf("upload with an invalid lifetime: %d", w.Code)
+	}
+	r := httptest.NewRequest("POST", "/upload/Shared?expires_in=-1h", nil)
+	w := httptest.NewRecorder()
+	testUpload(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("upload with a negative lifetime: %d", w.Code)
+	}
+	checkConsistent(t, "Shared")
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// filesHandler serves attachments below /files/ through serveAttachment.
+// Besides the files themselves, /files/{title}.zip streams all of a page's
+// attachments as one zip archive. Dot-files and dot-directories hold working
+// state and are never served.
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	rel := strings.TrimPrefix(r.URL.Path, "/files/")
+	for _, segment := range strings.Split(rel, "/") {
+		if segment == "" || strings.HasPrefix(segment, ".") {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	// A real attachment that happens to end in .zip wins over the archive
+	if base, ok := strings.CutSuffix(rel, ".zip"); ok {
+		if !attachmentExists(rel) {
+			if title, ok := zipTitle(base); ok {
+				servePageZip(w, r, title)
+				return
+			}
+		}
+	}
+	serveAttachment(w, r, rel)
+}
+
+// attachmentExists reports whether the /files/ path rel names an attachment
+func attachmentExists(rel string) bool {
+	title, ok := decodeTitle(path.Dir(rel))
+	if !ok {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(pageFilesDir(title), path.Base(rel)))
+	return err == nil
+}
+
+// zipTitle finds the page named in a /files/{title}.zip URL, which may use
+// the encoded directory name or the plain title
+func zipTitle(name string) (string, bool) {
+	if title, ok := decodeTitle(name); ok {
+		if _, err := os.Stat(pageFilename(title)); err == nil {
+			return title, true
+		}
+	}
+	if title, err := normalizeTitle(name); err == nil {
+		if _, err := os.Stat(pageFilename(title)); err == nil {
+			return title, true
+		}
+	}
+	return "", false
+}
+
+// servePageZip streams the attachments of title as a zip archive. Only the
+// list of files is read under the page lock; each file is opened as it is
+// added, and one replaced meanwhile is sent as it was when opened.
+func servePageZip(w http.ResponseWriter, r *http.Request, title string) {
+	if pageGone(title) {
+		goneError(w)
+		return
+	}
+	if pageLocked(r, title) {
+		lockedError(w, r, title)
+		return
+	}
+	unlock := pageLocks.RLock(title)
+	p, err := loadPage(title)
+	unlock()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": leafName(title) + ".zip"}))
+	if r.Method == "HEAD" {
+		return
+	}
+
+	zw := zip.NewWriter(w)
+	dir := pageFilesDir(title)
+	for _, name := range p.Files {
+		if err := addFileToZip(zw, filepath.Join(dir, name), name); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			// The response has started, so all we can do is stop
+			log.Printf("Error writing zip of %s: %v", title, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Error writing zip of %s: %v", title, err)
+	}
+}
+
+// addFileToZip copies the file at path into the archive as name
+func addFileToZip(zw *zip.Writer, path, name string) error {
+	f, err := openStored(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// folderEntryName is the path of a file inside an uploaded folder. Browsers
+// send it as the part's file name, which multipart.Part.FileName would cut
+// down to the last element, so it is read from the raw header. The result
+// is relative and can't climb out of the archive.
+func folderEntryName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	name := strings.ReplaceAll(params["filename"], "\\", "/")
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// storeFolderZip stores every file of a folder upload in one zip archive
+// named after the folder (or archiveName when given) and returns the name.
+// An expires_in field before the files overrides expires.
+func storeFolderZip(title string, reader *multipart.Reader, archiveName string, expires time.Time) (string, error) {
+	// Find the first file to name the archive after its folder
+	var first *multipart.Part
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return "", errNoFiles
+		}
+		if err != nil {
+			return "", err
+		}
+		if part.FormName() == "file" && folderEntryName(part) != "" {
+			first = part
+			break
+		}
+		if part.FormName() == "expires_in" {
+			if expires, err = readExpiryField(part); err != nil {
+				return "", err
+			}
+			continue
+		}
+		part.Close()
+	}
+	if archiveName == "" {
+		folder, _, _ := strings.Cut(folderEntryName(first), "/")
+		archiveName = strings.TrimSuffix(folder, ".zip")
+	}
+	if !strings.HasSuffix(strings.ToLower(archiveName), ".zip") {
+		archiveName += ".zip"
+	}
+	filename, ok := cleanAttachmentName(archiveName)
+	if !ok {
+		return "", errBadFileName
+	}
+
+	err := storeAttachment(title, filename, expires, func(filePath string) error {
+		return writeAttachmentWith(title, filePath, func(dst io.Writer) error {
+			zw := zip.NewWriter(dst)
+			seen := make(map[string]bool)
+			for part := first; ; {
+				if name := folderEntryName(part); part.FormName() == "file" && name != "" && !seen[name] {
+					seen[name] = true
+					entry, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+					if err != nil {
+						return err
+					}
+					if _, err := io.Copy(entry, part); err != nil {
+						return err
+					}
+				}
+				part.Close()
+
+				var err error
+				part, err = reader.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return zw.Close()
+		})
+	})
+	return filename, err
+}
+
+// ArchiveEntry is one file inside a zip attachment
+type ArchiveEntry struct {
+	Name string
+	Size uint64
+}
+
+// archiveListLimit caps how many entries of an archive the view lists
+const archiveListLimit = 200
+
+// Archive lists the files inside the attachment name if it is a zip
+// archive, for the view page. Other attachments return nil.
+func (p *Page) Archive(name string) []ArchiveEntry {
+	if !strings.EqualFold(filepath.Ext(name), ".zip") || p.Meta.Encrypted {
+		return nil
+	}
+	f, err := openStored(filepath.Join(pageFilesDir(p.Title), name))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	zr, err := zip.NewReader(f, f.size)
+	if err != nil {
+		return nil
+	}
+	var entries []ArchiveEntry
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		if len(entries) == archiveListLimit {
+			entries = append(entries, ArchiveEntry{Name: "…"})
+			break
+		}
+		entries = append(entries, ArchiveEntry{Name: f.Name, Size: f.UncompressedSize64})
+	}
+	return entries
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+// postFolder uploads files as a folder, the way the edit page sends a
+// dropped directory: each file name is its path inside the folder
+func postFolder(title, query string, files ...[2]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, file := range files {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", `form-data; name="file"; filename="`+file[0]+`"`)
+		part, _ := mw.CreatePart(header)
+		part.Write([]byte(file[1]))
+	}
+	mw.Close()
+	r := httptest.NewRequest("POST", "/upload/"+title+"?folder=zip"+query, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	testUpload(w, r)
+	return w
+}
+
+// zipContents reads a zip archive into a map of its files
+func zipContents(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("reading the archive: %v", err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(content)
+	}
+	return files
+}
+
+func TestFolderUpload(t *testing.T) {
+	testWiki(t)
+	w := postFolder("Album", "",
+		[2]string{"photos/a.txt", "first"},
+		[2]string{"photos/sub/b.txt", "second"},
+		[2]string{"photos/../../escape.txt", "climbing"},
+		[2]string{"photos/a.txt", "duplicate"},
+	)
+	if w.Code != http.StatusOK {
+		t.Fatalf("folder upload: %d %s", w.Code, w.Body)
+	}
+	want := map[string]string{"photos/a.txt": "first", "photos/sub/b.txt": "second", "escape.txt": "climbing"}
+	got := zipContents(t, []byte(attachmentContent("Album", "photos.zip")))
+	if len(got) != len(want) {
+		t.Errorf("photos.zip holds %q, want %q", got, want)
+	}
+	for name, content := range want {
+		if got[name] != content {
+			t.Errorf("%s in photos.zip = %q, want %q", name, got[name], content)
+		}
+	}
+
+	if w := postFolder("Album", "&name=Holiday", [2]string{"x/c.txt", "third"}); w.Code != http.StatusOK {
+		t.Fatalf("named folder upload: %d %s", w.Code, w.Body)
+	}
+	cache.purge()
+	p, err := loadPage("Album")
+	if err != nil || !slices.Equal(p.Files, []string{"photos.zip", "Holiday.zip"}) {
+		t.Fatalf("attachments after the folder uploads: %v, %v", p, err)
+	}
+	var listed []string
+	for _, entry := range p.Archive("photos.zip") {
+		listed = append(listed, entry.Name)
+	}
+	slices.Sort(listed)
+	if !slices.Equal(listed, []string{"escape.txt", "photos/a.txt", "photos/sub/b.txt"}) {
+		t.Errorf("listing of photos.zip = %q", listed)
+	}
+	checkConsistent(t, "Album")
+}
+
+func TestFolderUploadRefused(t *testing.T) {
+	testWiki(t)
+	ciphertext := base64.StdEncoding.EncodeToString(make([]byte, gcmOverhead+10))
+	if w := postForm(testSave, "/save/Secret", url.Values{"body": {ciphertext}, "meta": {"1"}, "encrypted": {"1"}}); w.Code != http.StatusFound {
+		t.Fatalf("saving the encrypted page: %d %s", w.Code, w.Body)
+	}
+	for what, w := range map[string]*httptest.ResponseRecorder{
+		"encrypted page": postFolder("Secret", "", [2]string{"f/a.txt", "plain"}),
+		"no files":       postFolder("Empty", ""),
+		"hidden name":    postFolder("Empty", "&name=.hidden", [2]string{"f/a.txt", "a"}),
+	} {
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("folder upload to %s: %d %s", what, w.Code, w.Body)
+		}
+	}
+	checkConsistent(t, "Secret")
+	checkConsistent(t, "Empty")
+}
+
+func TestPageZip(t *testing.T) {
+	testWiki(t)
+	if w := postFiles("Docs", [2]string{"a.txt", "first"}, [2]string{"b.txt", "second"}); w.Code != http.StatusOK {
+		t.Fatalf("uploading: %d %s", w.Code, w.Body)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		filesHandler(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	for _, path := range []string{"/files/Docs.zip", "/files/" + encodeTitle("Docs") + ".zip"} {
+		w := get(path)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+			t.Fatalf("GET %s: %d %s", path, w.Code, w.Header().Get("Content-Type"))
+		}
+		got := zipContents(t, w.Body.Bytes())
+		if len(got) != 2 || got["a.txt"] != "first" || got["b.txt"] != "second" {
+			t.Errorf("GET %s holds %q", path, got)
+		}
+	}
+
+	// A real attachment called like the archive is served instead
+	if w := postFile("Docs/Notes", "x.txt", "nested"); w.Code != http.StatusOK {
+		t.Fatal(w.Body)
+	}
+	if w := postFile("Docs", "Notes.zip", "not an archive"); w.Code != http.StatusOK {
+		t.Fatal(w.Body)
+	}
+	if w := get("/files/" + encodeTitle("Docs") + "/Notes.zip"); w.Body.String() != "not an archive" {
+		t.Errorf("attachment named like an archive = %q", w.Body)
+	}
+
+	for _, path := range []string{"/files/Nowhere.zip", "/files/.versions.zip", "/files/Docs/.hidden"} {
+		if w := get(path); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: %d", path, w.Code)
+		}
+	}
+}
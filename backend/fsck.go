@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fsck checks every attachment against the SHA-256 recorded in its page's
+// metadata, and against its copy in the persistent mirror. When repairing,
+// whichever side still matches the recorded digest is copied over the one
+// that doesn't, and attachments uploaded before digests were recorded get
+// one. Nothing is repaired when neither copy matches. It checks in the
+// background at startup and runs on demand at /api/fsck (GET reports, POST
+// repairs), which needs the WIKI_ADMIN_TOKEN. The backup never copies an
+// attachment that no longer matches its digest over the mirror, so the
+// mirror keeps the good copy to repair from.
+
+// Problems fsck can report
+const (
+	fsckUnrecorded    = "unrecorded"     // no digest in the metadata yet
+	fsckMissing       = "missing"        // in the Files list but not on disk
+	fsckCorrupt       = "corrupt"        // contents don't match the digest
+	fsckBackupMissing = "backup-missing" // no copy in the persistent mirror
+	fsckBackupCorrupt = "backup-corrupt" // the mirror's copy doesn't match
+)
+
+// fsckProblem is one finding of an fsck pass
+type fsckProblem struct {
+	Title    string `json:"title"`
+	File     string `json:"file"`
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired"`
+}
+
+// fsckReport is the outcome of an fsck pass
+type fsckReport struct {
+	Pages    int           `json:"pages"`
+	Files    int           `json:"files"`
+	Problems []fsckProblem `json:"problems"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+}
+
+// fsck checks the attachments of every page
+func fsck(repair bool) fsckReport {
+	report := fsckReport{Problems: []fsckProblem{}, Started: time.Now()}
+	for _, title := range getAllPages() {
+		report.Pages++
+		report.Files += fsckPage(title, repair, &report.Problems)
+	}
+	report.Finished = time.Now()
+	return report
+}
+
+// fsckPage checks the attachments of one page and returns how many it has
+func fsckPage(title string, repair bool, problems *[]fsckProblem) int {
+	var unlock func()
+	if repair {
+		unlock = pageLocks.Lock(title)
+	} else {
+		unlock = pageLocks.RLock(title)
+	}
+	defer unlock()
+
+	p, err := loadPage(title)
+	if err != nil {
+		return 0
+	}
+	recorded := false
+	for _, file := range p.Files {
+		report := func(problem string, repaired bool) {
+			*problems = append(*problems, fsckProblem{Title: title, File: file, Problem: problem, Repaired: repaired})
+		}
+		path := filepath.Join(pageFilesDir(title), file)
+		live, liveErr := fileSHA256(path)
+		backupPath, _ := backupAttachmentPath(path)
+		backup, backupErr := fileSHA256(backupPath)
+
+		attachment, ok := p.Meta.Attachments[file]
+		if !ok || attachment.SHA256 == "" {
+			if liveErr != nil {
+				report(fsckMissing, false)
+				continue
+			}
+			// Take the file as it is now to be the good copy
+			if repair {
+				if attachment, err = detectAttachment(path); err != nil {
+					report(fsckUnrecorded, false)
+					continue
+				}
+				if p.Meta.Attachments == nil {
+					p.Meta.Attachments = make(map[string]AttachmentMeta)
+				}
+				if info, err := os.Stat(path); err == nil {
+					attachment.Uploaded = info.ModTime()
+				}
+				p.Meta.Attachments[file] = attachment
+				recorded = true
+			}
+			report(fsckUnrecorded, repair)
+			attachment.SHA256 = live
+		}
+
+		switch {
+		case liveErr == nil && live == attachment.SHA256:
+			if backupErr != nil || backup != attachment.SHA256 {
+				problem := fsckBackupCorrupt
+				if os.IsNotExist(backupErr) {
+					problem = fsckBackupMissing
+				}
+				report(problem, repair && fsckCopy(path, backupPath))
+			}
+		case backupErr == nil && backup == attachment.SHA256:
+			problem := fsckCorrupt
+			if os.IsNotExist(liveErr) {
+				problem = fsckMissing
+			}
+			report(problem, repair && fsckCopy(backupPath, path))
+		default:
+			problem := fsckCorrupt
+			if os.IsNotExist(liveErr) {
+				problem = fsckMissing
+			}
+			report(problem, false)
+			log.Printf("fsck: no good copy of %s on page %s", file, title)
+		}
+	}
+
+	// Recording digests is not an edit, so the page keeps its timestamps
+	if recorded {
+		if err := commitPage(p); err != nil {
+			log.Printf("fsck: error saving digests of %s: %v", title, err)
+		} else {
+			cache.put(p)
+		}
+	}
+	return len(p.Files)
+}
+
+// intactAttachment reports whether file on title, at path, still has the
+// digest recorded for it. One with no digest recorded yet counts as intact.
+// The caller holds the page lock.
+func intactAttachment(title, file, path string) bool {
+	p, err := loadPage(title)
+	if err != nil {
+		return true
+	}
+	attachment, ok := p.Meta.Attachments[file]
+	if !ok || attachment.SHA256 == "" {
+		return true
+	}
+	digest, err := fileSHA256(path)
+	return err == nil && digest == attachment.SHA256
+}
+
+// fsckCopy replaces dst with the good copy at src
+func fsckCopy(src, dst string) bool {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		log.Printf("fsck: error repairing %s: %v", dst, err)
+		return false
+	}
+	if err := copyFile(src, dst); err != nil {
+		log.Printf("fsck: error repairing %s: %v", dst, err)
+		return false
+	}
+	return true
+}
+
+// logFsck runs a checking fsck pass and logs what it found
+func logFsck() {
+	report := fsck(false)
+	for _, p := range report.Problems {
+		log.Printf("fsck: %s/%s: %s (repaired: %v)", p.Title, p.File, p.Problem, p.Repaired)
+	}
+	log.Printf("fsck: checked %d attachments on %d pages, %d problems", report.Files, report.Pages, len(report.Problems))
+}
+
+// apiFsckHandler runs an fsck pass and returns its report as JSON. GET only
+// checks; POST also repairs.
+func apiFsckHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := fsck(r.Method == "POST")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
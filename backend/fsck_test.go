@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fsckProblems runs fsck and returns what it found by file
+func fsckProblems(repair bool) map[string]fsckProblem {
+	found := make(map[string]fsckProblem)
+	for _, p := range fsck(repair).Problems {
+		found[p.Title+"/"+p.File] = p
+	}
+	return found
+}
+
+func TestFsckRepairsFromMirror(t *testing.T) {
+	testWiki(t)
+	title := "Checked"
+	for _, file := range []string{"a.txt", "b.txt", "c.txt"} {
+		if w := postFile(title, file, "contents of "+file); w.Code != http.StatusOK {
+			t.Fatalf("uploading %s: %d %s", file, w.Code, w.Body)
+		}
+	}
+	BackupWikiFiles()
+	if found := fsckProblems(false); len(found) != 0 {
+		t.Fatalf("fsck of a healthy wiki: %v", found)
+	}
+
+	live := func(file string) string { return filepath.Join(pageFilesDir(title), file) }
+	mirror := func(file string) string {
+		path, _ := backupAttachmentPath(live(file))
+		return path
+	}
+	os.WriteFile(live("a.txt"), []byte("bit rot"), 0644)
+	os.Remove(mirror("b.txt"))
+	os.WriteFile(live("c.txt"), []byte("rot here"), 0644)
+	os.WriteFile(mirror("c.txt"), []byte("and there"), 0644)
+
+	// The backup leaves the mirror's good copy of a.txt alone
+	BackupWikiFiles()
+	if data, _ := os.ReadFile(mirror("a.txt")); string(data) != "contents of a.txt" {
+		t.Fatalf("the backup copied the damaged a.txt over the mirror: %q", data)
+	}
+
+	// The pass at startup only reports
+	logFsck()
+	if data, _ := os.ReadFile(live("a.txt")); string(data) != "bit rot" {
+		t.Errorf("the startup fsck changed a.txt to %q", data)
+	}
+
+	found := fsckProblems(true)
+	for file, want := range map[string]fsckProblem{
+		"a.txt": {Problem: fsckCorrupt, Repaired: true},
+		"c.txt": {Problem: fsckCorrupt, Repaired: false},
+	} {
+		got := found[title+"/"+file]
+		if got.Problem != want.Problem || got.Repaired != want.Repaired {
+			t.Errorf("fsck of %s: %+v, want %+v", file, got, want)
+		}
+	}
+	// b.txt was copied back to the mirror by the second backup already
+	if len(found) != 2 {
+		t.Errorf("fsck found %v", found)
+	}
+	for file, want := range map[string]string{"a.txt": "contents of a.txt", "c.txt": "rot here"} {
+		if data, _ := os.ReadFile(live(file)); string(data) != want {
+			t.Errorf("%s after repair = %q, want %q", file, data, want)
+		}
+	}
+	if data, _ := os.ReadFile(mirror("b.txt")); string(data) != "contents of b.txt" {
+		t.Errorf("mirror of b.txt = %q", data)
+	}
+}
+
+func TestFsckRepairsMirror(t *testing.T) {
+	testWiki(t)
+	title := "Mirrored"
+	if w := postFile(title, "a.txt", "good"); w.Code != http.StatusOK {
+		t.Fatalf("uploading a.txt: %d %s", w.Code, w.Body)
+	}
+	// The upload is backed up in the background
+	backups.Wait()
+	mirror, _ := backupAttachmentPath(filepath.Join(pageFilesDir(title), "a.txt"))
+	os.WriteFile(mirror, []byte("bad"), 0644)
+
+	if found := fsckProblems(false); found[title+"/a.txt"].Problem != fsckBackupCorrupt || found[title+"/a.txt"].Repaired {
+		t.Errorf("checking: %v", found)
+	}
+	if found := fsckProblems(true); !found[title+"/a.txt"].Repaired {
+		t.Errorf("repairing: %v", found)
+	}
+	if data, _ := os.ReadFile(mirror); string(data) != "good" {
+		t.Errorf("mirror after repair = %q", data)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+// titleLocks hands out one read/write lock per page title. Handlers take the
+// write lock around every load-modify-save of a page so that, for example,
+// two simultaneous uploads can't each read the old Files list and drop the
+// other's entry. Plain reads take the read lock. Entries are reference
+// counted and dropped once nobody holds or waits for them.
+//
+// The locks are not reentrant: code that runs while a handler holds a page's
+// lock (loadPage, Page.save, RestoreWikiFile, RestoreUploadedFiles) must not
+// try to take it again.
+type titleLocks struct {
+	mu    sync.Mutex
+	locks map[string]*titleLock
+}
+
+type titleLock struct {
+	sync.RWMutex
+	refs int
+}
+
+var pageLocks = &titleLocks{locks: make(map[string]*titleLock)}
+
+// restoreLocks serialize restoring a page from persistent storage. loadPage
+// restores pages on demand and runs under the read lock as often as the
+// write lock, and a read lock can't be upgraded, so restoring takes this
+// lock too: readers then can't restore the same page at once, and writers
+// already keep readers out.
+var restoreLocks = &titleLocks{locks: make(map[string]*titleLock)}
+
+// acquire returns the lock for title, creating it if needed
+func (l *titleLocks) acquire(title string) *titleLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tl, ok := l.locks[title]
+	if !ok {
+		tl = &titleLock{}
+		l.locks[title] = tl
+	}
+	tl.refs++
+	return tl
+}
+
+// release drops a reference taken by acquire
+func (l *titleLocks) release(title string, tl *titleLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tl.refs--
+	if tl.refs == 0 {
+		delete(l.locks, title)
+	}
+}
+
+// Lock takes the write lock of title and returns the function that releases it
+func (l *titleLocks) Lock(title string) func() {
+	tl := l.acquire(title)
+	tl.Lock()
+	return func() {
+		tl.Unlock()
+		l.release(title, tl)
+	}
+}
+
+// RLock takes the read lock of title and returns the function that releases it
+func (l *titleLocks) RLock(title string) func() {
+	tl := l.acquire(title)
+	tl.RLock()
+	return func() {
+		tl.RUnlock()
+		l.release(title, tl)
+	}
+}
+
+// LockMany takes the write locks of several titles at once, always in the
+// same order so two callers can't deadlock, and returns the function that
+// releases them all. Repeated titles are locked once.
+func (l *titleLocks) LockMany(titles ...string) func() {
+	titles = slices.Clone(titles)
+	slices.Sort(titles)
+	titles = slices.Compact(titles)
+	unlocks := make([]func(), len(titles))
+	for i, title := range titles {
+		unlocks[i] = l.Lock(title)
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	testSave       = makeHandler(saveHandler)
+	testUpload     = makeHandler(uploadHandler)
+	testDelete     = makeHandler(deleteHandler)
+	testDeleteFile = makeHandler(deleteFileHandler)
+)
+
+// testWiki runs a test in an empty wiki in a temporary directory
+func testWiki(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Chdir(dir)
+	saved := persistentDir
+	persistentDir = filepath.Join(dir, "persistence")
+	cache.purge()
+	t.Cleanup(func() {
+		// Let backups started by handlers finish before the files go
+		backups.Wait()
+		persistentDir = saved
+		cache.purge()
+	})
+}
+
+// postForm sends a form to handler the way the edit and view pages do
+func postForm(handler http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// postFile uploads one file to title
+func postFile(title, name, content string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", name)
+	part.Write([]byte(content))
+	mw.Close()
+	r := httptest.NewRequest("POST", "/upload/"+title, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	testUpload(w, r)
+	return w
+}
+
+// checkConsistent checks that the attachment list of title names exactly
+// the files in its directory
+func checkConsistent(t *testing.T, title string) {
+	t.Helper()
+	unlock := pageLocks.RLock(title)
+	defer unlock()
+	cache.purge()
+	p, err := loadPage(title)
+	var listed []string
+	if err == nil {
+		listed = slices.Clone(p.Files)
+	}
+	var stored []string
+	entries, _ := os.ReadDir(pageFilesDir(title))
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+			stored = append(stored, entry.Name())
+		}
+	}
+	slices.Sort(listed)
+	slices.Sort(stored)
+	if !slices.Equal(listed, stored) {
+		t.Errorf("%q lists attachments %q but has %q", title, listed, stored)
+	}
+	if err == nil {
+		for _, name := range listed {
+			if _, ok := p.Meta.Attachments[name]; !ok {
+				t.Errorf("%q has no metadata for attachment %s", title, name)
+			}
+		}
+	}
+}
+
+// TestConcurrentPageWrites runs saves, uploads, deletes and attachment
+// deletes at once on one page and on a namespace and the page inside it.
+// Run it with -race.
+func TestConcurrentPageWrites(t *testing.T) {
+	testWiki(t)
+	titles := []string{"Race", "Docs", "Docs/Child"}
+
+	const workers, rounds = 8, 25
+	var wg sync.WaitGroup
+	for worker := range workers {
+		wg.Go(func() {
+			for round := range rounds {
+				title := titles[(worker+round)%len(titles)]
+				file := fmt.Sprintf("f%d.txt", round%3)
+				var w *httptest.ResponseRecorder
+				var op string
+				switch (worker + round) % 5 {
+				case 0, 1:
+					op = "save"
+					w = postForm(testSave, "/save/"+title, url.Values{"body": {fmt.Sprintf("worker %d round %d", worker, round)}})
+				case 2:
+					op = "upload"
+					w = postFile(title, file, fmt.Sprintf("from worker %d", worker))
+				case 3:
+					op = "delete-file"
+					w = postForm(testDeleteFile, "/delete-file/"+title, url.Values{"filename": {file}})
+					// Another worker may have deleted the page first
+					if w.Code == http.StatusNotFound {
+						continue
+					}
+				case 4:
+					if round%4 != 0 {
+						continue
+					}
+					op = "delete"
+					w = postForm(testDelete, "/delete/"+title, nil)
+				}
+				if w.Code != http.StatusOK && w.Code != http.StatusFound {
+					t.Errorf("%s on %q: %d %s", op, title, w.Code, w.Body)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	backups.Wait()
+
+	for _, title := range titles {
+		checkConsistent(t, title)
+	}
+
+	// Every page still takes a save and an upload afterwards, and deleting
+	// the namespace page leaves the page inside it alone
+	for _, title := range titles {
+		if w := postForm(testSave, "/save/"+title, url.Values{"body": {"final"}}); w.Code != http.StatusFound {
+			t.Fatalf("final save of %q: %d %s", title, w.Code, w.Body)
+		}
+		if w := postFile(title, "last.txt", "last"); w.Code != http.StatusOK {
+			t.Fatalf("final upload to %q: %d %s", title, w.Code, w.Body)
+		}
+	}
+	if w := postForm(testDelete, "/delete/Docs", nil); w.Code != http.StatusFound {
+		t.Fatalf("deleting Docs: %d %s", w.Code, w.Body)
+	}
+	backups.Wait()
+	cache.purge()
+	unlock := pageLocks.RLock("Docs/Child")
+	p, err := loadPage("Docs/Child")
+	unlock()
+	if err != nil || string(p.Body) != "final" {
+		t.Fatalf("Docs/Child after deleting Docs: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(pageFilesDir("Docs/Child"), "last.txt")); err != nil {
+		t.Errorf("Docs/Child lost its attachment with Docs: %v", err)
+	}
+	for _, title := range titles {
+		checkConsistent(t, title)
+	}
+}
+
+// TestConcurrentRestore has several readers load a page whose working copy
+// is gone at once. The page is restored from the backup once, not by each.
+func TestConcurrentRestore(t *testing.T) {
+	testWiki(t)
+	title := "Shared Notes"
+	writeTestPage(t, title, "Plan.txt", "steps")
+	os.RemoveAll(filesDir)
+	for _, path := range []string{pageFilename(title), filesListFilename(title), metaFilename(title)} {
+		os.Remove(path)
+	}
+	cache.purge()
+	var logged syncBuffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	view := makeHandler(viewHandler)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			w := httptest.NewRecorder()
+			view(w, httptest.NewRequest("GET", "/view/"+url.PathEscape(title), nil))
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "body of "+title) {
+				t.Errorf("viewing %q during restore: %d", title, w.Code)
+			}
+		})
+	}
+	wg.Wait()
+	restored := "Restored " + pageFilename(title) + " from persistent storage"
+	if n := strings.Count(logged.String(), restored); n != 1 {
+		t.Errorf("%q was restored %d times", title, n)
+	}
+	checkRestored(t, title, "Plan.txt", "steps")
+}
+
+// syncBuffer is a bytes.Buffer that several goroutines can log to
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// PageMeta is the structured metadata kept next to each page body, in a
+// <title>.meta.json sidecar that is backed up along with the .txt files
+type PageMeta struct {
+	Tags        []string  `json:"tags,omitempty"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+	Author      string    `json:"author,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Pinned      bool      `json:"pinned,omitempty"`
+	Expires     time.Time `json:"expires,omitzero"` // when the reaper deletes the page, zero for never
+	// BurnAfterReading pages are deleted when they are first read
+	BurnAfterReading bool `json:"burn_after_reading,omitempty"`
+	// Encrypted pages hold ciphertext made in the browser, see e2e.go
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Password, when set, has to be entered before the page can be used
+	Password *PagePassword `json:"password,omitempty"`
+	// Shares are the read-only links handed out for the page
+	Shares []ShareLink `json:"shares,omitempty"`
+	// Attachments records what was learned about each attachment at upload
+	Attachments map[string]AttachmentMeta `json:"attachments,omitempty"`
+}
+
+// PublicMeta is the part of PageMeta that /api/page hands out. The password
+// hash and the share links stay on the server.
+type PublicMeta struct {
+	Tags        []string                  `json:"tags,omitempty"`
+	Created     time.Time                 `json:"created"`
+	Updated     time.Time                 `json:"updated"`
+	Author      string                    `json:"author,omitempty"`
+	ContentType string                    `json:"content_type,omitempty"`
+	Pinned      bool                      `json:"pinned,omitempty"`
+	Expires     time.Time                 `json:"expires,omitzero"`
+	Encrypted   bool                      `json:"encrypted,omitempty"`
+	Protected   bool                      `json:"protected,omitempty"`
+	Attachments map[string]AttachmentMeta `json:"attachments,omitempty"`
+}
+
+// Public returns what the API may show of m
+func (m PageMeta) Public() PublicMeta {
+	return PublicMeta{
+		Tags:        m.Tags,
+		Created:     m.Created,
+		Updated:     m.Updated,
+		Author:      m.Author,
+		ContentType: m.ContentType,
+		Pinned:      m.Pinned,
+		Expires:     m.Expires,
+		Encrypted:   m.Encrypted,
+		Protected:   m.Protected(),
+		Attachments: m.Attachments,
+	}
+}
+
+// AttachmentMeta describes one attachment of a page
+type AttachmentMeta struct {
+	ContentType string    `json:"content_type"` // detected at upload, used when serving
+	Size        int64     `json:"size"`
+	Uploaded    time.Time `json:"uploaded"`
+	SHA256      string    `json:"sha256,omitempty"` // hex digest of the contents
+	Expires     time.Time `json:"expires,omitzero"` // when the reaper deletes it, zero for never
+}
+
+// contentTypes are the body formats offered on the edit page
+var contentTypes = []string{"text/plain", "text/markdown", "application/json", "text/x-shellscript"}
+
+const defaultContentType = "text/plain"
+
+// loadMeta reads the metadata sidecar of a page. Pages saved before
+// metadata existed get timestamps from their body file.
+func loadMeta(title string) PageMeta {
+	var meta PageMeta
+	if data, err := readStored(metaFilename(title)); err == nil {
+		json.Unmarshal(data, &meta)
+	}
+	if meta.Created.IsZero() || meta.Updated.IsZero() {
+		if info, err := os.Stat(pageFilename(title)); err == nil {
+			if meta.Created.IsZero() {
+				meta.Created = info.ModTime()
+			}
+			if meta.Updated.IsZero() {
+				meta.Updated = info.ModTime()
+			}
+		}
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = defaultContentType
+	}
+	return meta
+}
+
+// HasTag reports whether the page carries tag
+func (m PageMeta) HasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeTag lower-cases a tag and checks it only holds letters, digits,
+// '-' and '_'
+func normalizeTag(raw string) (string, bool) {
+	tag := norm.NFC.String(strings.ToLower(strings.TrimPrefix(strings.TrimSpace(raw), "#")))
+	if tag == "" {
+		return "", false
+	}
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+			return "", false
+		}
+	}
+	return tag, true
+}
+
+// parseTags splits a comma or space separated tag list as typed on the edit
+// page, dropping invalid and duplicate tags
+func parseTags(s string) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		if tag, ok := normalizeTag(field); ok && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// applyMetaForm copies the metadata fields of the edit form onto meta. Forms
+// without the "meta" marker field (such as scripted saves that only post a
+// body) leave the metadata untouched.
+func applyMetaForm(r *http.Request, meta *PageMeta) {
+	if r.FormValue("meta") == "" {
+		return
+	}
+	meta.Tags = parseTags(r.FormValue("tags"))
+	meta.Author = strings.TrimSpace(r.FormValue("author"))
+	meta.Pinned = r.FormValue("pinned") != ""
+	meta.BurnAfterReading = r.FormValue("burn_after_reading") != ""
+	meta.Encrypted = r.FormValue("encrypted") != ""
+	meta.ContentType = defaultContentType
+	for _, ct := range contentTypes {
+		if r.FormValue("content_type") == ct {
+			meta.ContentType = ct
+		}
+	}
+}
+
+// ContentTypes lists the selectable body formats for the edit template
+func (p *Page) ContentTypes() []string {
+	return contentTypes
+}
+
+// TagsString renders the tags for the edit form's text input
+func (m PageMeta) TagsString() string {
+	return strings.Join(m.Tags, ", ")
+}
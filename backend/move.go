@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Attachments can be renamed, moved to another page or copied to one, with
+// POST /api/attachment or from the edit page. Both pages stay locked for
+// the whole operation. The file is put in its new place and the destination
+// page saved before the source page lets go of it, so a crash part way
+// leaves the attachment in both places and never in neither. The backup is
+// brought up to date for just the pages and files involved. Files don't
+// move between end-to-end encrypted pages and plain ones.
+
+var (
+	errNoAttachment      = errors.New("No such attachment")
+	errAttachmentExists  = errors.New("An attachment of that name already exists")
+	errEncryptionDiffers = errors.New("Attachments can't move between end-to-end encrypted and plain pages")
+)
+
+// attachmentTransfer describes one rename, move or copy
+type attachmentTransfer struct {
+	Title string // source page
+	File  string
+	To    string // destination page, which may be the source page
+	Name  string // file name on the destination page
+	Copy  bool
+}
+
+// transferAttachment carries out t
+func transferAttachment(t attachmentTransfer) error {
+	unlock := pageLocks.LockMany(t.Title, t.To)
+	defer unlock()
+
+	src, err := loadPage(t.Title)
+	if err != nil || !slices.Contains(src.Files, t.File) {
+		return errNoAttachment
+	}
+	samePage := t.To == t.Title
+	dst := src
+	if !samePage {
+		if dst, err = loadPage(t.To); err != nil {
+			dst = &Page{Title: t.To, Body: []byte{}}
+		}
+	}
+	// The browser encrypts an encrypted page's files, so they would be
+	// unreadable on a plain page, and a plain file would be sent as it is
+	// from an encrypted one
+	if src.Meta.Encrypted != dst.Meta.Encrypted {
+		return errEncryptionDiffers
+	}
+
+	srcPath := filepath.Join(pageFilesDir(t.Title), t.File)
+	dstPath := filepath.Join(pageFilesDir(t.To), t.Name)
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return errNoAttachment
+	}
+	if _, err := os.Stat(dstPath); err == nil || slices.Contains(dst.Files, t.Name) {
+		return errAttachmentExists
+	}
+	if err := transferAllowed(t, info.Size()); err != nil {
+		return err
+	}
+
+	// Put the file in place. Writes always replace attachments by renaming,
+	// so a move can share the file's data until the source is removed.
+	if err := os.MkdirAll(pageFilesDir(t.To), 0755); err != nil {
+		return err
+	}
+	if t.Copy {
+		err = copyFileAtomic(srcPath, dstPath, 0644)
+	} else if err = os.Link(srcPath, dstPath); err != nil {
+		err = copyFileAtomic(srcPath, dstPath, 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	attachment, ok := src.Meta.Attachments[t.File]
+	if !ok {
+		if attachment, err = detectAttachment(dstPath); err != nil {
+			os.Remove(dstPath)
+			return err
+		}
+	}
+	if samePage && !t.Copy {
+		// A rename keeps the file's place in the list
+		dst.Files[slices.Index(dst.Files, t.File)] = t.Name
+		delete(dst.Meta.Attachments, t.File)
+	} else {
+		dst.Files = append(dst.Files, t.Name)
+	}
+	if dst.Meta.Attachments == nil {
+		dst.Meta.Attachments = make(map[string]AttachmentMeta)
+	}
+	dst.Meta.Attachments[t.Name] = attachment
+	if err := dst.save(); err != nil {
+		os.Remove(dstPath)
+		return err
+	}
+
+	if !samePage && !t.Copy {
+		src.Files = slices.DeleteFunc(src.Files, func(f string) bool { return f == t.File })
+		delete(src.Meta.Attachments, t.File)
+		if err := src.save(); err != nil {
+			// Take the file back off the destination page
+			dst.Files = slices.DeleteFunc(dst.Files, func(f string) bool { return f == t.Name })
+			delete(dst.Meta.Attachments, t.Name)
+			if dst.save() == nil {
+				os.Remove(dstPath)
+			}
+			return err
+		}
+	}
+	if !t.Copy {
+		os.Remove(srcPath)
+		removeThumbnails(t.Title, t.File)
+		moveVersions(t)
+	}
+
+	backupTransfer(t, srcPath, dstPath)
+	events.publish(eventUpload, t.To, t.Name)
+	if !t.Copy {
+		events.publish(eventFileDelete, t.Title, t.File)
+	}
+	return nil
+}
+
+// transferAllowed checks t against the upload limits. A copy counts like a
+// new upload; a move only adds to the destination page.
+func transferAllowed(t attachmentTransfer, size int64) error {
+	if t.Copy {
+		allowance, limitErr, err := attachmentAllowance(t.To, t.Name)
+		if err != nil {
+			return err
+		}
+		if size > allowance {
+			return limitErr
+		}
+		return nil
+	}
+	if t.To == t.Title || maxPageSize <= 0 {
+		return nil
+	}
+	used, err := pageUsage(t.To)
+	if err != nil {
+		return err
+	}
+	// The file's versions move with it
+	for _, v := range listVersions(t.Title, t.File) {
+		if info, err := os.Stat(versionPath(t.Title, t.File, v.ID)); err == nil {
+			size += info.Size()
+		}
+	}
+	if used+size > maxPageSize {
+		return &uploadLimitError{Limit: "page's attachment limit", Max: maxPageSize}
+	}
+	return nil
+}
+
+// moveVersions takes the earlier versions of a moved attachment along,
+// here and in the backup
+func moveVersions(t attachmentTransfer) {
+	for _, v := range listVersions(t.Title, t.File) {
+		from := versionPath(t.Title, t.File, v.ID)
+		to := versionPath(t.To, t.Name, v.ID)
+		if os.MkdirAll(filepath.Dir(to), 0755) != nil || os.Rename(from, to) != nil {
+			continue
+		}
+		backupFrom, ok1 := backupAttachmentPath(from)
+		backupTo, ok2 := backupAttachmentPath(to)
+		if ok1 && ok2 && os.MkdirAll(filepath.Dir(backupTo), 0755) == nil {
+			os.Rename(backupFrom, backupTo)
+		}
+	}
+}
+
+// backupTransfer updates the backup for a finished transfer. Failures only
+// leave the backup behind until the next full run, so they are logged.
+func backupTransfer(t attachmentTransfer, srcPath, dstPath string) {
+	if err := backupPage(t.To); err != nil {
+		log.Printf("Error backing up %s after moving an attachment: %v", t.To, err)
+	}
+	if t.To != t.Title {
+		if err := backupPage(t.Title); err != nil {
+			log.Printf("Error backing up %s after moving an attachment: %v", t.Title, err)
+		}
+	}
+	if backup, ok := backupAttachmentPath(dstPath); ok {
+		if err := os.MkdirAll(filepath.Dir(backup), 0755); err != nil {
+			log.Printf("Error backing up %s after moving an attachment: %v", t.To, err)
+		} else if err := copyFile(dstPath, backup); err != nil {
+			log.Printf("Error backing up %s after moving an attachment: %v", t.To, err)
+		}
+	}
+	if backup, ok := backupAttachmentPath(srcPath); ok && !t.Copy {
+		os.Remove(backup)
+	}
+}
+
+// apiAttachmentHandler serves POST /api/attachment. It takes the form
+// fields action (rename, move or copy), title and file for the attachment,
+// and to (the destination page) and name (its new file name); both default
+// to the current ones. It answers with the new location as JSON, or with
+// return=edit redirects back to the source page's editor.
+func apiAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	title, err := normalizeTitle(r.FormValue("title"))
+	if err != nil {
+		http.Error(w, "Invalid title parameter", http.StatusBadRequest)
+		return
+	}
+	file, ok := cleanAttachmentName(r.FormValue("file"))
+	if !ok || file != r.FormValue("file") {
+		http.Error(w, "Invalid file parameter", http.StatusBadRequest)
+		return
+	}
+	t := attachmentTransfer{Title: title, File: file, To: title, Name: file}
+	if to := r.FormValue("to"); to != "" {
+		if t.To, err = normalizeTitle(to); err != nil {
+			http.Error(w, "Invalid to parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if name := r.FormValue("name"); name != "" {
+		if t.Name, ok = cleanAttachmentName(name); !ok {
+			uploadError(w, errBadFileName, http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch r.FormValue("action") {
+	case "rename":
+		t.To = title
+	case "move":
+	case "copy":
+		t.Copy = true
+	default:
+		http.Error(w, "Unknown action; use rename, move or copy", http.StatusBadRequest)
+		return
+	}
+
+	if attachmentGone(t.Title, t.File) || pageGone(t.To) {
+		goneError(w)
+		return
+	}
+	for _, page := range []string{t.Title, t.To} {
+		if pageLocked(r, page) {
+			lockedError(w, r, page)
+			return
+		}
+	}
+
+	switch err := transferAttachment(t); {
+	case errors.Is(err, errNoAttachment):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errAttachmentExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errEncryptionDiffers):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		uploadError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if r.FormValue("return") == "edit" {
+		http.Redirect(w, r, "/edit/"+title, http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Title string `json:"title"`
+		File  string `json:"file"`
+	}{t.To, t.Name})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// transfer posts an attachment transfer to the API
+func transfer(action, title, file, to, name string) (int, string) {
+	w := postForm(apiAttachmentHandler, "/api/attachment", url.Values{
+		"action": {action}, "title": {title}, "file": {file}, "to": {to}, "name": {name},
+	})
+	return w.Code, w.Body.String()
+}
+
+// attachmentContent reads file on title, "" if it isn't there
+func attachmentContent(title, file string) string {
+	data, err := readStored(filepath.Join(pageFilesDir(title), file))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func TestTransferAttachment(t *testing.T) {
+	testWiki(t)
+	writeTestPage(t, "Source", "a.txt", "first")
+	if w := postFile("Source", "b.txt", "second"); w.Code != http.StatusOK {
+		t.Fatalf("uploading b.txt: %d %s", w.Code, w.Body)
+	}
+
+	if code, body := transfer("rename", "Source", "a.txt", "", "renamed.txt"); code != http.StatusOK {
+		t.Fatalf("rename: %d %s", code, body)
+	}
+	if code, body := transfer("copy", "Source", "renamed.txt", "Copies", ""); code != http.StatusOK {
+		t.Fatalf("copy: %d %s", code, body)
+	}
+	if code, body := transfer("move", "Source", "b.txt", "Target", "moved.txt"); code != http.StatusOK {
+		t.Fatalf("move: %d %s", code, body)
+	}
+
+	for _, f := range []struct{ title, file, want string }{
+		{"Source", "renamed.txt", "first"},
+		{"Source", "a.txt", ""},
+		{"Source", "b.txt", ""},
+		{"Copies", "renamed.txt", "first"},
+		{"Target", "moved.txt", "second"},
+	} {
+		if got := attachmentContent(f.title, f.file); got != f.want {
+			t.Errorf("%s on %q = %q, want %q", f.file, f.title, got, f.want)
+		}
+	}
+	for _, title := range []string{"Source", "Copies", "Target"} {
+		checkConsistent(t, title)
+	}
+}
+
+func TestTransferAttachmentRefused(t *testing.T) {
+	testWiki(t)
+	for title, content := range map[string]string{"Source": "first", "Other": "other"} {
+		if w := postFile(title, "a.txt", content); w.Code != http.StatusOK {
+			t.Fatalf("uploading to %q: %d %s", title, w.Code, w.Body)
+		}
+	}
+	ciphertext := base64.StdEncoding.EncodeToString(make([]byte, gcmOverhead+10))
+	if w := postForm(testSave, "/save/Secret", url.Values{"body": {ciphertext}, "meta": {"1"}, "encrypted": {"1"}}); w.Code != http.StatusFound {
+		t.Fatalf("saving the encrypted page: %d %s", w.Code, w.Body)
+	}
+	if w := postFile("Secret", "sealed.bin", "browser ciphertext"); w.Code != http.StatusOK {
+		t.Fatalf("uploading to the encrypted page: %d %s", w.Code, w.Body)
+	}
+	bury("Expired", "")
+	bury("Source", "buried.txt")
+	t.Cleanup(func() {
+		unbury("Expired", "")
+		unbury("Source", "buried.txt")
+	})
+
+	for _, tt := range []struct {
+		what                          string
+		action, title, file, to, name string
+		want                          int
+	}{
+		{"missing file", "move", "Source", "none.txt", "Other", "", http.StatusNotFound},
+		{"missing page", "move", "Nowhere", "a.txt", "Other", "", http.StatusNotFound},
+		{"name taken", "move", "Source", "a.txt", "Other", "", http.StatusConflict},
+		{"bad name", "rename", "Source", "a.txt", "", ".a.txt", http.StatusBadRequest},
+		{"unknown action", "swap", "Source", "a.txt", "Other", "", http.StatusBadRequest},
+		{"plain to encrypted", "copy", "Source", "a.txt", "Secret", "", http.StatusForbidden},
+		{"encrypted to plain", "move", "Secret", "sealed.bin", "Source", "", http.StatusForbidden},
+		{"encrypted to new page", "move", "Secret", "sealed.bin", "Fresh", "", http.StatusForbidden},
+		{"expired destination", "move", "Source", "a.txt", "Expired", "", http.StatusGone},
+		{"expired file", "rename", "Source", "buried.txt", "", "b.txt", http.StatusGone},
+	} {
+		if code, body := transfer(tt.action, tt.title, tt.file, tt.to, tt.name); code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.what, code, body, tt.want)
+		}
+	}
+
+	if got := attachmentContent("Source", "a.txt"); got != "first" {
+		t.Errorf("a.txt on Source after refused transfers = %q", got)
+	}
+	if got := attachmentContent("Secret", "sealed.bin"); got != "browser ciphertext" {
+		t.Errorf("sealed.bin on Secret after refused transfers = %q", got)
+	}
+	for _, title := range []string{"Source", "Other", "Secret", "Fresh"} {
+		checkConsistent(t, title)
+	}
+	if _, err := os.Stat(pageFilename("Fresh")); !os.IsNotExist(err) {
+		t.Errorf("a refused move created its destination page: %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"unicode/utf16"
+)
+
+// textOp is an operational-transform edit of a text document, in the JSON
+// format of ot.js: an array whose positive numbers retain characters,
+// negative numbers delete them and strings insert text. Positions count
+// UTF-16 code units so they match JavaScript string indices in the editor.
+type textOp []opComponent
+
+// opComponent is exactly one of a retain, a delete or an insert
+type opComponent struct {
+	Retain int
+	Delete int
+	Insert []uint16
+}
+
+var errOpMismatch = errors.New("operation does not match the document")
+
+// maxOpLen bounds what one operation can retain or delete, far beyond any
+// page, so lengths from clients can't overflow when they are added up
+const maxOpLen = 1 << 30
+
+func (o *textOp) retain(n int) {
+	if n <= 0 {
+		return
+	}
+	if k := len(*o); k > 0 && (*o)[k-1].Retain > 0 {
+		(*o)[k-1].Retain += n
+		return
+	}
+	*o = append(*o, opComponent{Retain: n})
+}
+
+func (o *textOp) delete(n int) {
+	if n <= 0 {
+		return
+	}
+	if k := len(*o); k > 0 && (*o)[k-1].Delete > 0 {
+		(*o)[k-1].Delete += n
+		return
+	}
+	*o = append(*o, opComponent{Delete: n})
+}
+
+// insert keeps inserts ahead of an adjacent delete, so equal edits always
+// have the same canonical form
+func (o *textOp) insert(s []uint16) {
+	if len(s) == 0 {
+		return
+	}
+	k := len(*o)
+	if k > 0 && (*o)[k-1].Insert != nil {
+		(*o)[k-1].Insert = append(append([]uint16(nil), (*o)[k-1].Insert...), s...)
+		return
+	}
+	if k > 0 && (*o)[k-1].Delete > 0 {
+		if k > 1 && (*o)[k-2].Insert != nil {
+			(*o)[k-2].Insert = append(append([]uint16(nil), (*o)[k-2].Insert...), s...)
+			return
+		}
+		del := (*o)[k-1]
+		(*o)[k-1] = opComponent{Insert: s}
+		*o = append(*o, del)
+		return
+	}
+	*o = append(*o, opComponent{Insert: s})
+}
+
+// baseLen is the length of the document the operation applies to, or -1
+// if no document could be that long
+func (o textOp) baseLen() int {
+	n := 0
+	for _, c := range o {
+		if c.Retain < 0 || c.Delete < 0 || c.Retain > maxOpLen-n || c.Delete > maxOpLen-n-c.Retain {
+			return -1
+		}
+		n += c.Retain + c.Delete
+	}
+	return n
+}
+
+// apply returns doc with the operation applied
+func (o textOp) apply(doc []uint16) ([]uint16, error) {
+	if o.baseLen() != len(doc) {
+		return nil, errOpMismatch
+	}
+	out := make([]uint16, 0, len(doc))
+	pos := 0
+	for _, c := range o {
+		switch {
+		case c.Retain > 0:
+			out = append(out, doc[pos:pos+c.Retain]...)
+			pos += c.Retain
+		case c.Delete > 0:
+			pos += c.Delete
+		default:
+			out = append(out, c.Insert...)
+		}
+	}
+	return out, nil
+}
+
+// transformOps takes two operations made concurrently on the same document
+// and returns a' and b' such that applying a then b' equals applying b then
+// a'. When both insert at the same position, a's text comes first.
+func transformOps(a, b textOp) (textOp, textOp, error) {
+	if a.baseLen() < 0 || a.baseLen() != b.baseLen() {
+		return nil, nil, errOpMismatch
+	}
+	var a1, b1 textOp
+	i, j := 0, 0
+	var c1, c2 opComponent
+	has1, has2 := false, false
+	next1 := func() {
+		has1 = i < len(a)
+		if has1 {
+			c1 = a[i]
+			i++
+		}
+	}
+	next2 := func() {
+		has2 = j < len(b)
+		if has2 {
+			c2 = b[j]
+			j++
+		}
+	}
+	next1()
+	next2()
+	for has1 || has2 {
+		if has1 && c1.Insert != nil {
+			a1.insert(c1.Insert)
+			b1.retain(len(c1.Insert))
+			next1()
+			continue
+		}
+		if has2 && c2.Insert != nil {
+			a1.retain(len(c2.Insert))
+			b1.insert(c2.Insert)
+			next2()
+			continue
+		}
+		if !has1 || !has2 {
+			return nil, nil, errOpMismatch
+		}
+		n1, n2 := c1.Retain+c1.Delete, c2.Retain+c2.Delete
+		n := min(n1, n2)
+		switch {
+		case c1.Retain > 0 && c2.Retain > 0:
+			a1.retain(n)
+			b1.retain(n)
+		case c1.Delete > 0 && c2.Retain > 0:
+			a1.delete(n)
+		case c1.Retain > 0 && c2.Delete > 0:
+			b1.delete(n)
+		}
+		// Both deleting the same text needs no output on either side
+		if n1 == n {
+			next1()
+		} else {
+			c1 = shorten(c1, n)
+		}
+		if n2 == n {
+			next2()
+		} else {
+			c2 = shorten(c2, n)
+		}
+	}
+	return a1, b1, nil
+}
+
+// shorten drops the first n characters of a retain or delete
+func shorten(c opComponent, n int) opComponent {
+	if c.Retain > 0 {
+		c.Retain -= n
+	} else {
+		c.Delete -= n
+	}
+	return c
+}
+
+// diffOp builds the operation that turns old into new as one replaced range
+func diffOp(old, new []uint16) textOp {
+	prefix := 0
+	for prefix < len(old) && prefix < len(new) && old[prefix] == new[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(new)-prefix && old[len(old)-1-suffix] == new[len(new)-1-suffix] {
+		suffix++
+	}
+	var o textOp
+	o.retain(prefix)
+	o.insert(new[prefix : len(new)-suffix])
+	o.delete(len(old) - prefix - suffix)
+	o.retain(suffix)
+	return o
+}
+
+func (o textOp) MarshalJSON() ([]byte, error) {
+	parts := make([]interface{}, 0, len(o))
+	for _, c := range o {
+		switch {
+		case c.Retain > 0:
+			parts = append(parts, c.Retain)
+		case c.Delete > 0:
+			parts = append(parts, -c.Delete)
+		default:
+			parts = append(parts, string(utf16.Decode(c.Insert)))
+		}
+	}
+	return json.Marshal(parts)
+}
+
+func (o *textOp) UnmarshalJSON(data []byte) error {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	*o = nil
+	for _, part := range parts {
+		var n int
+		if err := json.Unmarshal(part, &n); err == nil {
+			if n > maxOpLen || n < -maxOpLen {
+				return errOpMismatch
+			}
+			if n > 0 {
+				o.retain(n)
+			} else if n < 0 {
+				o.delete(-n)
+			}
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(part, &s); err != nil {
+			return errors.New("operation components must be numbers or strings")
+		}
+		o.insert(utf16.Encode([]rune(s)))
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+	"unicode/utf16"
+)
+
+// parseOp reads an operation in its JSON form
+func parseOp(t *testing.T, s string) textOp {
+	t.Helper()
+	var o textOp
+	if err := json.Unmarshal([]byte(s), &o); err != nil {
+		t.Fatalf("parsing %s: %v", s, err)
+	}
+	return o
+}
+
+// applyText applies o to doc as a Go string
+func applyText(o textOp, doc string) (string, error) {
+	out, err := o.apply(utf16.Encode([]rune(doc)))
+	return string(utf16.Decode(out)), err
+}
+
+func TestOpApply(t *testing.T) {
+	tests := []struct {
+		doc, op, want string
+		err           bool
+	}{
+		{doc: "hello", op: `[5, " world"]`, want: "hello world"},
+		{doc: "hello world", op: `[5, -6]`, want: "hello"},
+		{doc: "hello", op: `["oh, ", 5]`, want: "oh, hello"},
+		{doc: "hello", op: `[1, "a", -4]`, want: "ha"},
+		{doc: "😀x", op: `[2, -1, "y"]`, want: "😀y"},
+		{doc: "", op: `["new"]`, want: "new"},
+		{doc: "", op: `[]`, want: ""},
+		{doc: "hello", op: `[4]`, err: true},
+		{doc: "hello", op: `[6]`, err: true},
+		{doc: "hello", op: `[3, -3]`, err: true},
+	}
+	for _, tt := range tests {
+		got, err := applyText(parseOp(t, tt.op), tt.doc)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s on %q = %q, want an error", tt.op, tt.doc, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s on %q = %q, %v, want %q", tt.op, tt.doc, got, err, tt.want)
+		}
+	}
+}
+
+// TestOpHugeComponents sends lengths that only add up to the document
+// once they overflow
+func TestOpHugeComponents(t *testing.T) {
+	doc := "hello"
+	for _, op := range []string{
+		fmt.Sprintf(`[%d, %d, %d]`, math.MaxInt, -math.MaxInt, len(doc)+2),
+		fmt.Sprintf(`[%d, %d]`, math.MaxInt, math.MinInt),
+		fmt.Sprintf(`[%d, %d, %d]`, maxOpLen, maxOpLen, len(doc)),
+		fmt.Sprintf(`[%d, %d]`, -maxOpLen, -maxOpLen),
+	} {
+		var o textOp
+		if err := json.Unmarshal([]byte(op), &o); err != nil {
+			continue
+		}
+		if got, err := applyText(o, doc); err == nil {
+			t.Errorf("%s on %q = %q, want an error", op, doc, got)
+		}
+		if _, _, err := transformOps(o, parseOp(t, `[5]`)); err == nil {
+			t.Errorf("%s was transformed against an op on %q", op, doc)
+		}
+	}
+}
+
+// TestTransformConverges checks that both orders of two concurrent edits
+// end in the same document (TP1)
+func TestTransformConverges(t *testing.T) {
+	tests := []struct {
+		doc, a, b, want string
+	}{
+		{doc: "abc", a: `["x", 3]`, b: `[3, "y"]`, want: "xabcy"},
+		// Inserts at the same place put a's text first
+		{doc: "abc", a: `[1, "x", 2]`, b: `[1, "y", 2]`, want: "axybc"},
+		{doc: "abc", a: `[-1, 2]`, b: `[-1, 2]`, want: "bc"},
+		{doc: "abcdef", a: `[1, -3, 2]`, b: `[2, -3, 1]`, want: "af"},
+		// An insert inside text the other deletes survives
+		{doc: "abcdef", a: `[3, "x", 3]`, b: `[1, -4, 1]`, want: "axf"},
+		{doc: "abc", a: `[3]`, b: `[-3, "new"]`, want: "new"},
+		{doc: "😀😀", a: `[2, "x", 2]`, b: `[-2, 2]`, want: "x😀"},
+		{doc: "", a: `["a"]`, b: `["b"]`, want: "ab"},
+	}
+	for _, tt := range tests {
+		a, b := parseOp(t, tt.a), parseOp(t, tt.b)
+		a1, b1, err := transformOps(a, b)
+		if err != nil {
+			t.Errorf("transforming %s and %s: %v", tt.a, tt.b, err)
+			continue
+		}
+		afterA, errA := applyText(a, tt.doc)
+		afterAB, errAB := applyText(b1, afterA)
+		afterB, errB := applyText(b, tt.doc)
+		afterBA, errBA := applyText(a1, afterB)
+		if errA != nil || errAB != nil || errB != nil || errBA != nil {
+			t.Errorf("%s and %s on %q: %v %v %v %v", tt.a, tt.b, tt.doc, errA, errAB, errB, errBA)
+			continue
+		}
+		if afterAB != afterBA || afterAB != tt.want {
+			t.Errorf("%s and %s on %q: %q one way, %q the other, want %q", tt.a, tt.b, tt.doc, afterAB, afterBA, tt.want)
+		}
+	}
+	if _, _, err := transformOps(parseOp(t, `[3]`), parseOp(t, `[4]`)); err == nil {
+		t.Error("ops on documents of different lengths were transformed")
+	}
+}
+
+func TestDiffOp(t *testing.T) {
+	for _, tt := range []struct{ old, new string }{
+		{"hello world", "hello there world"},
+		{"hello world", "world"},
+		{"abc", "abc"},
+		{"", "text"},
+		{"text", ""},
+		{"a😀b", "a😁b"},
+	} {
+		o := diffOp(utf16.Encode([]rune(tt.old)), utf16.Encode([]rune(tt.new)))
+		if got, err := applyText(o, tt.old); err != nil || got != tt.new {
+			t.Errorf("diff of %q and %q gives %q, %v", tt.old, tt.new, got, err)
+		}
+	}
+}
+
+// TestOpJSON checks that operations keep their canonical form through JSON
+func TestOpJSON(t *testing.T) {
+	for in, want := range map[string]string{
+		`[1, 2, "a", "b", -1, -2]`: `[3,"ab",-3]`,
+		`[1, -2, "x", 1]`:          `[1,"x",-2,1]`,
+		`[0, "", 4]`:               `[4]`,
+	} {
+		data, err := json.Marshal(parseOp(t, in))
+		if err != nil || string(data) != want {
+			t.Errorf("%s comes back as %s, %v, want %s", in, data, err, want)
+		}
+	}
+	var o textOp
+	if err := json.Unmarshal([]byte(`[1, true]`), &o); err == nil {
+		t.Error("an op with a boolean component was accepted")
+	}
+}
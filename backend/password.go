@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A page can be given a password on the edit page. Only a PBKDF2 hash of it
+// is kept, in the page's metadata, so it is backed up and restored with the
+// page like everything else there. Entering the password at /unlock/{title}
+// sets a signed cookie for that page; without it every route for the page
+// (view, edit, raw, files, thumbnails, previews, versions and the JSON API)
+// is refused. A valid share link lets its holder in without the password.
+
+// PBKDF2 parameters for new passwords; stored hashes keep their own
+// iteration count
+const (
+	passwordIterations = 600000
+	passwordKeyLen     = 32
+)
+
+// unlockTTL is how long entering a page's password lasts
+const unlockTTL = 12 * time.Hour
+
+// Guessing is limited per page: after unlockMaxFailures wrong passwords
+// within unlockWindow, /unlock/ refuses the page's attempts, right or
+// wrong, until the window has passed. Checking a password is a slow hash,
+// so at most unlockHashers run at once and attempts beyond that are
+// refused rather than queued.
+const (
+	unlockMaxFailures = 5
+	unlockWindow      = 5 * time.Minute
+)
+
+var unlockHashers = make(chan struct{}, max(1, runtime.NumCPU()/2))
+
+// unlockFailures counts recent wrong passwords per page
+var unlockFailures = &failureCounter{counts: make(map[string]failureCount)}
+
+type failureCounter struct {
+	mu     sync.Mutex
+	counts map[string]failureCount
+}
+
+type failureCount struct {
+	n     int
+	since time.Time
+}
+
+// blocked reports whether title has had too many wrong passwords lately,
+// and for how much longer
+func (c *failureCounter) blocked(title string) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fc, ok := c.counts[title]
+	if !ok {
+		return 0, false
+	}
+	left := unlockWindow - time.Since(fc.since)
+	if left <= 0 {
+		delete(c.counts, title)
+		return 0, false
+	}
+	return left, fc.n >= unlockMaxFailures
+}
+
+// fail records a wrong password for title, dropping counts that have run
+// out as it goes
+func (c *failureCounter) fail(title string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for t, fc := range c.counts {
+		if time.Since(fc.since) >= unlockWindow {
+			delete(c.counts, t)
+		}
+	}
+	fc, ok := c.counts[title]
+	if !ok {
+		fc.since = time.Now()
+	}
+	fc.n++
+	c.counts[title] = fc
+}
+
+// PagePassword is the hash of a page's password
+type PagePassword struct {
+	Hash       string `json:"hash"` // base64 PBKDF2-SHA256
+	Salt       string `json:"salt"` // base64
+	Iterations int    `json:"iterations"`
+}
+
+// hashPassword hashes a new page password
+func hashPassword(password string) (*PagePassword, error) {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, passwordKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	return &PagePassword{
+		Hash:       base64.StdEncoding.EncodeToString(key),
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		Iterations: passwordIterations,
+	}, nil
+}
+
+// matches reports whether password is the page's password
+func (pw *PagePassword) matches(password string) bool {
+	salt, err := base64.StdEncoding.DecodeString(pw.Salt)
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(pw.Hash)
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, pw.Iterations, len(want))
+	return err == nil && subtle.ConstantTimeCompare(key, want) == 1
+}
+
+// Protected reports whether the page has a password, for the templates
+func (m PageMeta) Protected() bool {
+	return m.Password != nil
+}
+
+// unlockCookieName is the cookie that unlocks title. Titles can hold
+// characters cookie names can't, so it is named after a hash.
+func unlockCookieName(title string) string {
+	sum := sha256.Sum256([]byte(title))
+	return "wiki_unlock_" + hex.EncodeToString(sum[:8])
+}
+
+// unlockSignature signs an unlock cookie. The password hash is part of it,
+// so changing or removing the password ends every unlock.
+func unlockSignature(key []byte, title string, pw *PagePassword, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "unlock\x00%s\x00%d\x00%s", title, expires, pw.Hash)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setUnlockCookie unlocks title for the browser making r. It uses the
+// same key as share links.
+func setUnlockCookie(w http.ResponseWriter, r *http.Request, title string, pw *PagePassword) error {
+	key, err := shareKey()
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(unlockTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     unlockCookieName(title),
+		Value:    strconv.FormatInt(expires.Unix(), 10) + "." + unlockSignature(key, title, pw, expires.Unix()),
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(unlockTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// unlocked reports whether r carries a live unlock cookie for title
+func unlocked(r *http.Request, title string, pw *PagePassword) bool {
+	c, err := r.Cookie(unlockCookieName(title))
+	if err != nil {
+		return false
+	}
+	stamp, sig, _ := strings.Cut(c.Value, ".")
+	expires, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return false
+	}
+	key, err := shareKey()
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(unlockSignature(key, title, pw, expires)))
+}
+
+// pageLocked reports whether title has a password that r hasn't given
+func pageLocked(r *http.Request, title string) bool {
+	if _, ok := sharedLink(r); ok {
+		return false
+	}
+	unlock := pageLocks.RLock(title)
+	p, err := loadPage(title)
+	unlock()
+	if err != nil || p.Meta.Password == nil {
+		return false
+	}
+	return !unlocked(r, title, p.Meta.Password)
+}
+
+// pageProtected reports whether title has a password. Responses for such
+// pages are marked private, so shared caches can't hand them to anyone
+// who hasn't unlocked the page.
+func pageProtected(title string) bool {
+	unlock := pageLocks.RLock(title)
+	defer unlock()
+	p, err := loadPage(title)
+	return err == nil && p.Meta.Protected()
+}
+
+// lockedError answers a request for a locked page. Browsers opening the
+// page are sent to enter the password; anything else is refused.
+func lockedError(w http.ResponseWriter, r *http.Request, title string) {
+	if r.Method == "GET" && (strings.HasPrefix(r.URL.Path, "/view/") || strings.HasPrefix(r.URL.Path, "/edit/")) {
+		http.Redirect(w, r, "/unlock/"+title+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return
+	}
+	http.Error(w, "This page is password protected; unlock it at /unlock/"+title, http.StatusForbidden)
+}
+
+// UnlockPage is the data for the unlock.html password form
+type UnlockPage struct {
+	Title   string
+	Next    string
+	Wrong   bool
+	Blocked bool
+}
+
+// unlockHandler serves /unlock/{title}: GET asks for the password and POST
+// checks it and goes on to next
+func unlockHandler(w http.ResponseWriter, r *http.Request, title string) {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/view/" + title
+	}
+
+	unlock := pageLocks.RLock(title)
+	p, err := loadPage(title)
+	unlock()
+	if err != nil || p.Meta.Password == nil {
+		http.Redirect(w, r, next, http.StatusFound)
+		return
+	}
+
+	page := &UnlockPage{Title: title, Next: next}
+	if r.Method == "POST" {
+		// Refuse before hashing anything
+		if left, blocked := unlockFailures.blocked(title); blocked {
+			w.Header().Set("Retry-After", strconv.Itoa(int(left.Seconds())+1))
+			page.Blocked = true
+			w.WriteHeader(http.StatusTooManyRequests)
+			templates.ExecuteTemplate(w, "unlock.html", page)
+			return
+		}
+		select {
+		case unlockHashers <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many unlock attempts at once; try again shortly", http.StatusTooManyRequests)
+			return
+		}
+		ok := p.Meta.Password.matches(r.FormValue("password"))
+		<-unlockHashers
+		if ok {
+			if err := setUnlockCookie(w, r, title, p.Meta.Password); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, next, http.StatusFound)
+			return
+		}
+		unlockFailures.fail(title)
+		// Slow down guessing
+		time.Sleep(time.Second)
+		page.Wrong = true
+		w.WriteHeader(http.StatusForbidden)
+	}
+	if err := templates.ExecuteTemplate(w, "unlock.html", page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAttachmentOtherSpelling asks for an attachment of a protected page
+// through another spelling of its directory, as a case-insensitive
+// filesystem would resolve it
+func TestAttachmentOtherSpelling(t *testing.T) {
+	testWiki(t)
+	title := "Notes"
+	writeTestPage(t, title, "plan.txt", "secret plan")
+	if w := postForm(testSave, "/save/"+title, url.Values{"body": {"hidden"}, "password": {"hunter2"}}); w.Code != http.StatusFound {
+		t.Fatalf("protecting %q: %d %s", title, w.Code, w.Body)
+	}
+	other := "_4Eotes"
+	if err := os.Symlink(encodeTitle(title), filepath.Join(filesDir, other)); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]int{
+		"/files/" + encodeTitle(title) + "/plan.txt": http.StatusForbidden,
+		"/files/" + other + "/plan.txt":              http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		filesHandler(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Errorf("GET %s: %d, want %d", path, w.Code, want)
+		}
+	}
+}
+
+// quickPassword hashes password with few iterations, as a hash made
+// before the count was raised would be, to keep tests that check it quick
+func quickPassword(password string) *PagePassword {
+	salt := []byte("0123456789abcdef")
+	key, _ := pbkdf2.Key(sha256.New, password, salt, 1000, 16)
+	return &PagePassword{Hash: base64.StdEncoding.EncodeToString(key), Salt: base64.StdEncoding.EncodeToString(salt), Iterations: 1000}
+}
+
+func TestPagePassword(t *testing.T) {
+	pw, err := hashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pw.Iterations != passwordIterations || !pw.matches("hunter2") || pw.matches("Hunter2") {
+		t.Fatalf("hash of hunter2: %+v", pw)
+	}
+	if again, _ := hashPassword("hunter2"); again.Salt == pw.Salt || again.Hash == pw.Hash {
+		t.Error("two hashes of one password share a salt")
+	}
+
+	// Hashes made with other parameters keep working
+	old := quickPassword("hunter2")
+	if !old.matches("hunter2") {
+		t.Error("a hash with 1000 iterations doesn't check")
+	}
+	for _, wrong := range []string{"", "hunter", "hunter22", "Hunter2"} {
+		if old.matches(wrong) {
+			t.Errorf("%q matches", wrong)
+		}
+	}
+	for what, bad := range map[string]*PagePassword{
+		"bad salt":      {Hash: old.Hash, Salt: "not base64!", Iterations: 1000},
+		"bad hash":      {Hash: "not base64!", Salt: old.Salt, Iterations: 1000},
+		"empty hash":    {Hash: "", Salt: old.Salt, Iterations: 1000},
+		"no iterations": {Hash: old.Hash, Salt: old.Salt},
+	} {
+		if bad.matches("hunter2") {
+			t.Errorf("a password with a %s matches", what)
+		}
+	}
+}
+
+// quicklyProtect gives title a quickPassword
+func quicklyProtect(t *testing.T, title, password string) {
+	t.Helper()
+	err := savePageBody(title, []byte("hidden"), func(p *Page) { p.Meta.Password = quickPassword(password) })
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// protectPage saves title with a password and returns the unlock cookie
+// the save sets
+func protectPage(t *testing.T, title, password string) *http.Cookie {
+	t.Helper()
+	w := postForm(testSave, "/save/"+title, url.Values{"body": {"hidden"}, "password": {password}})
+	if w.Code != http.StatusFound {
+		t.Fatalf("protecting %s: %d %s", title, w.Code, w.Body)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == unlockCookieName(title) {
+			return c
+		}
+	}
+	t.Fatalf("protecting %s set no unlock cookie", title)
+	return nil
+}
+
+// rawWith requests /raw/{title} with cookies
+func rawWith(title string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/raw/"+title, nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	makeHandler(rawHandler)(w, r)
+	return w
+}
+
+func TestUnlockCookie(t *testing.T) {
+	testWiki(t)
+	cookie := protectPage(t, "Private", "hunter2")
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/" {
+		t.Errorf("unlock cookie: %+v", cookie)
+	}
+	if w := rawWith("Private", cookie); w.Code != http.StatusOK || w.Body.String() != "hidden" {
+		t.Fatalf("raw with the cookie: %d %q", w.Code, w.Body)
+	}
+	if w := rawWith("Private"); w.Code != http.StatusForbidden || strings.Contains(w.Body.String(), "hidden") {
+		t.Errorf("raw without the cookie: %d %q", w.Code, w.Body)
+	}
+
+	stamp, sig, _ := strings.Cut(cookie.Value, ".")
+	expires, _ := strconv.ParseInt(stamp, 10, 64)
+	key, _ := shareKey()
+	cache.purge()
+	p, _ := loadPage("Private")
+	past := time.Now().Add(-time.Minute).Unix()
+	tampered := "A"
+	if sig[0] == 'A' {
+		tampered = "B"
+	}
+	forged := map[string]string{
+		"a tampered signature": stamp + "." + tampered + sig[1:],
+		"a later expiry":       strconv.FormatInt(expires+3600, 10) + "." + sig,
+		"no signature":         stamp,
+		"no expiry":            sig,
+		"an expired cookie":    strconv.FormatInt(past, 10) + "." + unlockSignature(key, "Private", p.Meta.Password, past),
+		"another page's":       stamp + "." + unlockSignature(key, "Other", p.Meta.Password, expires),
+	}
+	for what, value := range forged {
+		c := &http.Cookie{Name: cookie.Name, Value: value}
+		if w := rawWith("Private", c); w.Code != http.StatusForbidden {
+			t.Errorf("raw with %s: %d", what, w.Code)
+		}
+	}
+	// The cookie only unlocks its own page
+	protectPage(t, "Other", "hunter2")
+	if w := rawWith("Other", &http.Cookie{Name: unlockCookieName("Other"), Value: cookie.Value}); w.Code != http.StatusForbidden {
+		t.Errorf("another page with this page's cookie: %d", w.Code)
+	}
+
+	// Changing the password ends every unlock
+	r := httptest.NewRequest("POST", "/save/Private", strings.NewReader(url.Values{"body": {"hidden"}, "password": {"changed"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	testSave(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("changing the password: %d %s", w.Code, w.Body)
+	}
+	if w := rawWith("Private", cookie); w.Code != http.StatusForbidden {
+		t.Errorf("raw with the cookie for the old password: %d", w.Code)
+	}
+}
+
+// postUnlock enters a password at /unlock/{title}
+func postUnlock(title, password, next string) *httptest.ResponseRecorder {
+	return postForm(makeHandler(unlockHandler), "/unlock/"+title, url.Values{"password": {password}, "next": {next}})
+}
+
+func TestUnlock(t *testing.T) {
+	testWiki(t)
+	quicklyProtect(t, "Private", "hunter2")
+	t.Cleanup(func() { delete(unlockFailures.counts, "Private") })
+
+	w := httptest.NewRecorder()
+	makeHandler(unlockHandler)(w, httptest.NewRequest("GET", "/unlock/Private?next=/raw/Private", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `value="/raw/Private"`) {
+		t.Errorf("unlock form: %d %s", w.Code, w.Body)
+	}
+	if w := postUnlock("Private", "wrong", "/raw/Private"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "Wrong password") {
+		t.Errorf("wrong password: %d", w.Code)
+	}
+
+	for next, want := range map[string]string{
+		"/raw/Private":         "/raw/Private",
+		"//evil.example/":      "/view/Private",
+		"https://evil.example": "/view/Private",
+		"":                     "/view/Private",
+	} {
+		w := postUnlock("Private", "hunter2", next)
+		if w.Code != http.StatusFound || w.Header().Get("Location") != want {
+			t.Errorf("unlocking for %q: %d to %s, want %s", next, w.Code, w.Header().Get("Location"), want)
+			continue
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || rawWith("Private", cookies[0]).Code != http.StatusOK {
+			t.Errorf("unlocking for %q set %v", next, cookies)
+		}
+	}
+
+	// A page without a password needs no unlocking
+	postForm(testSave, "/save/Open", url.Values{"body": {"open"}})
+	if w := postUnlock("Open", "", "/view/Open"); w.Code != http.StatusFound || len(w.Result().Cookies()) != 0 {
+		t.Errorf("unlocking a page without a password: %d", w.Code)
+	}
+}
+
+func TestUnlockLockout(t *testing.T) {
+	testWiki(t)
+	quicklyProtect(t, "Private", "hunter2")
+	quicklyProtect(t, "Other", "hunter2")
+	t.Cleanup(func() {
+		delete(unlockFailures.counts, "Private")
+		delete(unlockFailures.counts, "Other")
+	})
+
+	// The last wrong password of the limit goes through the handler, the
+	// rest are counted directly to keep the test quick
+	for range unlockMaxFailures - 1 {
+		unlockFailures.fail("Private")
+	}
+	if w := postUnlock("Private", "wrong", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("wrong password: %d", w.Code)
+	}
+	w := postUnlock("Private", "hunter2", "")
+	if w.Code != http.StatusTooManyRequests || len(w.Result().Cookies()) != 0 || w.Header().Get("Retry-After") == "" {
+		t.Errorf("right password after too many wrong ones: %d %v", w.Code, w.Header())
+	}
+	// Other pages aren't held up
+	if w := postUnlock("Other", "hunter2", ""); w.Code != http.StatusFound {
+		t.Errorf("unlocking another page: %d", w.Code)
+	}
+
+	// Once the window has passed the page can be unlocked again
+	unlockFailures.mu.Lock()
+	fc := unlockFailures.counts["Private"]
+	fc.since = time.Now().Add(-unlockWindow)
+	unlockFailures.counts["Private"] = fc
+	unlockFailures.mu.Unlock()
+	if w := postUnlock("Private", "hunter2", ""); w.Code != http.StatusFound {
+		t.Errorf("unlocking after the window: %d", w.Code)
+	}
+}
+
+func TestFailureCounter(t *testing.T) {
+	c := &failureCounter{counts: make(map[string]failureCount)}
+	for i := range unlockMaxFailures {
+		if _, blocked := c.blocked("Page"); blocked {
+			t.Fatalf("blocked after %d failures", i)
+		}
+		c.fail("Page")
+	}
+	if left, blocked := c.blocked("Page"); !blocked || left <= 0 || left > unlockWindow {
+		t.Errorf("after %d failures: blocked %v for %v", unlockMaxFailures, blocked, left)
+	}
+	if _, blocked := c.blocked("Other"); blocked {
+		t.Error("another page is blocked")
+	}
+
+	// Counts that have run out are dropped
+	c.counts["Page"] = failureCount{n: unlockMaxFailures, since: time.Now().Add(-unlockWindow)}
+	c.fail("Other")
+	if _, ok := c.counts["Page"]; ok {
+		t.Error("an old count was kept")
+	}
+}
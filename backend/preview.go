@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// /preview/{title}/{file} shows a text-like attachment in the page's style:
+// line numbers, syntax highlighting in the browser (highlight.js) and CSV
+// or TSV files as a table. Large files are shown previewChunk bytes at a
+// time, cut at a line break, with a link that loads the next range.
+
+const previewChunk = 256 << 10
+
+// previewLanguages maps extensions to highlight.js language names
+var previewLanguages = map[string]string{
+	".go": "go", ".py": "python", ".js": "javascript", ".mjs": "javascript", ".ts": "typescript",
+	".json": "json", ".yaml": "yaml", ".yml": "yaml", ".toml": "ini", ".ini": "ini", ".conf": "ini",
+	".sh": "bash", ".bash": "bash", ".zsh": "bash", ".sql": "sql", ".xml": "xml", ".html": "xml",
+	".svg": "xml", ".css": "css", ".md": "markdown", ".c": "c", ".h": "c", ".cpp": "cpp", ".hpp": "cpp",
+	".rs": "rust", ".java": "java", ".kt": "kotlin", ".rb": "ruby", ".php": "php", ".lua": "lua",
+	".tf": "ini", ".dockerfile": "dockerfile", ".diff": "diff", ".patch": "diff", ".log": "plaintext",
+	".txt": "plaintext",
+}
+
+// previewContentTypes are non-text/* types that are text underneath
+var previewContentTypes = map[string]bool{
+	"application/json":       true,
+	"application/xml":        true,
+	"application/javascript": true,
+	"application/x-yaml":     true,
+	"application/x-sh":       true,
+	"application/toml":       true,
+	"image/svg+xml":          true,
+}
+
+// PreviewPage is what preview.html renders
+type PreviewPage struct {
+	Title     string
+	File      string
+	FilesPath string
+	Language  string // highlight.js language, "" to let it guess
+	Text      string
+	Gutter    string // line numbers matching Text
+	Header    []string
+	Rows      [][]string // set instead of Text for CSV and TSV files
+	Offset    int64
+	End       int64
+	Size      int64
+	NextURL   string
+}
+
+// attachmentType returns the recorded type of an attachment, or a guess
+// from its name for attachments uploaded before types were recorded
+func (p *Page) attachmentType(name string) string {
+	if a, ok := p.Meta.Attachments[name]; ok && a.ContentType != "" {
+		return a.ContentType
+	}
+	return attachmentContentType(name, nil)
+}
+
+// CanPreview tells the view which attachments get a preview link
+func (p *Page) CanPreview(name string) bool {
+	if p.Meta.Encrypted {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	if previewLanguages[ext] != "" || ext == ".csv" || ext == ".tsv" {
+		return true
+	}
+	t := mediaType(p.attachmentType(name))
+	return strings.HasPrefix(t, "text/") || previewContentTypes[t]
+}
+
+// previewHandler serves /preview/{title}/{file}?offset=N&line=N
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	title, file, ok := splitTitleFile(r.URL.Path, "/preview/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if attachmentGone(title, file) {
+		goneError(w)
+		return
+	}
+	if pageLocked(r, title) {
+		lockedError(w, r, title)
+		return
+	}
+	unlock := pageLocks.RLock(title)
+	p, err := loadPage(title)
+	unlock()
+	if err != nil || !slices.Contains(p.Files, file) {
+		http.NotFound(w, r)
+		return
+	}
+	if p.Meta.Encrypted {
+		http.Error(w, errEncryptedPage.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if !p.CanPreview(file) {
+		http.Error(w, "This attachment can't be previewed", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	line, _ := strconv.Atoi(r.URL.Query().Get("line"))
+	if offset < 0 {
+		offset = 0
+	}
+	if line < 1 {
+		line = 1
+	}
+
+	f, err := openStored(filepath.Join(pageFilesDir(title), file))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if offset > info.Size() {
+		offset = info.Size()
+	}
+	chunk := make([]byte, previewChunk)
+	n, err := f.ReadAt(chunk, offset)
+	if err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	chunk = chunk[:n]
+	if bytes.IndexByte(chunk, 0) >= 0 {
+		http.Error(w, "This attachment is not text", http.StatusUnsupportedMediaType)
+		return
+	}
+	// Stop at the last full line unless this is the end of the file
+	if end := offset + int64(n); end < info.Size() {
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			chunk = chunk[:i+1]
+		}
+	}
+
+	pp := &PreviewPage{
+		Title:     title,
+		File:      file,
+		FilesPath: encodeTitle(title),
+		Language:  previewLanguages[strings.ToLower(filepath.Ext(file))],
+		Offset:    offset,
+		End:       offset + int64(len(chunk)),
+		Size:      info.Size(),
+	}
+	text := strings.ToValidUTF8(string(chunk), string(utf8.RuneError))
+	lines := strings.Count(strings.TrimSuffix(text, "\n"), "\n") + 1
+	if pp.End < pp.Size {
+		next := url.Values{"offset": {strconv.FormatInt(pp.End, 10)}, "line": {strconv.Itoa(line + lines)}}
+		pp.NextURL = r.URL.Path + "?" + next.Encode()
+	}
+
+	ext := strings.ToLower(filepath.Ext(file))
+	if ext == ".csv" || ext == ".tsv" || mediaType(p.attachmentType(file)) == "text/csv" {
+		reader := csv.NewReader(strings.NewReader(text))
+		reader.FieldsPerRecord = -1
+		reader.LazyQuotes = true
+		if ext == ".tsv" {
+			reader.Comma = '\t'
+		}
+		if rows, err := reader.ReadAll(); err == nil && len(rows) > 0 {
+			if offset == 0 {
+				pp.Header, rows = rows[0], rows[1:]
+			}
+			pp.Rows = rows
+		}
+	}
+	if pp.Rows == nil && pp.Header == nil {
+		pp.Text = text
+		numbers := make([]string, lines)
+		for i := range numbers {
+			numbers[i] = fmt.Sprint(line + i)
+		}
+		pp.Gutter = strings.Join(numbers, "\n")
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := templates.ExecuteTemplate(w, "preview.html", pp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
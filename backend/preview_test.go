@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// getPreview requests a preview
+func getPreview(path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	previewHandler(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestPreview(t *testing.T) {
+	testWiki(t)
+	for name, content := range map[string]string{
+		"main.go":   "package main\n\nfunc main() { println(\"<script>\") }\n",
+		"table.csv": "name,size\nalpha,1\n\"b,eta\",2\n",
+		"table.tsv": "name\tsize\ngamma\t3\n",
+	} {
+		if w := postFile("Docs", name, content); w.Code != http.StatusOK {
+			t.Fatalf("uploading %s: %d %s", name, w.Code, w.Body)
+		}
+	}
+
+	w := getPreview("/preview/Docs/main.go")
+	body := w.Body.String()
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("preview of main.go: %d %s", w.Code, body)
+	}
+	if !strings.Contains(body, "package main") || !strings.Contains(body, "language-go") {
+		t.Errorf("preview of main.go doesn't show the code: %s", body)
+	}
+	if strings.Contains(body, "<script>\")") || !strings.Contains(body, "&lt;script&gt;") {
+		t.Errorf("the code isn't escaped: %s", body)
+	}
+
+	for path, cells := range map[string][]string{
+		"/preview/Docs/table.csv": {"<th>name</th>", "<td>alpha</td>", "<td>b,eta</td>"},
+		"/preview/Docs/table.tsv": {"<th>size</th>", "<td>gamma</td>", "<td>3</td>"},
+	} {
+		w := getPreview(path)
+		for _, cell := range cells {
+			if !strings.Contains(w.Body.String(), cell) {
+				t.Errorf("%s doesn't show %s: %d %s", path, cell, w.Code, w.Body)
+			}
+		}
+	}
+}
+
+// TestPreviewRanges checks that a large file is shown a range at a time,
+// cut at line breaks
+func TestPreviewRanges(t *testing.T) {
+	testWiki(t)
+	line := strings.Repeat("x", 99) + "\n"
+	lines := previewChunk/len(line) + 10
+	if w := postFile("Docs", "big.log", strings.Repeat(line, lines)); w.Code != http.StatusOK {
+		t.Fatal(w.Body)
+	}
+
+	w := getPreview("/preview/Docs/big.log")
+	shown := previewChunk / len(line)
+	next := "/preview/Docs/big.log?" + url.Values{
+		"line":   {strconv.Itoa(shown + 1)},
+		"offset": {strconv.Itoa(shown * len(line))},
+	}.Encode()
+	if !strings.Contains(w.Body.String(), strings.ReplaceAll(next, "&", "&amp;")) {
+		t.Fatalf("first range doesn't link to %s: %d", next, w.Code)
+	}
+	w = getPreview(next)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "offset=") || !strings.Contains(w.Body.String(), "\n"+strconv.Itoa(lines)+"<") {
+		t.Errorf("last range: %d", w.Code)
+	}
+	// Offsets past the end show nothing rather than failing
+	if w := getPreview("/preview/Docs/big.log?offset=99999999&line=-4"); w.Code != http.StatusOK {
+		t.Errorf("offset past the end: %d", w.Code)
+	}
+}
+
+func TestPreviewRefused(t *testing.T) {
+	testWiki(t)
+	for name, content := range map[string]string{
+		"notes.txt":  "notes",
+		"binary.txt": "text\x00with a NUL",
+		"tool.exe":   "MZ",
+	} {
+		if w := postFile("Docs", name, content); w.Code != http.StatusOK {
+			t.Fatal(w.Body)
+		}
+	}
+	for _, title := range []string{"Gone", "Private"} {
+		if w := postFile(title, "notes.txt", "notes"); w.Code != http.StatusOK {
+			t.Fatal(w.Body)
+		}
+	}
+	bury("Gone", "notes.txt")
+	t.Cleanup(func() { unbury("Gone", "notes.txt") })
+	if w := postForm(testSave, "/save/Private", url.Values{"body": {"hidden"}, "password": {"hunter2"}}); w.Code != http.StatusFound {
+		t.Fatalf("protecting the page: %d %s", w.Code, w.Body)
+	}
+	ciphertext := base64.StdEncoding.EncodeToString(make([]byte, gcmOverhead+10))
+	if w := postForm(testSave, "/save/Secret", url.Values{"body": {ciphertext}, "meta": {"1"}, "encrypted": {"1"}}); w.Code != http.StatusFound {
+		t.Fatalf("saving the encrypted page: %d %s", w.Code, w.Body)
+	}
+	if w := postFile("Secret", "notes.txt", string(make([]byte, gcmOverhead+10))); w.Code != http.StatusOK {
+		t.Fatal(w.Body)
+	}
+
+	for path, want := range map[string]int{
+		"/preview/Docs/notes.txt":    http.StatusOK,
+		"/preview/Docs/missing.txt":  http.StatusNotFound,
+		"/preview/Docs/.notes.txt":   http.StatusNotFound,
+		"/preview/Docs":              http.StatusNotFound,
+		"/preview/Docs/binary.txt":   http.StatusUnsupportedMediaType,
+		"/preview/Docs/tool.exe":     http.StatusUnsupportedMediaType,
+		"/preview/Secret/notes.txt":  http.StatusUnsupportedMediaType,
+		"/preview/Gone/notes.txt":    http.StatusGone,
+		"/preview/Private/notes.txt": http.StatusForbidden,
+	} {
+		if w := getPreview(path); w.Code != want {
+			t.Errorf("GET %s: %d, want %d", path, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Attachments are served from the wiki's own origin, so a stored HTML or
+// SVG file opened in the browser could run script as the wiki. Each
+// attachment's type is recorded when it is uploaded and every response
+// carries that type, X-Content-Type-Options: nosniff and a restrictive
+// Content-Security-Policy. Only images, audio, video, PDFs and plain text
+// are shown inline; everything else, including all active content, is sent
+// as a download.
+
+// extraContentTypes covers common extensions missing from Go's built-in
+// table when the system has no mime.types file (as in the Alpine image)
+var extraContentTypes = map[string]string{
+	".txt":  "text/plain; charset=utf-8",
+	".log":  "text/plain; charset=utf-8",
+	".md":   "text/markdown; charset=utf-8",
+	".csv":  "text/csv; charset=utf-8",
+	".yaml": "text/yaml; charset=utf-8",
+	".yml":  "text/yaml; charset=utf-8",
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".wav":  "audio/wav",
+	".ogg":  "audio/ogg",
+	".zip":  "application/zip",
+	".bmp":  "image/bmp",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".heic": "image/heic",
+}
+
+// activeContentTypes can run script when rendered by a browser
+var activeContentTypes = map[string]bool{
+	"text/html":                     true,
+	"application/xhtml+xml":         true,
+	"image/svg+xml":                 true,
+	"text/xml":                      true,
+	"application/xml":               true,
+	"text/javascript":               true,
+	"application/javascript":        true,
+	"application/x-shockwave-flash": true,
+}
+
+// attachmentContentType works out the type of an attachment from its name,
+// falling back to its first bytes when the extension is unknown. Content
+// that sniffs as HTML is kept as HTML so it is never shown inline.
+func attachmentContentType(name string, head []byte) string {
+	sniffed := http.DetectContentType(head)
+	ext := strings.ToLower(filepath.Ext(name))
+	ct := extraContentTypes[ext]
+	if ct == "" {
+		ct = mime.TypeByExtension(ext)
+	}
+	if ct == "" || isActiveContent(sniffed) {
+		return sniffed
+	}
+	return ct
+}
+
+// detectAttachment describes the attachment stored at path
+func detectAttachment(path string) (AttachmentMeta, error) {
+	f, err := openStored(path)
+	if err != nil {
+		return AttachmentMeta{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return AttachmentMeta{}, err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return AttachmentMeta{}, err
+	}
+	hash := sha256.New()
+	hash.Write(head[:n])
+	if _, err := io.Copy(hash, f); err != nil {
+		return AttachmentMeta{}, err
+	}
+	return AttachmentMeta{
+		ContentType: attachmentContentType(filepath.Base(path), head[:n]),
+		Size:        info.Size(),
+		Uploaded:    time.Now(),
+		SHA256:      hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// Checksum is the recorded SHA-256 of an attachment, for the view
+func (p *Page) Checksum(name string) string {
+	if digest := p.Meta.Attachments[name].SHA256; len(digest) == 2*sha256.Size {
+		return digest
+	}
+	return ""
+}
+
+// fileSHA256 is the hex SHA-256 digest of the file at path
+func fileSHA256(path string) (string, error) {
+	f, err := openStored(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// setIntegrityHeaders sends an attachment's recorded digest as its ETag and
+// as a Digest header (RFC 3230), so clients can check what they received
+func setIntegrityHeaders(w http.ResponseWriter, digest string) {
+	sum, err := hex.DecodeString(digest)
+	if err != nil || len(sum) != sha256.Size {
+		return
+	}
+	w.Header().Set("ETag", `"`+digest+`"`)
+	w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+}
+
+// mediaType is the type of a Content-Type value without its parameters
+func mediaType(ct string) string {
+	t, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(strings.Split(ct, ";")[0]))
+	}
+	return t
+}
+
+func isActiveContent(ct string) bool {
+	return activeContentTypes[mediaType(ct)]
+}
+
+// isInlineContent reports whether a type is safe to show in the browser
+func isInlineContent(ct string) bool {
+	t := mediaType(ct)
+	switch {
+	case isActiveContent(t):
+		return false
+	case strings.HasPrefix(t, "image/"), strings.HasPrefix(t, "video/"), strings.HasPrefix(t, "audio/"):
+		return true
+	case t == "application/pdf", strings.HasPrefix(t, "text/"):
+		return true
+	}
+	return false
+}
+
+// setAttachmentHeaders sets the type, disposition and security headers of
+// an attachment response
+func setAttachmentHeaders(w http.ResponseWriter, name, ct string) {
+	h := w.Header()
+	h.Set("X-Content-Type-Options", "nosniff")
+	if mediaType(ct) == "application/pdf" {
+		// Browser PDF viewers don't run in a sandbox
+		h.Set("Content-Security-Policy", "default-src 'none'; object-src 'self'; img-src 'self' data:; style-src 'unsafe-inline'")
+	} else {
+		h.Set("Content-Security-Policy", "default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'; sandbox")
+	}
+
+	disposition := "attachment"
+	if isInlineContent(ct) {
+		disposition = "inline"
+		// Text of any kind is shown as plain text
+		if strings.HasPrefix(mediaType(ct), "text/") {
+			ct = "text/plain; charset=utf-8"
+		}
+	}
+	h.Set("Content-Type", ct)
+	h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+}
+
+// serveAttachment serves the file at rel below filesDir
+func serveAttachment(w http.ResponseWriter, r *http.Request, rel string) {
+	// Only a page's own spelling of its directory is served. Another one
+	// reaches the same files on a case-insensitive filesystem, but would
+	// get past the page's password and expiry.
+	title, ok := decodeTitle(path.Dir(rel))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if attachmentGone(title, path.Base(rel)) {
+		goneError(w)
+		return
+	}
+	if pageLocked(r, title) {
+		lockedError(w, r, title)
+		return
+	}
+	full := filepath.Join(pageFilesDir(title), path.Base(rel))
+	f, err := openStored(full)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := path.Base(rel)
+	var attachment AttachmentMeta
+	unlock := pageLocks.RLock(title)
+	if p, err := loadPage(title); err == nil {
+		attachment = p.Meta.Attachments[name]
+		// Share links have already asked for no-store
+		if p.Meta.Protected() && w.Header().Get("Cache-Control") == "" {
+			w.Header().Set("Cache-Control", "private")
+		}
+	}
+	unlock()
+	// A digest recorded for other contents, such as a file replaced outside
+	// the wiki, would only make clients reject a good download
+	if attachment.SHA256 != "" && attachment.Size == info.Size() {
+		setIntegrityHeaders(w, attachment.SHA256)
+	}
+	ct := attachment.ContentType
+	if ct == "" {
+		// Uploaded before types were recorded
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(f, head)
+		ct = attachmentContentType(name, head[:n])
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	setAttachmentHeaders(w, name, ct)
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAttachmentContentType(t *testing.T) {
+	for _, tt := range []struct{ name, head, want string }{
+		{"notes.txt", "hello", "text/plain; charset=utf-8"},
+		{"data.csv", "a,b", "text/csv; charset=utf-8"},
+		{"clip.mp4", "", "video/mp4"},
+		{"page.html", "<p>hi</p>", "text/html; charset=utf-8"},
+		{"logo.svg", "<svg/>", "image/svg+xml"},
+		// Unknown extensions are sniffed
+		{"blob", "%PDF-1.4", "application/pdf"},
+		// HTML stays HTML whatever its name says
+		{"notes.txt", "<html><script>alert(1)</script>", "text/html; charset=utf-8"},
+		{"photo.jpg", "<!DOCTYPE html>", "text/html; charset=utf-8"},
+	} {
+		if got := attachmentContentType(tt.name, []byte(tt.head)); got != tt.want {
+			t.Errorf("attachmentContentType(%q, %q) = %q, want %q", tt.name, tt.head, got, tt.want)
+		}
+	}
+}
+
+func TestInlineContent(t *testing.T) {
+	for ct, want := range map[string]bool{
+		"image/png":                true,
+		"video/mp4":                true,
+		"audio/mpeg":               true,
+		"application/pdf":          true,
+		"text/csv; charset=utf-8":  true,
+		"image/svg+xml":            false,
+		"text/html; charset=utf-8": false,
+		"TEXT/HTML":                false,
+		"application/xhtml+xml":    false,
+		"text/javascript":          false,
+		"application/octet-stream": false,
+		"application/zip":          false,
+		"text/xml; charset=utf-8":  false,
+	} {
+		if got := isInlineContent(ct); got != want {
+			t.Errorf("isInlineContent(%q) = %v", ct, got)
+		}
+	}
+}
+
+// getFile requests /files/{title}/{file}
+func getFile(title, file string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/files/"+encodeTitle(title)+"/"+file, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	filesHandler(w, r)
+	return w
+}
+
+func TestServeAttachment(t *testing.T) {
+	testWiki(t)
+	files := map[string]string{
+		"notes.txt":  "plain notes",
+		"data.csv":   "a,b\n1,2\n",
+		"report.pdf": "%PDF-1.4 report",
+		"page.html":  "<html><script>alert(1)</script></html>",
+		"logo.svg":   `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`,
+		"fake.txt":   "<html><script>alert(1)</script></html>",
+		"tool.exe":   "MZ binary",
+	}
+	for name, content := range files {
+		if w := postFile("Docs", name, content); w.Code != http.StatusOK {
+			t.Fatalf("uploading %s: %d %s", name, w.Code, w.Body)
+		}
+	}
+
+	for name, want := range map[string]struct{ ct, disposition string }{
+		"notes.txt":  {"text/plain; charset=utf-8", "inline"},
+		"data.csv":   {"text/plain; charset=utf-8", "inline"},
+		"report.pdf": {"application/pdf", "inline"},
+		"page.html":  {"text/html; charset=utf-8", "attachment"},
+		"logo.svg":   {"image/svg+xml", "attachment"},
+		"fake.txt":   {"text/html; charset=utf-8", "attachment"},
+		"tool.exe":   {"", "attachment"},
+	} {
+		w := getFile("Docs", name)
+		h := w.Header()
+		if w.Code != http.StatusOK || w.Body.String() != files[name] {
+			t.Errorf("GET %s: %d %q", name, w.Code, w.Body)
+			continue
+		}
+		if want.ct != "" && h.Get("Content-Type") != want.ct {
+			t.Errorf("%s served as %q, want %q", name, h.Get("Content-Type"), want.ct)
+		}
+		if !strings.HasPrefix(h.Get("Content-Disposition"), want.disposition+";") || !strings.Contains(h.Get("Content-Disposition"), name) {
+			t.Errorf("%s disposition %q, want %s", name, h.Get("Content-Disposition"), want.disposition)
+		}
+		if h.Get("X-Content-Type-Options") != "nosniff" || !strings.HasPrefix(h.Get("Content-Security-Policy"), "default-src 'none'") {
+			t.Errorf("%s security headers: %v", name, h)
+		}
+		if name != "report.pdf" && !strings.HasSuffix(h.Get("Content-Security-Policy"), "; sandbox") {
+			t.Errorf("%s isn't sandboxed: %q", name, h.Get("Content-Security-Policy"))
+		}
+
+		sum := sha256.Sum256([]byte(files[name]))
+		if h.Get("ETag") != `"`+hex.EncodeToString(sum[:])+`"` || h.Get("Digest") != "sha-256="+base64.StdEncoding.EncodeToString(sum[:]) {
+			t.Errorf("%s integrity headers: ETag %s, Digest %s", name, h.Get("ETag"), h.Get("Digest"))
+		}
+		if w := getFile("Docs", name, "If-None-Match", h.Get("ETag")); w.Code != http.StatusNotModified {
+			t.Errorf("conditional GET of %s: %d", name, w.Code)
+		}
+	}
+
+	if w := getFile("Docs", "notes.txt", "Range", "bytes=6-"); w.Code != http.StatusPartialContent || w.Body.String() != "notes" {
+		t.Errorf("range of notes.txt: %d %q", w.Code, w.Body)
+	}
+}
+
+// TestServeUnrecordedAttachment checks attachments whose recorded type and
+// digest are missing or out of date
+func TestServeUnrecordedAttachment(t *testing.T) {
+	testWiki(t)
+	if w := postFile("Docs", "notes.txt", "recorded"); w.Code != http.StatusOK {
+		t.Fatal(w.Body)
+	}
+	dir := pageFilesDir("Docs")
+	// Replaced outside the wiki
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("changed outside"), 0644)
+	// Copied in without being recorded
+	os.WriteFile(filepath.Join(dir, "legacy"), []byte("<html><body>old</body></html>"), 0644)
+
+	w := getFile("Docs", "notes.txt")
+	if w.Body.String() != "changed outside" || w.Header().Get("ETag") != "" || w.Header().Get("Digest") != "" {
+		t.Errorf("stale digest: %q, ETag %q", w.Body, w.Header().Get("ETag"))
+	}
+	w = getFile("Docs", "legacy")
+	if w.Body.String() != "<html><body>old</body></html>" || !strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment") ||
+		w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("unrecorded attachment: %q %v", w.Body, w.Header())
+	}
+}
+
+func TestServeAttachmentRefused(t *testing.T) {
+	testWiki(t)
+	for _, title := range []string{"Docs", "Gone", "Private"} {
+		if w := postFile(title, "a.txt", "contents"); w.Code != http.StatusOK {
+			t.Fatal(w.Body)
+		}
+	}
+	bury("Gone", "a.txt")
+	t.Cleanup(func() { unbury("Gone", "a.txt") })
+	if w := postForm(testSave, "/save/Private", url.Values{"body": {"hidden"}, "password": {"hunter2"}}); w.Code != http.StatusFound {
+		t.Fatalf("protecting the page: %d %s", w.Code, w.Body)
+	}
+	os.Mkdir(filepath.Join(pageFilesDir("Docs"), "dir"), 0755)
+
+	for path, want := range map[string]int{
+		"/files/" + encodeTitle("Docs") + "/missing.txt": http.StatusNotFound,
+		"/files/" + encodeTitle("Docs") + "/dir":         http.StatusNotFound,
+		"/files/" + encodeTitle("Docs") + "/.a.txt":      http.StatusNotFound,
+		"/files/" + encodeTitle("Docs") + "//a.txt":      http.StatusNotFound,
+		"/files/Docs/a.txt":                              http.StatusNotFound,
+		"/files/" + encodeTitle("Gone") + "/a.txt":       http.StatusGone,
+		"/files/" + encodeTitle("Private") + "/a.txt":    http.StatusForbidden,
+		"/files/" + encodeTitle("Docs") + "/a.txt":       http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		filesHandler(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Errorf("GET %s: %d, want %d", path, w.Code, want)
+		}
+		if w.Code != http.StatusOK && strings.Contains(w.Body.String(), "contents") {
+			t.Errorf("GET %s answered with the file", path)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Share links give read-only access to one page (with its attachments) or
+// to one attachment, for handing something to people outside the wiki's
+// users. A link is ?share=<id>.<signature> on the /view/, /raw/ or /files/
+// URL, where the signature is an HMAC over the page, file, id and expiry
+// made with a key kept in persistentDir. The link itself is recorded in the
+// page's metadata, which is what lets it be counted, limited and revoked.
+// Links are made and revoked from the edit page through /api/share.
+
+// shareKeyFile holds the HMAC key; it is created on first use
+var shareKeyFile = envString("WIKI_SHARE_KEY_FILE", "")
+
+var (
+	errShareInvalid = errors.New("Invalid share link")
+	errShareEnded   = errors.New("This share link has expired, been used up or been revoked")
+)
+
+// ShareLink is one share link of a page, kept in its metadata
+type ShareLink struct {
+	ID      string    `json:"id"`
+	File    string    `json:"file,omitempty"` // "" shares the page and its attachments
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	MaxUses int64     `json:"max_uses,omitempty"` // 0 for no limit
+	Uses    int64     `json:"uses"`
+	Revoked bool      `json:"revoked,omitempty"`
+}
+
+// Active reports whether the link still gives access
+func (s ShareLink) Active() bool {
+	return !s.Revoked && !expired(s.Expires) && (s.MaxUses == 0 || s.Uses < s.MaxUses)
+}
+
+// Status describes the link for the edit page
+func (s ShareLink) Status() string {
+	switch {
+	case s.Revoked:
+		return "revoked"
+	case expired(s.Expires):
+		return "expired"
+	case !s.Active():
+		return "used up"
+	}
+	return "expires in " + remaining(s.Expires)
+}
+
+// shareKey loads the HMAC key, creating it the first time
+var shareKey = sync.OnceValues(func() ([]byte, error) {
+	keyPath := shareKeyFile
+	if keyPath == "" {
+		keyPath = filepath.Join(persistentDir, ".share-key")
+	}
+	if key, err := os.ReadFile(keyPath); err == nil && len(key) >= 32 {
+		return key, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, key, 0600); err != nil {
+		return nil, err
+	}
+	log.Printf("Created share link key %s", keyPath)
+	return key, nil
+})
+
+// shareSignature signs what a link grants
+func shareSignature(key []byte, title string, s ShareLink) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\x00%s\x00%s\x00%d", title, s.File, s.ID, s.Expires.Unix())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// ShareURL is the link for s, relative to the wiki's address
+func (p *Page) ShareURL(s ShareLink) string {
+	key, err := shareKey()
+	if err != nil {
+		return ""
+	}
+	token := s.ID + "." + shareSignature(key, p.Title, s)
+	if s.File != "" {
+		return "/files/" + p.FilesPath() + "/" + url.PathEscape(s.File) + "?share=" + token
+	}
+	return "/view/" + p.Title + "?share=" + token
+}
+
+type shareContextKey struct{}
+
+// sharedLink returns the share link a request was let in with, if any
+func sharedLink(r *http.Request) (ShareLink, bool) {
+	s, ok := r.Context().Value(shareContextKey{}).(ShareLink)
+	return s, ok
+}
+
+// checkShare is the middleware in front of /view/, /raw/ and /files/.
+// Requests without ?share= pass straight through. The rest must carry a
+// live link for what they ask for; they are counted and marked with
+// sharedLink for the handlers behind.
+func checkShare(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("share")
+		if token == "" {
+			next(w, r)
+			return
+		}
+		// Keep the token out of caches and other sites' logs
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+
+		title, file, ok := shareTarget(r.URL.Path)
+		if !ok {
+			http.Error(w, errShareInvalid.Error(), http.StatusForbidden)
+			return
+		}
+		// Read-only: the only POST is confirming a burn-after-reading page
+		if r.Method != "GET" && r.Method != "HEAD" && !(r.Method == "POST" && file == "") {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s, err := useShare(title, file, token, r)
+		switch {
+		case errors.Is(err, errShareInvalid):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, errShareEnded):
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), shareContextKey{}, s)))
+	}
+}
+
+// shareTarget finds the page and attachment a /view/, /raw/ or /files/ URL
+// asks for. The file is "" for the page itself and for its zip archive.
+func shareTarget(urlPath string) (title, file string, ok bool) {
+	if m := validPath.FindStringSubmatch(urlPath); m != nil && (m[1] == "view" || m[1] == "raw") {
+		title, err := normalizeTitle(m[2])
+		return title, "", err == nil
+	}
+	rel, ok := strings.CutPrefix(urlPath, "/files/")
+	if !ok {
+		return "", "", false
+	}
+	if base, isZip := strings.CutSuffix(rel, ".zip"); isZip && !strings.Contains(rel, "/") {
+		title, ok := zipTitle(base)
+		return title, "", ok
+	}
+	title, ok = decodeTitle(path.Dir(rel))
+	return title, path.Base(rel), ok
+}
+
+// useShare checks token against the links of title and counts the use.
+// Attachments fetched under a page link, HEAD requests, later parts of
+// ranged downloads and the confirmation step of burn-after-reading pages
+// don't count.
+func useShare(title, file, token string, r *http.Request) (ShareLink, error) {
+	id, sig, _ := strings.Cut(token, ".")
+	key, err := shareKey()
+	if err != nil {
+		return ShareLink{}, err
+	}
+
+	unlock := pageLocks.Lock(title)
+	defer unlock()
+	p, err := loadPage(title)
+	if err != nil {
+		return ShareLink{}, errShareInvalid
+	}
+	i := slices.IndexFunc(p.Meta.Shares, func(s ShareLink) bool { return s.ID == id })
+	if i < 0 {
+		return ShareLink{}, errShareInvalid
+	}
+	s := p.Meta.Shares[i]
+	if !hmac.Equal([]byte(sig), []byte(shareSignature(key, title, s))) || (s.File != "" && s.File != file) {
+		return ShareLink{}, errShareInvalid
+	}
+	if !s.Active() {
+		return ShareLink{}, errShareEnded
+	}
+
+	counts := r.Method != "HEAD" && (s.File != "" || file == "")
+	if rng := r.Header.Get("Range"); rng != "" && !strings.HasPrefix(rng, "bytes=0-") {
+		counts = false
+	}
+	if p.Meta.BurnAfterReading && file == "" && r.Method != "POST" {
+		counts = false
+	}
+	if counts {
+		s.Uses++
+		p.Meta.Shares[i] = s
+		if err := commitShares(p); err != nil {
+			return ShareLink{}, err
+		}
+	}
+	return s, nil
+}
+
+// commitShares saves a change to the share links of p. It isn't an edit,
+// so the page keeps its timestamps, and it is backed up at once so a
+// restore can't bring back a revoked or used-up link.
+func commitShares(p *Page) error {
+	if err := commitPage(p); err != nil {
+		return err
+	}
+	cache.put(p)
+	if err := backupPage(p.Title); err != nil {
+		log.Printf("Error backing up share links of %s: %v", p.Title, err)
+	}
+	return nil
+}
+
+// apiShareHandler serves POST /api/share. With action=create it makes a
+// link to the page given by title, or to its attachment file, that lasts
+// for expires_in (a day by default) and optionally max_uses uses; with
+// action=revoke it ends the link id. It answers with the link as JSON, or
+// with return=edit redirects back to the page's editor.
+func apiShareHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	title, err := normalizeTitle(r.FormValue("title"))
+	if err != nil {
+		http.Error(w, "Invalid title parameter", http.StatusBadRequest)
+		return
+	}
+	if pageLocked(r, title) {
+		lockedError(w, r, title)
+		return
+	}
+
+	unlock := pageLocks.Lock(title)
+	defer unlock()
+	p, err := loadPage(title)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var s ShareLink
+	switch r.FormValue("action") {
+	case "create":
+		if s, err = newShareLink(p, r); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errNoAttachment) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		// Links that ended a while ago are only clutter
+		p.Meta.Shares = slices.DeleteFunc(p.Meta.Shares, func(s ShareLink) bool {
+			return time.Since(s.Expires) > tombstoneTTL
+		})
+		p.Meta.Shares = append(p.Meta.Shares, s)
+	case "revoke":
+		i := slices.IndexFunc(p.Meta.Shares, func(s ShareLink) bool { return s.ID == r.FormValue("id") })
+		if i < 0 {
+			http.Error(w, "No such share link", http.StatusNotFound)
+			return
+		}
+		p.Meta.Shares[i].Revoked = true
+		s = p.Meta.Shares[i]
+	default:
+		http.Error(w, "Unknown action; use create or revoke", http.StatusBadRequest)
+		return
+	}
+	if err := commitShares(p); err != nil {
+		http.Error(w, "Error saving share link: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.FormValue("return") == "edit" {
+		http.Redirect(w, r, "/edit/"+title, http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ShareLink
+		URL string `json:"url"`
+	}{s, p.ShareURL(s)})
+}
+
+// newShareLink reads the create form of apiShareHandler
+func newShareLink(p *Page, r *http.Request) (ShareLink, error) {
+	s := ShareLink{Created: time.Now(), File: r.FormValue("file")}
+	if s.File != "" && !slices.Contains(p.Files, s.File) {
+		return s, errNoAttachment
+	}
+	lifetime := r.FormValue("expires_in")
+	if lifetime == "" {
+		lifetime = "1d"
+	}
+	d, err := parseLifetime(lifetime)
+	if err != nil {
+		return s, err
+	}
+	s.Expires = s.Created.Add(d).Truncate(time.Second)
+	if v := r.FormValue("max_uses"); v != "" {
+		if s.MaxUses, err = strconv.ParseInt(v, 10, 64); err != nil || s.MaxUses < 0 {
+			return s, errors.New("Invalid max_uses value")
+		}
+	}
+	id := make([]byte, 9)
+	rand.Read(id)
+	s.ID = base64.RawURLEncoding.EncodeToString(id)
+	return s, nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareSignature(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	expires := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	link := ShareLink{ID: "abc", File: "a.txt", Expires: expires}
+	sig := shareSignature(key, "Page", link)
+	if sig != shareSignature(key, "Page", link) {
+		t.Fatal("the signature isn't stable")
+	}
+	for what, other := range map[string]string{
+		"another page":   shareSignature(key, "Other", link),
+		"another file":   shareSignature(key, "Page", ShareLink{ID: "abc", File: "b.txt", Expires: expires}),
+		"the whole page": shareSignature(key, "Page", ShareLink{ID: "abc", Expires: expires}),
+		"another id":     shareSignature(key, "Page", ShareLink{ID: "abd", File: "a.txt", Expires: expires}),
+		"a later expiry": shareSignature(key, "Page", ShareLink{ID: "abc", File: "a.txt", Expires: expires.Add(time.Second)}),
+		"another key":    shareSignature([]byte("another key, just as long as one"), "Page", link),
+		// The fields are separated, so they can't be shifted between
+		"a shifted file": shareSignature(key, "Page\x00a.txt", ShareLink{ID: "abc", Expires: expires}),
+	} {
+		if other == sig {
+			t.Errorf("the signature for %s is the same", what)
+		}
+	}
+}
+
+func TestShareLinkActive(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	for _, tt := range []struct {
+		link   ShareLink
+		active bool
+		status string
+	}{
+		{ShareLink{Expires: later}, true, "expires in 59m"},
+		{ShareLink{Expires: later, MaxUses: 2, Uses: 1}, true, "expires in 59m"},
+		{ShareLink{Expires: later, MaxUses: 2, Uses: 2}, false, "used up"},
+		{ShareLink{Expires: later, Revoked: true}, false, "revoked"},
+		{ShareLink{Expires: time.Now().Add(-time.Second)}, false, "expired"},
+	} {
+		if tt.link.Active() != tt.active || tt.link.Status() != tt.status {
+			t.Errorf("%+v: active %v, %q; want %v, %q", tt.link, tt.link.Active(), tt.link.Status(), tt.active, tt.status)
+		}
+	}
+}
+
+// shareMux routes the handlers share links reach, as main does
+func shareMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/view/", checkShare(makeHandler(viewHandler)))
+	mux.HandleFunc("/raw/", checkShare(makeHandler(rawHandler)))
+	mux.HandleFunc("/files/", checkShare(filesHandler))
+	mux.HandleFunc("/api/share", apiShareHandler)
+	return mux
+}
+
+// shareResponse is what /api/share answers with
+type shareResponse struct {
+	ShareLink
+	URL string `json:"url"`
+}
+
+// createShare makes a link through /api/share
+func createShare(t *testing.T, form url.Values) shareResponse {
+	t.Helper()
+	form.Set("action", "create")
+	w := postForm(apiShareHandler, "/api/share", form)
+	if w.Code != http.StatusOK {
+		t.Fatalf("creating a share link with %v: %d %s", form, w.Code, w.Body)
+	}
+	var s shareResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// shareUses is the recorded use count of link id of title
+func shareUses(t *testing.T, title, id string) int64 {
+	t.Helper()
+	cache.purge()
+	p, err := loadPage(title)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range p.Meta.Shares {
+		if s.ID == id {
+			return s.Uses
+		}
+	}
+	t.Fatalf("%s has no share link %s", title, id)
+	return 0
+}
+
+func TestSharePage(t *testing.T) {
+	testWiki(t)
+	mux := shareMux()
+	get := func(method, target string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	if w := postFile("Shared", "a.txt", "attached"); w.Code != http.StatusOK {
+		t.Fatal(w.Body)
+	}
+	postForm(testSave, "/save/Shared", url.Values{"body": {"shared text"}})
+	s := createShare(t, url.Values{"title": {"Shared"}, "max_uses": {"2"}, "expires_in": {"1h"}})
+	if !strings.HasPrefix(s.URL, "/view/Shared?share="+s.ID+".") || s.MaxUses != 2 || time.Until(s.Expires) > time.Hour {
+		t.Fatalf("share link: %+v", s)
+	}
+	// A password set later doesn't shut the link out
+	if w := postForm(testSave, "/save/Shared", url.Values{"body": {"shared text"}, "password": {"hunter2"}}); w.Code != http.StatusFound {
+		t.Fatal(w.Body)
+	}
+	if w := get("GET", "/view/Shared"); w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), "/unlock/") {
+		t.Fatalf("view without the link: %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	w := get("GET", s.URL)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "shared text") {
+		t.Fatalf("view with the link: %d %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" || w.Header().Get("Referrer-Policy") != "no-referrer" {
+		t.Errorf("headers: %v", w.Header())
+	}
+	token := strings.TrimPrefix(s.URL, "/view/Shared?share=")
+	// Attachments of a shared page and HEAD requests come with it
+	if w := get("GET", "/files/"+encodeTitle("Shared")+"/a.txt?share="+token); w.Code != http.StatusOK || w.Body.String() != "attached" {
+		t.Errorf("attachment with the page's link: %d %q", w.Code, w.Body)
+	}
+	get("HEAD", s.URL)
+	if uses := shareUses(t, "Shared", s.ID); uses != 1 {
+		t.Errorf("%d uses after one view", uses)
+	}
+	if w := get("GET", "/raw/Shared?share="+token); w.Body.String() != "shared text" {
+		t.Errorf("raw with the link: %d %q", w.Code, w.Body)
+	}
+	if w := get("GET", s.URL); w.Code != http.StatusGone {
+		t.Errorf("view after the last use: %d", w.Code)
+	}
+
+	// Links are read-only
+	for _, method := range []string{"PUT", "DELETE"} {
+		if w := get(method, s.URL); w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s with the link: %d", method, w.Code)
+		}
+	}
+}
+
+func TestShareAttachment(t *testing.T) {
+	testWiki(t)
+	mux := shareMux()
+	get := func(method, target string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	for _, file := range []string{"a.txt", "b.txt"} {
+		if w := postFile("Files", file, "contents of "+file); w.Code != http.StatusOK {
+			t.Fatal(w.Body)
+		}
+	}
+	s := createShare(t, url.Values{"title": {"Files"}, "file": {"a.txt"}})
+	if !strings.HasPrefix(s.URL, "/files/"+encodeTitle("Files")+"/a.txt?share=") || time.Until(s.Expires) < 23*time.Hour {
+		t.Fatalf("share link: %+v", s)
+	}
+	token := s.URL[strings.Index(s.URL, "=")+1:]
+
+	if w := get("GET", s.URL); w.Code != http.StatusOK || w.Body.String() != "contents of a.txt" {
+		t.Fatalf("attachment with its link: %d %q", w.Code, w.Body)
+	}
+	// Later parts of a download don't count
+	get("GET", s.URL, "Range", "bytes=5-")
+	if w := get("GET", s.URL, "Range", "bytes=0-3"); w.Body.String() != "cont" {
+		t.Errorf("range: %q", w.Body)
+	}
+	if uses := shareUses(t, "Files", s.ID); uses != 2 {
+		t.Errorf("%d uses, want 2", uses)
+	}
+
+	for target, want := range map[string]int{
+		"/files/" + encodeTitle("Files") + "/b.txt?share=" + token: http.StatusForbidden,
+		"/view/Files?share=" + token:                               http.StatusForbidden,
+		"/files/" + encodeTitle("Files") + ".zip?share=" + token:   http.StatusForbidden,
+	} {
+		if w := get("GET", target); w.Code != want || strings.Contains(w.Body.String(), "contents") {
+			t.Errorf("GET %s: %d, want %d", target, w.Code, want)
+		}
+	}
+	if w := get("POST", s.URL); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST of an attachment link: %d", w.Code)
+	}
+}
+
+func TestShareLinkRefused(t *testing.T) {
+	testWiki(t)
+	mux := shareMux()
+	get := func(target string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w.Code
+	}
+	postForm(testSave, "/save/Shared", url.Values{"body": {"shared text"}})
+	postForm(testSave, "/save/Other", url.Values{"body": {"other text"}})
+	s := createShare(t, url.Values{"title": {"Shared"}})
+	token := strings.TrimPrefix(s.URL, "/view/Shared?share=")
+	id, sig, _ := strings.Cut(token, ".")
+	tampered := []byte(sig)
+	tampered[0] ^= 1
+	if tampered[0] == '.' || tampered[0] == '&' {
+		tampered[0] = 'A'
+	}
+
+	for target, want := range map[string]int{
+		"/view/Shared?share=" + id + "." + string(tampered): http.StatusForbidden,
+		"/view/Shared?share=" + id:                          http.StatusForbidden,
+		"/view/Shared?share=nosuchid." + sig:                http.StatusForbidden,
+		"/view/Other?share=" + token:                        http.StatusForbidden,
+		"/view/Missing?share=" + token:                      http.StatusForbidden,
+		"/edit/Shared?share=" + token:                       http.StatusNotFound,
+		"/view/Shared?share=" + token:                       http.StatusOK,
+	} {
+		if code := get(target); code != want {
+			t.Errorf("GET %s: %d, want %d", target, code, want)
+		}
+	}
+
+	// Moving the expiry on invalidates the link
+	cache.purge()
+	p, _ := loadPage("Shared")
+	p.Meta.Shares[0].Expires = p.Meta.Shares[0].Expires.Add(24 * time.Hour)
+	commitShares(p)
+	if code := get(s.URL); code != http.StatusForbidden {
+		t.Errorf("link with a moved expiry: %d", code)
+	}
+
+	// Expired
+	p.Meta.Shares[0].Expires = time.Now().Add(-time.Minute).Truncate(time.Second)
+	commitShares(p)
+	if code := get(p.ShareURL(p.Meta.Shares[0])); code != http.StatusGone {
+		t.Errorf("expired link: %d", code)
+	}
+
+	// Revoked
+	s = createShare(t, url.Values{"title": {"Shared"}})
+	if w := postForm(apiShareHandler, "/api/share", url.Values{"action": {"revoke"}, "title": {"Shared"}, "id": {s.ID}}); w.Code != http.StatusOK {
+		t.Fatalf("revoking: %d %s", w.Code, w.Body)
+	}
+	if code := get(s.URL); code != http.StatusGone {
+		t.Errorf("revoked link: %d", code)
+	}
+}
+
+func TestShareAPIRefused(t *testing.T) {
+	testWiki(t)
+	if w := postFile("Shared", "a.txt", "attached"); w.Code != http.StatusOK {
+		t.Fatal(w.Body)
+	}
+	if w := postForm(testSave, "/save/Private", url.Values{"body": {"hidden"}, "password": {"hunter2"}}); w.Code != http.StatusFound {
+		t.Fatal(w.Body)
+	}
+	for what, tt := range map[string]struct {
+		form url.Values
+		want int
+	}{
+		"unknown action": {url.Values{"title": {"Shared"}, "action": {"share"}}, http.StatusBadRequest},
+		"invalid title":  {url.Values{"title": {"bad//title"}, "action": {"create"}}, http.StatusBadRequest},
+		"missing page":   {url.Values{"title": {"Missing"}, "action": {"create"}}, http.StatusNotFound},
+		"missing file":   {url.Values{"title": {"Shared"}, "action": {"create"}, "file": {"b.txt"}}, http.StatusNotFound},
+		"bad lifetime":   {url.Values{"title": {"Shared"}, "action": {"create"}, "expires_in": {"never"}}, http.StatusBadRequest},
+		"negative uses":  {url.Values{"title": {"Shared"}, "action": {"create"}, "max_uses": {"-1"}}, http.StatusBadRequest},
+		"bad uses":       {url.Values{"title": {"Shared"}, "action": {"create"}, "max_uses": {"many"}}, http.StatusBadRequest},
+		"unknown revoke": {url.Values{"title": {"Shared"}, "action": {"revoke"}, "id": {"nosuchid"}}, http.StatusNotFound},
+		"locked page":    {url.Values{"title": {"Private"}, "action": {"create"}}, http.StatusForbidden},
+	} {
+		if w := postForm(apiShareHandler, "/api/share", tt.form); w.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", what, w.Code, w.Body, tt.want)
+		}
+	}
+	w := httptest.NewRecorder()
+	apiShareHandler(w, httptest.NewRequest("GET", "/api/share?action=create&title=Shared", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: %d", w.Code)
+	}
+	cache.purge()
+	if p, _ := loadPage("Shared"); len(p.Meta.Shares) != 0 {
+		t.Errorf("refused requests left links: %+v", p.Meta.Shares)
+	}
+}
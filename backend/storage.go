@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Writes of page files and of the backup mirror never modify a file in
+// place. Data goes to a temporary file in the same directory, is fsynced and
+// then renamed over the target, so readers and crashes only ever see the old
+// or the new contents.
+//
+// A page is several files (body, .files.txt, .meta.json). To commit them
+// together, Page.save first writes a journal holding the complete new state,
+// then replaces each file, then removes the journal. A journal left behind by
+// a crash is replayed at startup.
+
+// writeFileAtomic replaces path with data
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return writeAtomic(path, perm, func(f *os.File) error {
+		_, err := f.Write(data)
+		return err
+	})
+}
+
+// writeAtomic replaces path with whatever fill writes to the temporary file
+func writeAtomic(path string, perm os.FileMode, fill func(*os.File) error) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	// Clean up the temporary file on any failure before the rename
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmpName)
+		}
+	}()
+
+	if err := fill(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+	committed = true
+	syncDir(dir)
+	return nil
+}
+
+// copyFileAtomic replaces dst with a copy of src
+func copyFileAtomic(src, dst string, perm os.FileMode) error {
+	sourceFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+	return writeAtomic(dst, perm, func(f *os.File) error {
+		_, err := io.Copy(f, sourceFile)
+		return err
+	})
+}
+
+// syncDir flushes a directory so a rename into it survives a crash. Not all
+// platforms support this, so errors are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// pageJournal is the complete new state of a page, written before any of
+// the page's own files are touched
+type pageJournal struct {
+	Title string   `json:"title"`
+	Body  []byte   `json:"body"`
+	Files []string `json:"files"`
+	Meta  PageMeta `json:"meta"`
+}
+
+// commitPage writes all of a page's files as one unit
+func commitPage(p *Page) error {
+	journal := pageJournal{Title: p.Title, Body: p.Body, Files: p.Files, Meta: p.Meta}
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	journalPath := journalFilename(p.Title)
+	if err := writeStoredFile(journalPath, data, 0600); err != nil {
+		return err
+	}
+	if err := journal.apply(); err != nil {
+		// The journal stays behind and is replayed on the next start
+		return err
+	}
+	if err := os.Remove(journalPath); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(journalPath))
+	return nil
+}
+
+// apply writes the page's body, attachment list and metadata
+func (j *pageJournal) apply() error {
+	if err := writeStoredFile(pageFilename(j.Title), j.Body, 0600); err != nil {
+		return err
+	}
+
+	filesList := filesListFilename(j.Title)
+	if len(j.Files) > 0 {
+		if err := writeStoredFile(filesList, []byte(join(j.Files, "\n")), 0600); err != nil {
+			return err
+		}
+	} else if err := os.Remove(filesList); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	meta, err := json.MarshalIndent(j.Meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStoredFile(metaFilename(j.Title), meta, 0600)
+}
+
+// RecoverJournals finishes page saves that were interrupted by a crash. It
+// runs at startup, after restoration from persistent storage, so the newer
+// journaled state wins over the older backup.
+func RecoverJournals() {
+	filepath.WalkDir(".", func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != "." && (reservedNamespaces[path] || !isEncodedSegment(d.Name())) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".journal.json") {
+			return nil
+		}
+
+		data, err := readStored(path)
+		if err != nil {
+			log.Printf("Error reading journal %s: %v", path, err)
+			return nil
+		}
+		var journal pageJournal
+		if err := json.Unmarshal(data, &journal); err != nil || journalFilename(journal.Title) != path {
+			log.Printf("Discarding unreadable journal %s", path)
+			os.Remove(path)
+			return nil
+		}
+		if err := journal.apply(); err != nil {
+			log.Printf("Error replaying journal %s: %v", path, err)
+			return nil
+		}
+		os.Remove(path)
+		log.Printf("Recovered interrupted save of %s", journal.Title)
+		return nil
+	})
+}
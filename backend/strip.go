@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+)
+
+// Uploaded photos often carry GPS coordinates, device details and editing
+// history. Unless disabled with WIKI_STRIP_METADATA=false, or for one upload
+// with the keep_metadata field, images are cleaned on their way to disk:
+//
+//   - JPEG: APP1 (Exif, XMP), APP13 (IPTC) and the other APPn segments
+//     except JFIF, ICC profiles and Adobe colour information, plus comments
+//   - PNG: tEXt, zTXt, iTXt, eXIf and tIME chunks
+//   - WebP: EXIF and XMP chunks
+//
+// The orientation is the one piece of EXIF worth keeping, since without it
+// phone photos come out sideways; it is written back as a minimal EXIF block
+// holding nothing else. HEIC can't be rewritten here and is stored as it is.
+// The format is detected from the content, not the file name, which is
+// kept either way.
+
+var stripUploadMetadata = envBool("WIKI_STRIP_METADATA", true)
+
+// stripMaxBuffer caps WebP files, which are rewritten in memory because the
+// container records its total size up front
+const stripMaxBuffer = 64 << 20
+
+var errStripTooLarge = &uploadLimitError{Limit: "size for removing WebP metadata", Max: stripMaxBuffer}
+
+// withoutMetadata returns a reader of src with image metadata removed.
+// Content that isn't a supported image passes through unchanged. Close the
+// result to stop the conversion early.
+func withoutMetadata(src io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(stripMetadata(pw, src))
+	}()
+	return pr
+}
+
+// stripMetadata copies src to dst, removing metadata from images
+func stripMetadata(dst io.Writer, src io.Reader) error {
+	br := bufio.NewReaderSize(src, 64<<10)
+	head, _ := br.Peek(12)
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return stripJPEG(dst, br)
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return stripPNG(dst, br)
+	case len(head) == 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return stripWebP(dst, br)
+	case len(head) == 12 && string(head[4:8]) == "ftyp" && isHEIFBrand(string(head[8:12])):
+		log.Printf("Storing HEIC upload without removing its metadata")
+	}
+	_, err := io.Copy(dst, br)
+	return err
+}
+
+func isHEIFBrand(brand string) bool {
+	switch brand {
+	case "heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1":
+		return true
+	}
+	return false
+}
+
+// minimalExif is a TIFF-format EXIF block with only an orientation tag
+func minimalExif(orientation int) []byte {
+	return []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // big-endian header, first IFD at 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0, // Orientation, SHORT, 1 value
+		0, 0, 0, 0, // no next IFD
+	}
+}
+
+// stripJPEG copies the segments before the image data, leaving out the
+// metadata ones, then the image data itself
+func stripJPEG(dst io.Writer, src *bufio.Reader) error {
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(src, soi); err != nil {
+		return err
+	}
+	if _, err := dst.Write(soi); err != nil {
+		return err
+	}
+	for {
+		b, err := src.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0xFF {
+			return errors.New("malformed JPEG")
+		}
+		marker, err := src.ReadByte()
+		for err == nil && marker == 0xFF { // fill bytes
+			marker, err = src.ReadByte()
+		}
+		if err != nil {
+			return err
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD9) { // no length follows
+			if _, err := dst.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			if marker == 0xD9 {
+				_, err = io.Copy(dst, src)
+				return err
+			}
+			continue
+		}
+
+		var lengthBytes [2]byte
+		if _, err := io.ReadFull(src, lengthBytes[:]); err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(lengthBytes[:]))
+		if length < 2 {
+			return errors.New("malformed JPEG")
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(src, segment); err != nil {
+			return err
+		}
+
+		if jpegMetadataSegment(marker, segment) {
+			// Put a bare orientation where the Exif block was
+			if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				if o := exifOrientation(segment[6:]); o > 1 {
+					exif := append([]byte("Exif\x00\x00"), minimalExif(o)...)
+					if err := writeJPEGSegment(dst, 0xE1, exif); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		if err := writeJPEGSegment(dst, marker, segment); err != nil {
+			return err
+		}
+		if marker == 0xDA { // start of scan: the rest is image data
+			_, err = io.Copy(dst, src)
+			return err
+		}
+	}
+}
+
+// jpegMetadataSegment reports whether a segment is metadata to remove
+func jpegMetadataSegment(marker byte, segment []byte) bool {
+	switch {
+	case marker == 0xFE: // comment
+		return true
+	case marker == 0xE0:
+		return !bytes.HasPrefix(segment, []byte("JFIF\x00")) && !bytes.HasPrefix(segment, []byte("JFXX\x00"))
+	case marker == 0xE2:
+		return !bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00"))
+	case marker == 0xEE:
+		return !bytes.HasPrefix(segment, []byte("Adobe"))
+	case marker >= 0xE1 && marker <= 0xEF:
+		return true
+	}
+	return false
+}
+
+func writeJPEGSegment(dst io.Writer, marker byte, segment []byte) error {
+	if len(segment)+2 > 0xFFFF {
+		return errors.New("JPEG segment too long")
+	}
+	header := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(segment)+2))
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+	_, err := dst.Write(segment)
+	return err
+}
+
+// pngMetadataChunks are the chunk types removed from PNGs
+var pngMetadataChunks = map[string]bool{"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true}
+
+// stripPNG copies a PNG chunk by chunk, leaving out the metadata chunks
+func stripPNG(dst io.Writer, src *bufio.Reader) error {
+	if _, err := io.CopyN(dst, src, 8); err != nil {
+		return err
+	}
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(src, header[:]); err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:8])
+		if length > 1<<31 {
+			return errors.New("malformed PNG")
+		}
+
+		if pngMetadataChunks[chunkType] {
+			if chunkType == "eXIf" && length <= 1<<20 {
+				data := make([]byte, length)
+				if _, err := io.ReadFull(src, data); err != nil {
+					return err
+				}
+				if o := exifOrientation(data); o > 1 {
+					if err := writePNGChunk(dst, "eXIf", minimalExif(o)); err != nil {
+						return err
+					}
+				}
+				length = 0
+			}
+			if _, err := src.Discard(int(length) + 4); err != nil { // data and CRC
+				return err
+			}
+			continue
+		}
+
+		if _, err := dst.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, src, length+4); err != nil {
+			return err
+		}
+		if chunkType == "IEND" {
+			_, err := io.Copy(dst, src)
+			return err
+		}
+	}
+}
+
+func writePNGChunk(dst io.Writer, chunkType string, data []byte) error {
+	buf := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], chunkType)
+	buf = append(buf, data...)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	_, err := dst.Write(buf)
+	return err
+}
+
+// stripWebP rewrites a WebP without its EXIF and XMP chunks. The VP8X
+// header's flags say which of them are present, so they are updated too.
+func stripWebP(dst io.Writer, src *bufio.Reader) error {
+	data, err := io.ReadAll(io.LimitReader(src, stripMaxBuffer+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > stripMaxBuffer {
+		return errStripTooLarge
+	}
+
+	var chunks [][]byte
+	vp8x := -1
+	orientation := 1
+	for i := 12; i+8 <= len(data); {
+		length := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + length + length%2
+		if length < 0 || i+8+length > len(data) {
+			return fmt.Errorf("malformed WebP")
+		}
+		end = min(end, len(data))
+		switch string(data[i : i+4]) {
+		case "EXIF":
+			orientation = exifOrientation(bytes.TrimPrefix(data[i+8:i+8+length], []byte("Exif\x00\x00")))
+		case "XMP ":
+		case "VP8X":
+			vp8x = len(chunks)
+			fallthrough
+		default:
+			chunks = append(chunks, append([]byte(nil), data[i:end]...))
+		}
+		i = end
+	}
+
+	keepExif := orientation > 1
+	if keepExif {
+		exif := minimalExif(orientation)
+		chunk := binary.LittleEndian.AppendUint32([]byte("EXIF"), uint32(len(exif)))
+		chunks = append(chunks, append(chunk, exif...))
+	}
+	if vp8x >= 0 && len(chunks[vp8x]) > 8 {
+		flags := chunks[vp8x][8] &^ 0x04 // no XMP
+		if keepExif {
+			flags |= 0x08
+		} else {
+			flags &^= 0x08
+		}
+		chunks[vp8x][8] = flags
+	} else if keepExif {
+		// A simple WebP can't carry EXIF without a VP8X header
+		chunks = chunks[:len(chunks)-1]
+	}
+
+	size := 4
+	for _, chunk := range chunks {
+		size += len(chunk)
+	}
+	header := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(size))
+	header = append(header, "WEBP"...)
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if _, err := dst.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
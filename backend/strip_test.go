@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A camera's Exif block: the orientation and the make of the camera, which
+// is short enough to sit in the entry itself
+var cameraExif = []byte{
+	'M', 'M', 0, 42, 0, 0, 0, 8,
+	0, 2,
+	0x01, 0x0F, 0, 2, 0, 0, 0, 4, 'C', 'a', 'm', 0, // Make, ASCII
+	0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 6, 0, 0, // Orientation
+	0, 0, 0, 0,
+}
+
+// jpegSegment encodes one JPEG marker segment
+func jpegSegment(marker byte, data string) string {
+	var buf bytes.Buffer
+	writeJPEGSegment(&buf, marker, []byte(data))
+	return buf.String()
+}
+
+// photoWithMetadata is a JPEG carrying the usual metadata of a phone photo
+func photoWithMetadata() string {
+	photo := testImage("photo.jpg", 30, 20)
+	return photo[:2] +
+		jpegSegment(0xE0, "JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x00\x00") +
+		jpegSegment(0xE1, "Exif\x00\x00"+string(cameraExif)) +
+		jpegSegment(0xE1, "http://ns.adobe.com/xap/1.0/\x00<gps>51.5N</gps>") +
+		jpegSegment(0xE2, "ICC_PROFILE\x00\x01\x01profile") +
+		jpegSegment(0xED, "Photoshop 3.0\x00iptc-caption") +
+		jpegSegment(0xFE, "taken at home") +
+		photo[2:]
+}
+
+// stripped runs stripMetadata over data
+func stripped(t *testing.T, data string) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := stripMetadata(&out, strings.NewReader(data)); err != nil {
+		t.Fatalf("stripping: %v", err)
+	}
+	return out.String()
+}
+
+func TestStripJPEG(t *testing.T) {
+	out := stripped(t, photoWithMetadata())
+	for _, secret := range []string{"Cam\x00", "<gps>", "iptc-caption", "taken at home"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("%q is still in the photo", secret)
+		}
+	}
+	for _, kept := range []string{"JFIF\x00", "ICC_PROFILE\x00\x01\x01profile"} {
+		if !strings.Contains(out, kept) {
+			t.Errorf("%q was removed", kept)
+		}
+	}
+	if exif := jpegExif([]byte(out)); !bytes.Equal(exif, minimalExif(6)) {
+		t.Errorf("Exif left in the photo: %x", exif)
+	}
+	if _, _, err := image.Decode(strings.NewReader(out)); err != nil {
+		t.Errorf("decoding the stripped photo: %v", err)
+	}
+
+	// Without an orientation, no Exif is written back
+	plain := testImage("plain.jpg", 10, 10)
+	upright := plain[:2] + jpegSegment(0xE1, "Exif\x00\x00"+string(minimalExif(1))) + plain[2:]
+	if out := stripped(t, upright); out != plain {
+		t.Errorf("an upright photo kept %d more bytes", len(out)-len(plain))
+	}
+}
+
+// pngWithChunks inserts chunks after a PNG's header chunk
+func pngWithChunks(data string, chunks ...[2]string) string {
+	var extra bytes.Buffer
+	for _, chunk := range chunks {
+		writePNGChunk(&extra, chunk[0], []byte(chunk[1]))
+	}
+	ihdrEnd := 8 + 12 + 13
+	return data[:ihdrEnd] + extra.String() + data[ihdrEnd:]
+}
+
+func TestStripPNG(t *testing.T) {
+	exif := string(minimalExif(3)) + "Cam"
+	in := pngWithChunks(testImage("a.png", 10, 10),
+		[2]string{"tEXt", "Comment\x00secret text"},
+		[2]string{"iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00<gps/>"},
+		[2]string{"tIME", "\x07\xea\x03\x01\x0c\x00\x00"},
+		[2]string{"eXIf", exif},
+		[2]string{"gAMA", "\x00\x00\xb1\x8f"},
+	)
+	out := []byte(stripped(t, in))
+	for _, chunk := range []string{"tEXt", "iTXt", "tIME"} {
+		if pngChunk(out, chunk) != nil {
+			t.Errorf("the %s chunk is still there", chunk)
+		}
+	}
+	if !bytes.Equal(pngChunk(out, "eXIf"), minimalExif(3)) {
+		t.Errorf("eXIf left: %x", pngChunk(out, "eXIf"))
+	}
+	if pngChunk(out, "gAMA") == nil {
+		t.Error("the gAMA chunk was removed")
+	}
+	if _, _, err := image.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("decoding the stripped image: %v", err)
+	}
+}
+
+// webpFile builds a WebP container of the given chunks
+func webpFile(chunks ...[2]string) []byte {
+	var body []byte
+	for _, chunk := range chunks {
+		body = append(body, chunk[0]...)
+		body = binary.LittleEndian.AppendUint32(body, uint32(len(chunk[1])))
+		body = append(body, chunk[1]...)
+		if len(chunk[1])%2 == 1 {
+			body = append(body, 0)
+		}
+	}
+	data := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(4+len(body)))
+	return append(append(data, "WEBP"...), body...)
+}
+
+func TestStripWebP(t *testing.T) {
+	vp8x := "\x0c\x00\x00\x00\x09\x00\x00\x09\x00\x00" // EXIF and XMP flags
+	for orientation, want := range map[int][]byte{
+		1: webpFile([2]string{"VP8X", "\x00" + vp8x[1:]}, [2]string{"VP8L", "pix"}),
+		8: webpFile([2]string{"VP8X", "\x08" + vp8x[1:]}, [2]string{"VP8L", "pix"}, [2]string{"EXIF", string(minimalExif(8))}),
+	} {
+		in := webpFile(
+			[2]string{"VP8X", vp8x},
+			[2]string{"VP8L", "pix"},
+			[2]string{"EXIF", "Exif\x00\x00" + string(minimalExif(orientation)) + "Cam"},
+			[2]string{"XMP ", "<gps/>"},
+		)
+		if out := stripped(t, string(in)); out != string(want) {
+			t.Errorf("orientation %d: stripped to %q, want %q", orientation, out, want)
+		}
+	}
+
+	// A simple WebP has nowhere to keep the orientation
+	in := webpFile([2]string{"VP8L", "pix"}, [2]string{"EXIF", string(minimalExif(6))})
+	if out := stripped(t, string(in)); out != string(webpFile([2]string{"VP8L", "pix"})) {
+		t.Errorf("simple WebP stripped to %q", out)
+	}
+}
+
+func TestStripPassesThrough(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"plain text",
+		"\x00\x00\x00\x18ftypheic\x00\x00\x00\x00 Exif GPS",
+		"\x89PNF not quite",
+	} {
+		if out := stripped(t, data); out != data {
+			t.Errorf("%q came out as %q", data, out)
+		}
+	}
+}
+
+func TestStripRefusesMalformed(t *testing.T) {
+	for what, data := range map[string]string{
+		"truncated JPEG":  "\xFF\xD8\xFF\xE1\x00\x10Exif",
+		"JPEG garbage":    "\xFF\xD8\xFF\xE0\x00\x04ab\x00junk",
+		"bad length JPEG": "\xFF\xD8\xFF\xE0\x00\x01",
+		"overlong PNG":    "\x89PNG\r\n\x1a\n\xff\xff\xff\xffIHDR",
+		"truncated PNG":   "\x89PNG\r\n\x1a\n\x00\x00\x00",
+		"overlong WebP":   "RIFF\x00\x00\x00\x00WEBPVP8L\xff\x00\x00\x00pix",
+	} {
+		r := withoutMetadata(strings.NewReader(data))
+		if _, err := io.ReadAll(r); err == nil {
+			t.Errorf("%s was passed on", what)
+		}
+		r.Close()
+	}
+}
+
+// TestUploadStripsMetadata checks that uploaded photos lose their metadata
+// unless the uploader asks to keep it
+func TestUploadStripsMetadata(t *testing.T) {
+	testWiki(t)
+	photo := photoWithMetadata()
+	upload := func(name, query string, keepField bool) {
+		t.Helper()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		if keepField {
+			mw.WriteField("keep_metadata", "1")
+		}
+		part, _ := mw.CreateFormFile("file", name)
+		part.Write([]byte(photo))
+		mw.Close()
+		r := httptest.NewRequest("POST", "/upload/Photos"+query, &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		testUpload(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("uploading %s: %d %s", name, w.Code, w.Body)
+		}
+	}
+	upload("stripped.jpg", "", false)
+	upload("query.jpg", "?keep_metadata=1", false)
+	upload("field.jpg", "", true)
+	// The content decides, not the name
+	upload("renamed.bin", "", false)
+
+	for file, kept := range map[string]bool{"stripped.jpg": false, "query.jpg": true, "field.jpg": true, "renamed.bin": false} {
+		got := attachmentContent("Photos", file)
+		if (got == photo) != kept || strings.Contains(got, "taken at home") != kept {
+			t.Errorf("%s kept its metadata: %v, want %v", file, got == photo, kept)
+		}
+	}
+
+	saved := stripUploadMetadata
+	stripUploadMetadata = false
+	t.Cleanup(func() { stripUploadMetadata = saved })
+	upload("unstripped.jpg", "", false)
+	if attachmentContent("Photos", "unstripped.jpg") != photo {
+		t.Error("metadata was removed with stripping turned off")
+	}
+	checkConsistent(t, "Photos")
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+)
+
+// Thumbnails of image attachments are made on first request by
+// /thumb/{title}/{file}?size=N and cached in files/.thumbs next to the
+// attachments, as <file>@<size>.jpg (or .png for formats that can be
+// transparent). A cached thumbnail older than its attachment is remade.
+
+var thumbsDir = filepath.Join(filesDir, ".thumbs")
+
+// thumbSizes are the bounding boxes a client may ask for
+var thumbSizes = map[int]bool{128: true, 256: true, 512: true}
+
+const defaultThumbSize = 256
+
+// Images larger than this are not decoded, to keep a crafted file from
+// exhausting memory
+var thumbMaxSource = envInt("WIKI_THUMB_MAX_SOURCE", 50<<20)
+
+const thumbMaxPixels = 50_000_000
+
+// thumbLocks keeps two requests from making the same thumbnail at once
+var thumbLocks = &titleLocks{locks: make(map[string]*titleLock)}
+
+// imageDecoders maps attachment extensions to their decoders
+var imageDecoders = map[string]func(io.Reader) (image.Image, error){
+	".jpg":  jpeg.Decode,
+	".jpeg": jpeg.Decode,
+	".png":  png.Decode,
+	".gif":  gif.Decode,
+	".webp": webp.Decode,
+	".bmp":  bmp.Decode,
+	".tif":  tiff.Decode,
+	".tiff": tiff.Decode,
+}
+
+// imageConfigDecoders reads image dimensions without decoding the pixels
+var imageConfigDecoders = map[string]func(io.Reader) (image.Config, error){
+	".jpg":  jpeg.DecodeConfig,
+	".jpeg": jpeg.DecodeConfig,
+	".png":  png.DecodeConfig,
+	".gif":  gif.DecodeConfig,
+	".webp": webp.DecodeConfig,
+	".bmp":  bmp.DecodeConfig,
+	".tif":  tiff.DecodeConfig,
+	".tiff": tiff.DecodeConfig,
+}
+
+// isThumbnailable reports whether a thumbnail can be made of the attachment
+func isThumbnailable(name string) bool {
+	return imageDecoders[strings.ToLower(filepath.Ext(name))] != nil
+}
+
+// IsImage tells the view which attachments to show in the gallery
+func (p *Page) IsImage(name string) bool {
+	return !p.Meta.Encrypted && isThumbnailable(name)
+}
+
+// thumbPageDir is where the thumbnails of title's attachments are cached
+func thumbPageDir(title string) string {
+	return filepath.Join(thumbsDir, filepath.FromSlash(encodeTitle(title)))
+}
+
+// thumbPath is the cached thumbnail of one attachment at one size
+func thumbPath(title, file string, size int) string {
+	return filepath.Join(thumbPageDir(title), thumbName(file, size))
+}
+
+// thumbName is the file name of a thumbnail of file
+func thumbName(file string, size int) string {
+	ext := ".png"
+	if e := strings.ToLower(filepath.Ext(file)); e == ".jpg" || e == ".jpeg" {
+		ext = ".jpg"
+	}
+	return fmt.Sprintf("%s@%d%s", file, size, ext)
+}
+
+// thumbFile is the attachment the thumbnail called name was made from. The
+// name must be exactly what thumbName gives for one of the sizes, so the
+// thumbnails of a sibling such as "a.png@2.png" don't pass for those of
+// "a.png".
+func thumbFile(name string) (string, bool) {
+	i := strings.LastIndex(name, "@")
+	if i <= 0 {
+		return "", false
+	}
+	for size := range thumbSizes {
+		if name == thumbName(name[:i], size) {
+			return name[:i], true
+		}
+	}
+	return "", false
+}
+
+// removeThumbnails drops the cached thumbnails of file, or of all of the
+// page's attachments when file is empty
+func removeThumbnails(title, file string) {
+	dir := thumbPageDir(title)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if of, ok := thumbFile(entry.Name()); file == "" || (ok && of == file) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+// splitTitleFile splits the path of a /{prefix}/{title}/{file} URL. The file
+// is the last segment, so titles may still contain namespaces.
+func splitTitleFile(urlPath, prefix string) (string, string, bool) {
+	rest := strings.TrimPrefix(urlPath, prefix)
+	i := strings.LastIndex(rest, "/")
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", false
+	}
+	title, err := normalizeTitle(rest[:i])
+	if err != nil {
+		return "", "", false
+	}
+	file, ok := cleanAttachmentName(rest[i+1:])
+	if !ok || file != rest[i+1:] {
+		return "", "", false
+	}
+	return title, file, true
+}
+
+// hasAttachment reports whether file is listed among title's attachments
+func hasAttachment(title, file string) bool {
+	unlock := pageLocks.RLock(title)
+	p, err := loadPage(title)
+	unlock()
+	if err != nil {
+		return false
+	}
+	for _, f := range p.Files {
+		if f == file {
+			return true
+		}
+	}
+	return false
+}
+
+// thumbHandler serves /thumb/{title}/{file}
+func thumbHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	title, file, ok := splitTitleFile(r.URL.Path, "/thumb/")
+	if ok && attachmentGone(title, file) {
+		goneError(w)
+		return
+	}
+	if ok && pageLocked(r, title) {
+		lockedError(w, r, title)
+		return
+	}
+	if !ok || !isThumbnailable(file) || !hasAttachment(title, file) || isEncrypted(title) {
+		http.NotFound(w, r)
+		return
+	}
+	size := defaultThumbSize
+	if s := r.URL.Query().Get("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || !thumbSizes[n] {
+			http.Error(w, "Unsupported thumbnail size", http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+
+	path, err := ensureThumbnail(title, file, size)
+	if err != nil {
+		log.Printf("Error making thumbnail of %s/%s: %v", title, file, err)
+		http.Error(w, "Could not make a thumbnail of this file", http.StatusUnprocessableEntity)
+		return
+	}
+	f, err := openStored(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if pageProtected(title) {
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+	} else {
+		w.Header().Set("Cache-Control", "max-age=3600")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+}
+
+// ensureThumbnail returns the path of an up-to-date cached thumbnail,
+// making it first if needed
+func ensureThumbnail(title, file string, size int) (string, error) {
+	src := filepath.Join(pageFilesDir(title), file)
+	dst := thumbPath(title, file, size)
+	release := thumbLocks.Lock(dst)
+	defer release()
+
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	if dstInfo, err := os.Stat(dst); err == nil && !dstInfo.ModTime().Before(srcInfo.ModTime()) {
+		return dst, nil
+	}
+	if srcInfo.Size() > thumbMaxSource {
+		return "", fmt.Errorf("image is larger than %d bytes", thumbMaxSource)
+	}
+
+	data, err := readStored(src)
+	if err != nil {
+		return "", err
+	}
+	thumb, err := makeThumbnail(data, strings.ToLower(filepath.Ext(file)), size)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	err = writeStored(dst, 0644, func(f io.Writer) error {
+		if filepath.Ext(dst) == ".jpg" {
+			return jpeg.Encode(f, thumb, &jpeg.Options{Quality: 82})
+		}
+		return png.Encode(f, thumb)
+	})
+	return dst, err
+}
+
+// makeThumbnail decodes an image, scales it to fit a size x size box and
+// turns it upright according to its EXIF orientation
+func makeThumbnail(data []byte, ext string, size int) (image.Image, error) {
+	config, err := imageConfigDecoders[ext](bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > thumbMaxPixels {
+		return nil, fmt.Errorf("image has more than %d pixels", thumbMaxPixels)
+	}
+	img, err := imageDecoders[ext](bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return nil, fmt.Errorf("empty image")
+	}
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/w)
+		} else {
+			w, h = max(1, w*size/h), size
+		}
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.BiLinear.Scale(scaled, scaled.Bounds(), img, b, draw.Src, nil)
+	return orient(scaled, imageOrientation(data, ext)), nil
+}
+
+// orient applies an EXIF orientation (1-8) to img
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	if orientation >= 5 {
+		out = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // turn 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // turn 90° counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			out.SetRGBA(dx, dy, img.RGBAAt(x, y))
+		}
+	}
+	return out
+}
+
+// imageOrientation returns the EXIF orientation of a JPEG, PNG or WebP
+// image, or 1 when it has none
+func imageOrientation(data []byte, ext string) int {
+	var exif []byte
+	switch ext {
+	case ".jpg", ".jpeg":
+		exif = jpegExif(data)
+	case ".png":
+		exif = pngChunk(data, "eXIf")
+	case ".webp":
+		exif = webpChunk(data, "EXIF")
+	}
+	return exifOrientation(exif)
+}
+
+// jpegExif returns the TIFF block of a JPEG's Exif APP1 segment
+func jpegExif(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 { // image data follows
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		i += 2 + length
+	}
+	return nil
+}
+
+// pngChunk returns the data of the first PNG chunk of the given type
+func pngChunk(data []byte, chunkType string) []byte {
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return nil
+	}
+	for i := 8; i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		if length < 0 || i+12+length > len(data) {
+			return nil
+		}
+		if string(data[i+4:i+8]) == chunkType {
+			return data[i+8 : i+8+length]
+		}
+		i += 12 + length
+	}
+	return nil
+}
+
+// webpChunk returns the data of the first RIFF chunk of the given type
+func webpChunk(data []byte, chunkType string) []byte {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil
+	}
+	for i := 12; i+8 <= len(data); {
+		length := int(binary.LittleEndian.Uint32(data[i+4:]))
+		if length < 0 || i+8+length > len(data) {
+			return nil
+		}
+		if string(data[i:i+4]) == chunkType {
+			return bytes.TrimPrefix(data[i+8:i+8+length], []byte("Exif\x00\x00"))
+		}
+		i += 8 + length + length%2 // chunks are padded to an even size
+	}
+	return nil
+}
+
+// exifOrientation reads the Orientation tag (0x0112) from the first IFD of
+// a TIFF-format EXIF block
+func exifOrientation(tiffData []byte) int {
+	if len(tiffData) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiffData[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiffData[4:]))
+	if ifd < 8 || ifd+2 > len(tiffData) {
+		return 1
+	}
+	count := int(order.Uint16(tiffData[ifd:]))
+	for k := 0; k < count; k++ {
+		entry := ifd + 2 + k*12
+		if entry+12 > len(tiffData) {
+			return 1
+		}
+		if order.Uint16(tiffData[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiffData[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// testImage encodes a w x h image as PNG, or JPEG for a .jpg name
+func testImage(name string, w, h int) string {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 200, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if name[len(name)-4:] == ".jpg" {
+		jpeg.Encode(&buf, img, nil)
+	} else {
+		png.Encode(&buf, img)
+	}
+	return buf.String()
+}
+
+// getThumb requests a thumbnail
+func getThumb(path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	thumbHandler(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+// thumbBounds decodes a thumbnail response and returns its size
+func thumbBounds(t *testing.T, w *httptest.ResponseRecorder) image.Point {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("thumbnail: %d %s", w.Code, w.Body)
+	}
+	img, _, err := image.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("decoding the thumbnail: %v", err)
+	}
+	return img.Bounds().Size()
+}
+
+func TestThumbnail(t *testing.T) {
+	testWiki(t)
+	if w := postFile("Gallery", "wide.png", testImage("wide.png", 600, 300)); w.Code != http.StatusOK {
+		t.Fatalf("uploading: %d %s", w.Code, w.Body)
+	}
+	for query, want := range map[string]image.Point{
+		"":          {256, 128},
+		"?size=128": {128, 64},
+		"?size=512": {512, 256},
+	} {
+		w := getThumb("/thumb/Gallery/wide.png" + query)
+		if got := thumbBounds(t, w); got != want {
+			t.Errorf("thumbnail%s is %v, want %v", query, got, want)
+		}
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("Cache-Control") != "max-age=3600" {
+			t.Errorf("thumbnail%s headers: %v", query, w.Header())
+		}
+	}
+
+	// Small images keep their size
+	postFile("Gallery", "small.jpg", testImage("small.jpg", 40, 20))
+	if got := thumbBounds(t, getThumb("/thumb/Gallery/small.jpg")); got != (image.Point{40, 20}) {
+		t.Errorf("thumbnail of a small image is %v", got)
+	}
+	if _, err := os.Stat(thumbPath("Gallery", "small.jpg", defaultThumbSize)); err != nil {
+		t.Errorf("the thumbnail wasn't cached: %v", err)
+	}
+
+	// A cached thumbnail is served until its attachment changes
+	cached := thumbPath("Gallery", "wide.png", 128)
+	os.WriteFile(cached, []byte("cached"), 0644)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(cached, later, later)
+	if w := getThumb("/thumb/Gallery/wide.png?size=128"); w.Body.String() != "cached" {
+		t.Errorf("the cached thumbnail wasn't served: %d", w.Code)
+	}
+	earlier := time.Now().Add(-time.Hour)
+	os.Chtimes(cached, earlier, earlier)
+	if got := thumbBounds(t, getThumb("/thumb/Gallery/wide.png?size=128")); got != (image.Point{128, 64}) {
+		t.Errorf("remade thumbnail is %v", got)
+	}
+}
+
+// TestThumbnailOrientation checks that a photo taken sideways comes out
+// upright, from the orientation left in the upload's EXIF
+func TestThumbnailOrientation(t *testing.T) {
+	testWiki(t)
+	photo := testImage("photo.jpg", 300, 100)
+	exif := append([]byte("Exif\x00\x00"), minimalExif(6)...)
+	segment := binary.BigEndian.AppendUint16([]byte{0xFF, 0xE1}, uint16(len(exif)+2))
+	photo = photo[:2] + string(segment) + string(exif) + photo[2:]
+	if w := postFile("Gallery", "photo.jpg", photo); w.Code != http.StatusOK {
+		t.Fatalf("uploading: %d %s", w.Code, w.Body)
+	}
+	if got := thumbBounds(t, getThumb("/thumb/Gallery/photo.jpg?size=128")); got != (image.Point{42, 128}) {
+		t.Errorf("thumbnail of a photo turned 90° is %v", got)
+	}
+}
+
+// pngHeader is the start of a PNG claiming to be w x h, enough for its
+// dimensions to be read
+func pngHeader(w, h int) string {
+	ihdr := binary.BigEndian.AppendUint32([]byte("IHDR"), uint32(w))
+	ihdr = binary.BigEndian.AppendUint32(ihdr, uint32(h))
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+	chunk := binary.BigEndian.AppendUint32(nil, 13)
+	chunk = append(chunk, ihdr...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(ihdr))
+	return "\x89PNG\r\n\x1a\n" + string(chunk)
+}
+
+func TestThumbnailRefused(t *testing.T) {
+	testWiki(t)
+	for name, content := range map[string]string{
+		"ok.png":     testImage("ok.png", 10, 10),
+		"notes.txt":  "not an image",
+		"broken.png": "not a png either",
+		"huge.png":   pngHeader(10000, 10000),
+	} {
+		if w := postFile("Gallery", name, content); w.Code != http.StatusOK {
+			t.Fatalf("uploading %s: %d %s", name, w.Code, w.Body)
+		}
+	}
+	if w := postFile("Gone", "ok.png", testImage("ok.png", 10, 10)); w.Code != http.StatusOK {
+		t.Fatal(w.Body)
+	}
+	bury("Gone", "ok.png")
+	t.Cleanup(func() { unbury("Gone", "ok.png") })
+
+	ciphertext := base64.StdEncoding.EncodeToString(make([]byte, gcmOverhead+10))
+	if w := postForm(testSave, "/save/Secret", url.Values{"body": {ciphertext}, "meta": {"1"}, "encrypted": {"1"}}); w.Code != http.StatusFound {
+		t.Fatalf("saving the encrypted page: %d %s", w.Code, w.Body)
+	}
+	if w := postFile("Secret", "sealed.png", string(make([]byte, gcmOverhead+10))); w.Code != http.StatusOK {
+		t.Fatalf("uploading to the encrypted page: %d %s", w.Code, w.Body)
+	}
+
+	if w := postFile("Private", "ok.png", testImage("ok.png", 10, 10)); w.Code != http.StatusOK {
+		t.Fatal(w.Body)
+	}
+	if w := postForm(testSave, "/save/Private", url.Values{"body": {"hidden"}, "password": {"hunter2"}}); w.Code != http.StatusFound {
+		t.Fatalf("protecting the page: %d %s", w.Code, w.Body)
+	}
+
+	for path, want := range map[string]int{
+		"/thumb/Gallery/ok.png?size=100": http.StatusBadRequest,
+		"/thumb/Gallery/ok.png?size=big": http.StatusBadRequest,
+		"/thumb/Gallery/notes.txt":       http.StatusNotFound,
+		"/thumb/Gallery/missing.png":     http.StatusNotFound,
+		"/thumb/Gallery/.hidden.png":     http.StatusNotFound,
+		"/thumb/Gallery":                 http.StatusNotFound,
+		"/thumb/Secret/sealed.png":       http.StatusNotFound,
+		"/thumb/Gallery/broken.png":      http.StatusUnprocessableEntity,
+		"/thumb/Gallery/huge.png":        http.StatusUnprocessableEntity,
+		"/thumb/Gone/ok.png":             http.StatusGone,
+		"/thumb/Private/ok.png":          http.StatusForbidden,
+		"/thumb/Gallery/ok.png?size=128": http.StatusOK,
+	} {
+		if w := getThumb(path); w.Code != want {
+			t.Errorf("GET %s: %d, want %d", path, w.Code, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	thumbHandler(w, httptest.NewRequest("POST", "/thumb/Gallery/ok.png", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: %d", w.Code)
+	}
+}
+
+func TestThumbFile(t *testing.T) {
+	for name, want := range map[string]string{
+		"a.png@128.png":   "a.png",
+		"a.jpg@512.jpg":   "a.jpg",
+		"a@b.png@256.png": "a@b.png",
+		"a.png@2.png":     "",
+		"a.png@128.jpg":   "",
+		"@128.png":        "",
+		"a.png":           "",
+	} {
+		got, ok := thumbFile(name)
+		if got != want || ok != (want != "") {
+			t.Errorf("thumbFile(%q) = %q, %v; want %q", name, got, ok, want)
+		}
+	}
+}
+
+func TestSplitTitleFile(t *testing.T) {
+	for path, want := range map[string][2]string{
+		"/thumb/Page/a.png":        {"Page", "a.png"},
+		"/thumb/work/Plan/a b.png": {"work/Plan", "a b.png"},
+		"/thumb/Page/":             {},
+		"/thumb/a.png":             {},
+		"/thumb/Page/.a.png":       {},
+		"/thumb/bad//title/a.png":  {},
+	} {
+		title, file, ok := splitTitleFile(path, "/thumb/")
+		if got := [2]string{title, file}; got != want || ok != (want != [2]string{}) {
+			t.Errorf("splitTitleFile(%q) = %q, %v; want %q", path, got, ok, want)
+		}
+	}
+}
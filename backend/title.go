@@ -0,0 +1,443 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Page titles are slash-separated paths such as "work/aws/keys". Every
+// segment but the last is a namespace; on disk each namespace becomes a
+// directory, so "work/aws/keys" is stored as work/aws/keys.txt and its
+// attachments live in files/work/aws/keys/_files/. Keeping them a level
+// down leaves files/work/aws/keys/ to the directories of nested pages, so
+// an attachment "b" of page "a" and the page "a/b" never meet.
+//
+// Titles may contain any Unicode letters and digits. Before use they are
+// normalized (NFC, plus optional case folding) and each segment is encoded
+// for the filesystem: a-z, 0-9 and '-' are kept, every other byte is written
+// as _xx in lowercase hex. "Notes" becomes "_4eotes" and "café" becomes
+// "caf_c3_a9", so names never collide on case-insensitive filesystems and
+// can always be decoded back to the original title.
+
+// Case policies for WIKI_TITLE_CASE
+const (
+	casePreserve = "preserve" // "Notes" and "notes" are different pages
+	caseFold     = "fold"     // titles are case folded, so both open "notes"
+)
+
+var titleCasePolicy = envString("WIKI_TITLE_CASE", casePreserve)
+
+var errInvalidTitle = errors.New("invalid page title")
+
+// attachmentsDirName is the directory below a page's files directory that
+// holds its attachments. "_fi" is no escape, so encodeSegment never gives
+// it and no nested page can have it as its name.
+const attachmentsDirName = "_files"
+
+// reservedNamespaces are top-level directory names the app already uses in
+// its working directory; pages may not be created underneath them.
+var reservedNamespaces = map[string]bool{
+	"files":       true,
+	"icon":        true,
+	"persistence": true,
+}
+
+var titleFolder = cases.Fold()
+
+func init() {
+	if titleCasePolicy != casePreserve && titleCasePolicy != caseFold {
+		log.Printf("Unknown WIKI_TITLE_CASE %q, using %q", titleCasePolicy, casePreserve)
+		titleCasePolicy = casePreserve
+	}
+}
+
+// normalizeTitle turns user input into the canonical form of a title, or
+// returns errInvalidTitle if it cannot name a page
+func normalizeTitle(raw string) (string, error) {
+	title := norm.NFC.String(strings.Trim(raw, "/"))
+	if titleCasePolicy == caseFold {
+		title = norm.NFC.String(titleFolder.String(title))
+	}
+	if title == "" {
+		return "", errInvalidTitle
+	}
+	segments := strings.Split(title, "/")
+	for i, segment := range segments {
+		segment = strings.TrimSpace(segment)
+		if !validSegment(segment) {
+			return "", errInvalidTitle
+		}
+		segments[i] = segment
+	}
+	if len(segments) > 1 && reservedNamespaces[encodeSegment(segments[0])] {
+		return "", errInvalidTitle
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// validSegment reports whether s may be used as one segment of a title:
+// letters, marks, digits, spaces, '-', '_' and '.', not starting with a dot
+func validSegment(s string) bool {
+	if s == "" || s[0] == '.' {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r), unicode.IsMark(r), unicode.IsDigit(r):
+		case r == '-', r == '_', r == '.', r == ' ':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isValidTitle reports whether title is already in canonical form
+func isValidTitle(title string) bool {
+	normalized, err := normalizeTitle(title)
+	return err == nil && normalized == title
+}
+
+// encodeSegment maps one title segment to its on-disk name
+func encodeSegment(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return b.String()
+}
+
+// decodeSegment is the inverse of encodeSegment. It rejects names that
+// encodeSegment could not have produced.
+func decodeSegment(name string) (string, bool) {
+	var b []byte
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-':
+			b = append(b, c)
+		case c == '_' && i+2 < len(name):
+			v, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", false
+			}
+			b = append(b, byte(v))
+			i += 2
+		default:
+			return "", false
+		}
+	}
+	s := string(b)
+	if s == "" || encodeSegment(s) != name {
+		return "", false
+	}
+	return s, true
+}
+
+// isEncodedSegment reports whether a directory name could belong to a
+// namespace, as opposed to app directories or hidden files
+func isEncodedSegment(name string) bool {
+	_, ok := decodeSegment(name)
+	return ok
+}
+
+// encodeTitle maps a title to its slash-separated on-disk path
+func encodeTitle(title string) string {
+	segments := strings.Split(title, "/")
+	for i, segment := range segments {
+		segments[i] = encodeSegment(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// decodeTitle maps an on-disk path back to the title, if it is one
+func decodeTitle(encoded string) (string, bool) {
+	title, ok := decodeEncodedPath(filepath.ToSlash(encoded))
+	if !ok || !isValidTitle(title) {
+		return "", false
+	}
+	return title, true
+}
+
+// pageFilename returns the path of the page body file relative to the
+// working directory
+func pageFilename(title string) string {
+	return filepath.FromSlash(encodeTitle(title)) + ".txt"
+}
+
+// filesListFilename returns the path of the page's attachment list
+func filesListFilename(title string) string {
+	return filepath.FromSlash(encodeTitle(title)) + ".files.txt"
+}
+
+// metaFilename returns the path of the page's metadata sidecar
+func metaFilename(title string) string {
+	return filepath.FromSlash(encodeTitle(title)) + ".meta.json"
+}
+
+// journalFilename returns the path of the journal written while the page
+// is being saved
+func journalFilename(title string) string {
+	return filepath.FromSlash(encodeTitle(title)) + ".journal.json"
+}
+
+// pageFilesDir returns the directory holding the page's uploaded files
+func pageFilesDir(title string) string {
+	return filepath.Join(filesDir, filepath.FromSlash(encodeTitle(title)), attachmentsDirName)
+}
+
+// attachmentDirTitle returns the page whose attachments are kept in dir,
+// given relative to filesDir, if it is such a directory
+func attachmentDirTitle(dir string) (string, bool) {
+	if filepath.Base(dir) != attachmentsDirName {
+		return "", false
+	}
+	return decodeTitle(filepath.Dir(dir))
+}
+
+// FilesPath is the page's path below /files/, for attachment links
+func (p *Page) FilesPath() string {
+	return encodeTitle(p.Title)
+}
+
+// titleFromFilename is the inverse of pageFilename. It returns false for
+// files that are not page bodies (for example .files.txt lists).
+func titleFromFilename(name string) (string, bool) {
+	if !strings.HasSuffix(name, ".txt") || strings.HasSuffix(name, ".files.txt") {
+		return "", false
+	}
+	return decodeTitle(strings.TrimSuffix(name, ".txt"))
+}
+
+// titleFromPageFile returns the title a page file (body or sidecar) belongs to
+func titleFromPageFile(name string) (string, bool) {
+	for _, suffix := range []string{".files.txt", ".meta.json", ".txt"} {
+		if strings.HasSuffix(name, suffix) {
+			return decodeTitle(strings.TrimSuffix(name, suffix))
+		}
+	}
+	return "", false
+}
+
+// namespaceOf returns the namespace part of a title ("" for top-level pages)
+func namespaceOf(title string) string {
+	ns := path.Dir(title)
+	if ns == "." {
+		return ""
+	}
+	return ns
+}
+
+// leafName returns the last segment of a title
+func leafName(title string) string {
+	return path.Base(title)
+}
+
+// Crumb is one step of the breadcrumb trail shown on namespace listings
+type Crumb struct {
+	Name      string
+	Namespace string
+}
+
+// breadcrumbs splits a namespace into the trail of its ancestors
+func breadcrumbs(ns string) []Crumb {
+	if ns == "" {
+		return nil
+	}
+	parts := strings.Split(ns, "/")
+	crumbs := make([]Crumb, 0, len(parts))
+	for i, part := range parts {
+		crumbs = append(crumbs, Crumb{Name: part, Namespace: strings.Join(parts[:i+1], "/")})
+	}
+	return crumbs
+}
+
+// MigrateTitles renames pages stored under names that are not the encoded
+// form of their normalized title: pages created before titles were encoded
+// ("Notes.txt") and pages left over from a different WIKI_TITLE_CASE policy.
+// root holds the page files and filesRoot their attachment directories.
+func MigrateTitles(root, filesRoot string) {
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return
+	}
+	var bodies []string
+	err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel != "." && (reservedNamespaces[rel] || strings.HasPrefix(d.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(rel, ".txt") && !strings.HasSuffix(rel, ".files.txt") {
+			bodies = append(bodies, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error scanning %s for title migration: %v", root, err)
+		return
+	}
+
+	for _, body := range bodies {
+		oldBody := filepath.Join(root, body)
+		oldPath := filepath.ToSlash(strings.TrimSuffix(body, ".txt"))
+		if _, ok := decodeTitle(oldPath); ok {
+			continue // Already canonical
+		}
+
+		// Legacy names are the raw title; encoded names from another case
+		// policy decode to one
+		raw := oldPath
+		if decoded, ok := decodeEncodedPath(oldPath); ok {
+			raw = decoded
+		}
+		title, err := normalizeTitle(raw)
+		if err != nil {
+			log.Printf("Cannot migrate page file %s: %v", oldBody, err)
+			continue
+		}
+		newPath := encodeTitle(title)
+		newBody := filepath.Join(root, filepath.FromSlash(newPath)+".txt")
+		if _, err := os.Stat(newBody); err == nil {
+			log.Printf("Cannot migrate page file %s: %s already exists", oldBody, newBody)
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(newBody), 0755); err != nil {
+			log.Printf("Error migrating %s: %v", oldBody, err)
+			continue
+		}
+		if err := os.Rename(oldBody, newBody); err != nil {
+			log.Printf("Error migrating %s: %v", oldBody, err)
+			continue
+		}
+		for _, suffix := range []string{".files.txt", ".meta.json"} {
+			oldSidecar := filepath.Join(root, filepath.FromSlash(oldPath)+suffix)
+			if _, err := os.Stat(oldSidecar); err == nil {
+				newSidecar := filepath.Join(root, filepath.FromSlash(newPath)+suffix)
+				if err := os.Rename(oldSidecar, newSidecar); err != nil {
+					log.Printf("Error migrating %s: %v", oldSidecar, err)
+				}
+			}
+		}
+		// Legacy names come from before attachments had a directory of
+		// their own; MigrateAttachmentDirs moves them there next
+		oldDir := filepath.Join(filesRoot, filepath.FromSlash(oldPath))
+		newDir := filepath.Join(filesRoot, filepath.FromSlash(newPath))
+		if err := moveAttachmentFiles(oldDir, newDir); err != nil {
+			log.Printf("Error migrating attachments of %s: %v", oldBody, err)
+		}
+		os.Remove(oldDir)
+		removeEmptyParents(oldBody, root)
+		removeEmptyParents(oldDir, filesRoot)
+		log.Printf("Migrated page %s to %s", oldBody, newBody)
+	}
+}
+
+// decodeEncodedPath decodes every segment of an on-disk path without
+// requiring the result to be canonical under the current case policy
+func decodeEncodedPath(p string) (string, bool) {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		decoded, ok := decodeSegment(segment)
+		if !ok {
+			return "", false
+		}
+		segments[i] = decoded
+	}
+	return strings.Join(segments, "/"), true
+}
+
+// MigrateAttachmentDirs moves attachments that are still kept directly in
+// their page's directory below filesRoot, as they were before nested pages
+// had directories of their own there, down into its attachmentsDirName
+func MigrateAttachmentDirs(filesRoot string) {
+	var dirs []string
+	filepath.WalkDir(filesRoot, func(p string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || p == filesRoot {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") || d.Name() == attachmentsDirName {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(filesRoot, p)
+		if err != nil {
+			return nil
+		}
+		if _, ok := decodeTitle(rel); !ok {
+			return filepath.SkipDir
+		}
+		dirs = append(dirs, p)
+		return nil
+	})
+
+	for _, dir := range dirs {
+		dest := filepath.Join(dir, attachmentsDirName)
+		// An attachment called _files is in the way of the directory, so
+		// it moves aside and follows the others in
+		aside := filepath.Join(dir, ".migrating"+attachmentsDirName)
+		info, err := os.Lstat(dest)
+		movedAside := err == nil && !info.IsDir()
+		if movedAside {
+			if err := os.Rename(dest, aside); err != nil {
+				log.Printf("Error migrating attachments of %s: %v", dir, err)
+				continue
+			}
+		}
+		if err := moveAttachmentFiles(dir, dest); err != nil {
+			log.Printf("Error migrating attachments of %s: %v", dir, err)
+			continue
+		}
+		if movedAside {
+			if err := os.Rename(filepath.Join(dest, filepath.Base(aside)), filepath.Join(dest, attachmentsDirName)); err != nil {
+				log.Printf("Error migrating attachments of %s: %v", dir, err)
+			}
+		}
+	}
+}
+
+// moveAttachmentFiles moves the regular files of one directory into
+// another. Sub-directories belong to nested pages and are left alone.
+func moveAttachmentFiles(srcDir, destDir string) error {
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if err := os.MkdirAll(destDir, 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(srcDir, entry.Name()), filepath.Join(destDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads over the tus protocol (https://tus.io, version 1.0.0
+// with the creation, checksum, termination and expiration extensions).
+//
+// POST /tus/{title} creates an upload and returns its URL,
+// /tus/{title}?id={id}. The client then PATCHes the file in chunks; after a
+// dropped connection it asks for the stored offset with HEAD and carries on
+// from there. Chunks go to files/.tus, which backups skip. Once the last
+// byte arrives the file is checked against the whole-file checksum given at
+// creation, if any, and moved into the page's attachments through
+// storeAttachment like a normal upload.
+//
+// An upload reserves its whole Upload-Length against the page limit and the
+// storage quota when it is created, which covers the chunks stored so far.
+// The reservation lasts as long as its state file: until the upload is
+// finished, deleted or expires.
+
+const tusVersion = "1.0.0"
+
+var tusDir = filepath.Join(filesDir, ".tus")
+
+// tusExpiry is how long an unfinished upload is kept
+var tusExpiry = time.Duration(envInt("WIKI_TUS_EXPIRY_HOURS", 24)) * time.Hour
+
+// tusReserveMu serializes checking the limits and reserving space for new
+// uploads, so uploads created at once can't all take the same space
+var tusReserveMu sync.Mutex
+
+// tusLocks serializes requests on the same upload
+var tusLocks = &titleLocks{locks: make(map[string]*titleLock)}
+
+var tusIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// errTusChecksum is returned when data doesn't match its checksum
+var errTusChecksum = errors.New("checksum mismatch")
+
+// tusUpload is the state of one upload, kept next to its data
+type tusUpload struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title"`
+	Filename     string    `json:"filename"`
+	Length       int64     `json:"length"`
+	Offset       int64     `json:"offset"`
+	Checksum     string    `json:"checksum,omitempty"` // "<algorithm> <base64 digest>" of the whole file
+	KeepMetadata bool      `json:"keep_metadata,omitempty"`
+	ExpiresIn    string    `json:"expires_in,omitempty"` // lifetime of the finished attachment
+	Created      time.Time `json:"created"`
+}
+
+func (u *tusUpload) infoPath() string { return filepath.Join(tusDir, u.ID+".json") }
+func (u *tusUpload) dataPath() string { return filepath.Join(tusDir, u.ID+".bin") }
+
+func (u *tusUpload) expires() time.Time { return u.Created.Add(tusExpiry) }
+
+func (u *tusUpload) saveInfo() error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(u.infoPath(), data, 0600)
+}
+
+func (u *tusUpload) remove() {
+	os.Remove(u.dataPath())
+	os.Remove(u.infoPath())
+}
+
+// loadTusUpload reads the state of upload id, which must belong to title
+func loadTusUpload(id, title string) (*tusUpload, error) {
+	if !tusIDPattern.MatchString(id) {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(filepath.Join(tusDir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var u tusUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+	// An expired upload is as good as swept
+	if u.ID != id || u.Title != title || time.Now().After(u.expires()) {
+		return nil, os.ErrNotExist
+	}
+	return &u, nil
+}
+
+// tusReserved adds up the lengths of the unfinished uploads to title, or to
+// every page when title is "". Expired uploads have given theirs back.
+func tusReserved(title string) int64 {
+	entries, err := os.ReadDir(tusDir)
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(tusDir, entry.Name()))
+		var u tusUpload
+		if err != nil || json.Unmarshal(data, &u) != nil {
+			continue
+		}
+		if (title == "" || u.Title == title) && !time.Now().After(u.expires()) {
+			total += u.Length
+		}
+	}
+	return total
+}
+
+// tusHash returns a hash for one of the supported checksum algorithms
+func tusHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "md5":
+		return md5.New()
+	}
+	return nil
+}
+
+// parseTusChecksum splits an "<algorithm> <base64 digest>" value
+func parseTusChecksum(value string) (string, []byte, error) {
+	algorithm, encoded, ok := strings.Cut(strings.TrimSpace(value), " ")
+	if !ok || tusHash(algorithm) == nil {
+		return "", nil, errors.New("unsupported checksum algorithm")
+	}
+	digest, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, errors.New("malformed checksum")
+	}
+	return algorithm, digest, nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated keys,
+// each followed by a space and a base64 value
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("malformed metadata value for %s", key)
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+// tusHandler dispatches the tus requests for one page
+func tusHandler(w http.ResponseWriter, r *http.Request, title string) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Tus-Checksum-Algorithm, Upload-Offset, Upload-Length, Upload-Expires")
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Methods", "POST, HEAD, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, Upload-Checksum, X-HTTP-Method-Override")
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,checksum,termination,expiration")
+		if maxFileSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxFileSize, 10))
+		}
+		w.Header().Set("Tus-Checksum-Algorithm", "sha1,sha256,md5")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	method := r.Method
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" {
+		method = override
+	}
+	switch method {
+	case "POST":
+		tusCreate(w, r, title)
+	case "HEAD", "PATCH", "DELETE":
+		id := r.URL.Query().Get("id")
+		release := tusLocks.Lock(id)
+		defer release()
+		u, err := loadTusUpload(id, title)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		switch method {
+		case "HEAD":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+			w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+			w.Header().Set("Upload-Expires", u.expires().UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusOK)
+		case "PATCH":
+			tusPatch(w, r, u)
+		case "DELETE":
+			u.remove()
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// tusCreate starts a new upload
+func tusCreate(w http.ResponseWriter, r *http.Request, title string) {
+	go sweepTusUploads()
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length is required", http.StatusBadRequest)
+		return
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := meta["filename"]
+	if name == "" {
+		name = meta["name"]
+	}
+	filename, ok := cleanAttachmentName(name)
+	if !ok {
+		http.Error(w, "A valid filename is required in Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	if meta["checksum"] != "" {
+		if _, _, err := parseTusChecksum(meta["checksum"]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if _, err := expiryFor(meta["expires_in"]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Chunks would arrive as plaintext, which an encrypted page must not get
+	if isEncrypted(title) {
+		http.Error(w, errEncryptedPage.Error(), http.StatusBadRequest)
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u := &tusUpload{
+		ID:           hex.EncodeToString(idBytes),
+		Title:        title,
+		Filename:     filename,
+		Length:       length,
+		Checksum:     meta["checksum"],
+		KeepMetadata: !stripUploadMetadata || meta["keep_metadata"] != "",
+		ExpiresIn:    meta["expires_in"],
+		Created:      time.Now(),
+	}
+	if err := reserveTusUpload(u); err != nil {
+		uploadError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// An empty file is complete as soon as it exists
+	if length == 0 {
+		if err := finishTusUpload(u); err != nil {
+			uploadError(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	location := url.URL{Path: "/tus/" + title, RawQuery: "id=" + u.ID}
+	w.Header().Set("Location", location.String())
+	w.Header().Set("Upload-Expires", u.expires().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// reserveTusUpload checks that u fits in what the limits leave and creates
+// it, which reserves its length
+func reserveTusUpload(u *tusUpload) error {
+	tusReserveMu.Lock()
+	defer tusReserveMu.Unlock()
+	allowance, limitErr, err := attachmentAllowance(u.Title, u.Filename)
+	if err != nil {
+		return err
+	}
+	if u.Length > allowance {
+		return limitErr
+	}
+	if err := os.MkdirAll(tusDir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(u.dataPath(), nil, 0600); err != nil {
+		return err
+	}
+	if err := u.saveInfo(); err != nil {
+		u.remove()
+		return err
+	}
+	return nil
+}
+
+// tusPatch appends one chunk at the upload's current offset
+func tusPatch(w http.ResponseWriter, r *http.Request, u *tusUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Offset is required", http.StatusBadRequest)
+		return
+	}
+	if offset != u.Offset {
+		http.Error(w, "Upload-Offset does not match the stored offset", http.StatusConflict)
+		return
+	}
+	var checksum hash.Hash
+	var digest []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		algorithm, d, err := parseTusChecksum(header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		checksum, digest = tusHash(algorithm), d
+	}
+
+	f, err := os.OpenFile(u.dataPath(), os.O_WRONLY, 0600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(u.Offset, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.ContentLength > u.Length-u.Offset {
+		http.Error(w, "Chunk runs past Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var dst io.Writer = f
+	if checksum != nil {
+		dst = io.MultiWriter(f, checksum)
+	}
+	body := http.MaxBytesReader(w, r.Body, u.Length-u.Offset)
+	n, copyErr := io.Copy(dst, body)
+
+	// A chunk with a checksum, or one that runs past the end, is all or
+	// nothing; otherwise whatever arrived before a dropped connection is
+	// kept to resume from
+	var tooLarge *http.MaxBytesError
+	if errors.As(copyErr, &tooLarge) {
+		f.Truncate(u.Offset)
+		http.Error(w, "Chunk runs past Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if checksum != nil && (copyErr != nil || !bytes.Equal(checksum.Sum(nil), digest)) {
+		f.Truncate(u.Offset)
+		if copyErr == nil {
+			http.Error(w, errTusChecksum.Error(), 460)
+		} else {
+			http.Error(w, copyErr.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	if err := f.Sync(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u.Offset += n
+	if err := u.saveInfo(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if copyErr != nil {
+		http.Error(w, copyErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if u.Offset == u.Length {
+		f.Close()
+		if err := finishTusUpload(u); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errTusChecksum) {
+				status = 460
+			}
+			uploadError(w, err, status)
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload verifies a complete upload and moves it into the page's
+// attachments. A file that fails its checksum or can't be stored is
+// discarded.
+func finishTusUpload(u *tusUpload) error {
+	if u.Checksum != "" {
+		algorithm, digest, err := parseTusChecksum(u.Checksum)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(u.dataPath())
+		if err != nil {
+			return err
+		}
+		h := tusHash(algorithm)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(h.Sum(nil), digest) {
+			u.remove()
+			return errTusChecksum
+		}
+	}
+
+	// From here the file counts as the attachment it becomes, so the
+	// reservation goes. An upload that fails to be stored can't be
+	// resumed: its data may already have been moved.
+	os.Remove(u.infoPath())
+
+	// The lifetime runs from when the upload completes
+	expires, _ := expiryFor(u.ExpiresIn)
+	err := storeAttachment(u.Title, u.Filename, expires, func(path string) error {
+		// The limits may have been reached by other uploads in the meantime
+		allowance, limitErr, err := attachmentAllowance(u.Title, u.Filename)
+		if err != nil {
+			return err
+		}
+		if u.Length > allowance {
+			return limitErr
+		}
+		if !u.KeepMetadata || keys.Load() != nil {
+			// Cleaning or encrypting the file rewrites it, so it can't
+			// simply be moved
+			f, err := os.Open(u.dataPath())
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			var src io.Reader = f
+			if !u.KeepMetadata {
+				cleaned := withoutMetadata(f)
+				defer cleaned.Close()
+				src = cleaned
+			}
+			if err := writeAttachment(u.Title, path, src); err != nil {
+				return err
+			}
+			return os.Remove(u.dataPath())
+		}
+		if err := os.Rename(u.dataPath(), path); err != nil {
+			return err
+		}
+		syncDir(filepath.Dir(path))
+		return nil
+	})
+	if err != nil {
+		os.Remove(u.dataPath())
+	}
+	return err
+}
+
+// sweepTusUploads removes unfinished uploads that have expired
+func sweepTusUploads() {
+	entries, err := os.ReadDir(tusDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !tusIDPattern.MatchString(id) {
+			continue
+		}
+		release := tusLocks.Lock(id)
+		data, err := os.ReadFile(filepath.Join(tusDir, entry.Name()))
+		var u tusUpload
+		if err == nil && json.Unmarshal(data, &u) == nil && u.ID == id && time.Now().After(u.expires()) {
+			u.remove()
+			log.Printf("Removed expired upload %s of %s", u.Filename, u.Title)
+		}
+		release()
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTus = makeHandler(tusHandler)
+
+// tusRequest sends one tus request to title, for upload id unless it is ""
+func tusRequest(method, title, id string, header map[string]string, body []byte) *httptest.ResponseRecorder {
+	target := "/tus/" + title
+	if id != "" {
+		target += "?id=" + id
+	}
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for key, value := range header {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	testTus(w, r)
+	return w
+}
+
+// tusCreateUpload starts an upload of length bytes named filename and
+// returns the response and the upload's id
+func tusCreateUpload(title, filename string, length int) (*httptest.ResponseRecorder, string) {
+	w := tusRequest("POST", title, "", map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(filename)),
+	}, nil)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		return w, ""
+	}
+	return w, location.Query().Get("id")
+}
+
+// tusPatchChunk sends data at offset
+func tusPatchChunk(title, id string, offset int, data []byte) *httptest.ResponseRecorder {
+	return tusRequest("PATCH", title, id, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	}, data)
+}
+
+// TestTusReservations checks that unfinished uploads hold their declared
+// length against the storage quota until they finish or are deleted
+func TestTusReservations(t *testing.T) {
+	testWiki(t)
+	saved := storageQuota
+	storageQuota = 1000
+	t.Cleanup(func() { storageQuota = saved })
+
+	w, first := tusCreateUpload("Big", "a.bin", 600)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating the first upload: %d %s", w.Code, w.Body)
+	}
+	if w, _ := tusCreateUpload("Other", "b.bin", 600); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("second upload into reserved space: %d %s", w.Code, w.Body)
+	}
+	if w := postFile("Other", "c.bin", string(make([]byte, 500))); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("plain upload into reserved space: %d %s", w.Code, w.Body)
+	}
+
+	// Deleting the upload gives its space back
+	if w := tusRequest("DELETE", "Big", first, nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("deleting the first upload: %d %s", w.Code, w.Body)
+	}
+	w, second := tusCreateUpload("Other", "b.bin", 600)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating the second upload after the delete: %d %s", w.Code, w.Body)
+	}
+
+	// Finishing turns the reservation into the attachment's own space
+	if w := tusPatchChunk("Other", second, 0, make([]byte, 600)); w.Code != http.StatusNoContent {
+		t.Fatalf("sending the second upload: %d %s", w.Code, w.Body)
+	}
+	if used, err := storageUsage(); err != nil || used != 600 {
+		t.Errorf("storage used after finishing: %d, %v", used, err)
+	}
+	if w, _ := tusCreateUpload("Big", "d.bin", 401); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload over what is left: %d %s", w.Code, w.Body)
+	}
+	if w, _ := tusCreateUpload("Big", "d.bin", 400); w.Code != http.StatusCreated {
+		t.Errorf("upload into what is left: %d %s", w.Code, w.Body)
+	}
+}
+
+// tusOffset asks for the stored offset of an upload, -1 if it is unknown
+func tusOffset(title, id string) int {
+	w := tusRequest("HEAD", title, id, nil, nil)
+	if w.Code != http.StatusOK {
+		return -1
+	}
+	offset, _ := strconv.Atoi(w.Header().Get("Upload-Offset"))
+	return offset
+}
+
+// TestTusResume sends an upload in chunks, with requests that must leave
+// the stored offset where it was in between
+func TestTusResume(t *testing.T) {
+	testWiki(t)
+	data := []byte("0123456789")
+	w, id := tusCreateUpload("Resumed", "digits.txt", len(data))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating the upload: %d %s", w.Code, w.Body)
+	}
+
+	if w := tusPatchChunk("Resumed", id, 0, data[:4]); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "4" {
+		t.Fatalf("first chunk: %d %s, offset %s", w.Code, w.Body, w.Header().Get("Upload-Offset"))
+	}
+	sum := sha1.Sum(data[4:7])
+	goodSum := "sha1 " + base64.StdEncoding.EncodeToString(sum[:])
+	badSum := "sha1 " + base64.StdEncoding.EncodeToString(make([]byte, sha1.Size))
+	overlong := httptest.NewRequest("PATCH", "/tus/Resumed?id="+id, io.MultiReader(bytes.NewReader(data[4:])))
+	for _, tt := range []struct {
+		what   string
+		header map[string]string
+		body   []byte
+		want   int
+	}{
+		{"chunk sent again", map[string]string{"Upload-Offset": "0"}, data[:4], http.StatusConflict},
+		{"chunk past a gap", map[string]string{"Upload-Offset": "6"}, data[6:], http.StatusConflict},
+		{"no offset", map[string]string{"Upload-Offset": ""}, data[4:], http.StatusBadRequest},
+		{"wrong content type", map[string]string{"Content-Type": "text/plain"}, data[4:], http.StatusUnsupportedMediaType},
+		{"wrong checksum", map[string]string{"Upload-Checksum": badSum}, data[4:7], 460},
+		{"unknown checksum", map[string]string{"Upload-Checksum": "crc32 AAAA"}, data[4:7], http.StatusBadRequest},
+		{"chunk past the length", nil, append(data[4:], '!'), http.StatusRequestEntityTooLarge},
+	} {
+		header := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "4"}
+		maps.Copy(header, tt.header)
+		if w := tusRequest("PATCH", "Resumed", id, header, tt.body); w.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.what, w.Code, w.Body, tt.want)
+		}
+		if offset := tusOffset("Resumed", id); offset != 4 {
+			t.Errorf("offset after %s = %d", tt.what, offset)
+		}
+	}
+	// Also when the body doesn't say how long it is
+	overlong.Header.Set("Tus-Resumable", tusVersion)
+	overlong.Header.Set("Content-Type", "application/offset+octet-stream")
+	overlong.Header.Set("Upload-Offset", "4")
+	overlong.Body = io.NopCloser(io.MultiReader(bytes.NewReader(data[4:]), bytes.NewReader([]byte("!"))))
+	overlong.ContentLength = -1
+	rec := httptest.NewRecorder()
+	testTus(rec, overlong)
+	if rec.Code != http.StatusRequestEntityTooLarge || tusOffset("Resumed", id) != 4 {
+		t.Errorf("streamed chunk past the length: %d, offset %d", rec.Code, tusOffset("Resumed", id))
+	}
+
+	header := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "4", "Upload-Checksum": goodSum}
+	if w := tusRequest("PATCH", "Resumed", id, header, data[4:7]); w.Code != http.StatusNoContent || tusOffset("Resumed", id) != 7 {
+		t.Fatalf("chunk with its checksum: %d %s", w.Code, w.Body)
+	}
+	if w := tusPatchChunk("Resumed", id, 7, data[7:]); w.Code != http.StatusNoContent {
+		t.Fatalf("last chunk: %d %s", w.Code, w.Body)
+	}
+	if got := attachmentContent("Resumed", "digits.txt"); got != string(data) {
+		t.Errorf("finished upload = %q", got)
+	}
+	if offset := tusOffset("Resumed", id); offset != -1 {
+		t.Errorf("the finished upload still answers with offset %d", offset)
+	}
+	checkConsistent(t, "Resumed")
+}
+
+func TestTusRefused(t *testing.T) {
+	testWiki(t)
+	wholeSum := sha256.Sum256([]byte("expected"))
+	w, checked := tusCreateUpload("Page", "checked.txt", 8)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating an upload: %d %s", w.Code, w.Body)
+	}
+	// Give it a whole-file checksum the data won't match
+	w = tusRequest("POST", "Page", "", map[string]string{
+		"Upload-Length": "8",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("summed.txt")) +
+			",checksum " + base64.StdEncoding.EncodeToString([]byte("sha256 "+base64.StdEncoding.EncodeToString(wholeSum[:]))),
+	}, nil)
+	summed := strings.TrimPrefix(w.Header().Get("Location"), "/tus/Page?id=")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating an upload with a checksum: %d %s", w.Code, w.Body)
+	}
+	if w := tusPatchChunk("Page", summed, 0, []byte("received")); w.Code != 460 {
+		t.Errorf("upload that fails its checksum: %d %s", w.Code, w.Body)
+	}
+	if tusOffset("Page", summed) != -1 || attachmentContent("Page", "summed.txt") != "" {
+		t.Error("the upload that failed its checksum was kept")
+	}
+
+	if w := tusRequest("HEAD", "Other", checked, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("upload asked for under another page: %d", w.Code)
+	}
+	if w := tusRequest("HEAD", "Page", "../../page", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("malformed id: %d", w.Code)
+	}
+	r := httptest.NewRequest("HEAD", "/tus/Page?id="+checked, nil)
+	rec := httptest.NewRecorder()
+	testTus(rec, r)
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("request without Tus-Resumable: %d", rec.Code)
+	}
+	for what, header := range map[string]map[string]string{
+		"no length":       {"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt"))},
+		"no filename":     {"Upload-Length": "3"},
+		"hidden filename": {"Upload-Length": "3", "Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(".a"))},
+		"bad metadata":    {"Upload-Length": "3", "Upload-Metadata": "filename %%%"},
+	} {
+		if w := tusRequest("POST", "Page", "", header, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("creating an upload with %s: %d %s", what, w.Code, w.Body)
+		}
+	}
+
+	// Expired uploads are gone and give their space back
+	saved := tusExpiry
+	tusExpiry = -time.Second
+	t.Cleanup(func() { tusExpiry = saved })
+	if tusOffset("Page", checked) != -1 || tusReserved("") != 0 {
+		t.Errorf("expired upload: offset %d, %d bytes reserved", tusOffset("Page", checked), tusReserved(""))
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Upload limits. Sizes are in bytes; 0 turns the page and storage limits
+// off. Files are streamed to disk and stopped as soon as they go over a
+// limit, so an oversized upload never fills the disk.
+var (
+	maxFileSize    = envInt("WIKI_MAX_FILE_SIZE", 1<<30) // one attachment
+	maxPageSize    = envInt("WIKI_MAX_PAGE_SIZE", 0)     // all attachments of one page
+	storageQuota   = envInt("WIKI_STORAGE_QUOTA", 0)     // all attachments of the wiki
+	maxUploadFiles = envInt("WIKI_MAX_UPLOAD_FILES", 20) // files in one upload request
+)
+
+// stagingDir holds uploads while they are streamed in, before they replace
+// an attachment
+var stagingDir = filepath.Join(filesDir, ".uploads")
+
+var (
+	errNoFiles     = errors.New("Error retrieving file: no file in upload")
+	errBadFileName = errors.New("Invalid file name")
+)
+
+// uploadLimitError reports which limit an upload ran into
+type uploadLimitError struct {
+	Limit string
+	Max   int64
+}
+
+func (e *uploadLimitError) Error() string {
+	return fmt.Sprintf("Upload exceeds the %s of %d bytes", e.Limit, e.Max)
+}
+
+// attachmentAllowance returns how many bytes filename may hold as an
+// attachment of title, and the limit to report if it gets larger. Earlier
+// versions count against the page and the quota like attachments; what
+// replacing an existing file of the same name frees is given back, see
+// replacedSize. Uploads check it while they stream in without the page
+// lock, and storeAttachment checks again with it held before the file
+// replaces anything.
+func attachmentAllowance(title, filename string) (int64, *uploadLimitError, error) {
+	allowance := int64(math.MaxInt64)
+	limitErr := &uploadLimitError{Limit: "file size limit", Max: math.MaxInt64}
+	restrict := func(remaining int64, err *uploadLimitError) {
+		if remaining < allowance {
+			allowance, limitErr = max(remaining, 0), err
+		}
+	}
+
+	if maxFileSize > 0 {
+		restrict(maxFileSize, &uploadLimitError{Limit: "file size limit", Max: maxFileSize})
+	}
+	var replaced int64
+	if filename != "" {
+		replaced = replacedSize(title, filename)
+	}
+	if maxPageSize > 0 {
+		used, err := pageUsage(title)
+		if err != nil {
+			return 0, nil, err
+		}
+		restrict(maxPageSize-used+replaced, &uploadLimitError{Limit: "page's attachment limit", Max: maxPageSize})
+	}
+	if storageQuota > 0 {
+		used, err := storageUsage()
+		if err != nil {
+			return 0, nil, err
+		}
+		restrict(storageQuota-used+replaced, &uploadLimitError{Limit: "storage quota", Max: storageQuota})
+	}
+	return allowance, limitErr, nil
+}
+
+// pageUsage is the space title's attachments take, with their versions
+// and what its unfinished resumable uploads have reserved
+func pageUsage(title string) (int64, error) {
+	used, err := attachmentUsage(pageFilesDir(title), false)
+	if err != nil {
+		return 0, err
+	}
+	versions, err := attachmentUsage(versionPageDir(title), false)
+	return used + versions + tusReserved(title), err
+}
+
+// storageUsage is pageUsage for the whole wiki
+func storageUsage() (int64, error) {
+	used, err := attachmentUsage(filesDir, true)
+	return used + tusReserved(""), err
+}
+
+// attachmentUsage adds up the sizes of the attachments in dir, and below it
+// when recursive. Dot-files and dot-directories are working state, not
+// attachments, except files/.versions: earlier versions take up space just
+// like the attachments they were.
+func attachmentUsage(dir string, recursive bool) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			hidden := strings.HasPrefix(d.Name(), ".") && filepath.Clean(path) != filepath.Clean(versionsDir)
+			if path != dir && (!recursive || hidden) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+// writeAttachment streams src to path, where storeAttachment stages a file
+// for title, and gives up with an uploadLimitError once it passes what the
+// limits allow.
+func writeAttachment(title, path string, src io.Reader) error {
+	return writeAttachmentWith(title, path, func(dst io.Writer) error {
+		_, err := io.Copy(dst, src)
+		return err
+	})
+}
+
+// writeAttachmentWith is writeAttachment for contents produced by fill,
+// such as an archive built on the fly
+func writeAttachmentWith(title, path string, fill func(io.Writer) error) error {
+	allowance, limitErr, err := attachmentAllowance(title, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	return writeStored(path, 0644, func(dst io.Writer) error {
+		return fill(&limitedWriter{w: dst, remaining: allowance, err: limitErr})
+	})
+}
+
+// limitedWriter fails with err once more than remaining bytes are written
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+	err       error
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining {
+		return 0, l.err
+	}
+	l.remaining -= int64(len(p))
+	return l.w.Write(p)
+}
+
+// uploadRequestLimit is the hard cap on the body of one upload request
+func uploadRequestLimit() int64 {
+	if maxFileSize <= 0 || maxUploadFiles <= 0 || maxFileSize > (math.MaxInt64-1<<20)/maxUploadFiles {
+		return math.MaxInt64
+	}
+	// Allow for the multipart headers around each file
+	return maxFileSize*maxUploadFiles + 1<<20
+}
+
+// uploadError answers a failed upload: 413 for anything over a limit and
+// status otherwise
+func uploadError(w http.ResponseWriter, err error, status int) {
+	var limitErr *uploadLimitError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &limitErr):
+		http.Error(w, limitErr.Error(), http.StatusRequestEntityTooLarge)
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("Upload exceeds the request limit of %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errNoFiles), errors.Is(err, errBadFileName), errors.Is(err, errBadLifetime):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), status)
+	}
+}
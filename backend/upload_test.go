@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSlowUploadLeavesPageReadable streams an upload in slowly and views
+// the page while it is still coming in
+func TestSlowUploadLeavesPageReadable(t *testing.T) {
+	testWiki(t)
+	title := "Slow"
+	if w := postForm(testSave, "/save/"+title, url.Values{"body": {"still here"}}); w.Code != http.StatusFound {
+		t.Fatalf("saving %q: %d %s", title, w.Code, w.Body)
+	}
+
+	body, sender := io.Pipe()
+	mw := multipart.NewWriter(sender)
+	r := httptest.NewRequest("POST", "/upload/"+title, body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	uploaded := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		testUpload(w, r)
+		uploaded <- w
+	}()
+	part, _ := mw.CreateFormFile("file", "big.bin")
+	chunk := bytes.Repeat([]byte("x"), 64<<10)
+	// The pipe only returns once the handler has read the chunk, so the
+	// upload is under way from here
+	part.Write(chunk)
+
+	viewed := make(chan int, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		makeHandler(viewHandler)(w, httptest.NewRequest("GET", "/view/"+title, nil))
+		viewed <- w.Code
+	}()
+	select {
+	case code := <-viewed:
+		if code != http.StatusOK {
+			t.Errorf("viewing %q during the upload: %d", title, code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("viewing %q waited for the upload to finish", title)
+	}
+
+	part.Write(chunk)
+	mw.Close()
+	sender.Close()
+	if w := <-uploaded; w.Code != http.StatusOK {
+		t.Fatalf("upload to %q: %d %s", title, w.Code, w.Body)
+	}
+	info, err := os.Stat(filepath.Join(pageFilesDir(title), "big.bin"))
+	if err != nil || info.Size() != 2*int64(len(chunk)) {
+		t.Errorf("big.bin after the upload: %v %v", info, err)
+	}
+	entries, _ := os.ReadDir(stagingDir)
+	if len(entries) != 0 {
+		t.Errorf("the upload left %d entries in %s", len(entries), stagingDir)
+	}
+	checkConsistent(t, title)
+}
+
+// TestUploadLimits runs uploads into the file size limit and into the
+// page's limit, which earlier versions count against
+func TestUploadLimits(t *testing.T) {
+	testWiki(t)
+	savedFile, savedPage := maxFileSize, maxPageSize
+	maxFileSize, maxPageSize = 500, 1000
+	t.Cleanup(func() { maxFileSize, maxPageSize = savedFile, savedPage })
+
+	title := "Limits"
+	if w := postFile(title, "big.txt", string(bytes.Repeat([]byte("x"), 501))); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload over the file size limit: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(pageFilesDir(title), "big.txt")); !os.IsNotExist(err) {
+		t.Errorf("the refused upload was stored: %v", err)
+	}
+
+	content := string(bytes.Repeat([]byte("y"), 400))
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusRequestEntityTooLarge} {
+		if w := postFile(title, "notes.txt", content); w.Code != want {
+			t.Errorf("upload %d of notes.txt: %d %s, want %d", i+1, w.Code, w.Body, want)
+		}
+	}
+	if used, err := pageUsage(title); err != nil || used != 800 {
+		t.Errorf("%q uses %d bytes (%v), want 800", title, used, err)
+	}
+	entries, _ := os.ReadDir(stagingDir)
+	if len(entries) != 0 {
+		t.Errorf("refused uploads left %d entries in %s", len(entries), stagingDir)
+	}
+	checkConsistent(t, title)
+}
+
+// postFiles uploads several files to title in one request
+func postFiles(title string, files ...[2]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, file := range files {
+		part, _ := mw.CreateFormFile("file", file[0])
+		part.Write([]byte(file[1]))
+	}
+	mw.Close()
+	r := httptest.NewRequest("POST", "/upload/"+title, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	testUpload(w, r)
+	return w
+}
+
+func TestUploadRefused(t *testing.T) {
+	testWiki(t)
+	savedQuota, savedFiles := storageQuota, maxUploadFiles
+	storageQuota, maxUploadFiles = 1000, 2
+	t.Cleanup(func() { storageQuota, maxUploadFiles = savedQuota, savedFiles })
+
+	if w := postFiles("First", [2]string{"a.txt", "aaa"}, [2]string{"b.txt", "bbb"}); w.Code != http.StatusOK {
+		t.Fatalf("uploading two files: %d %s", w.Code, w.Body)
+	}
+	if w := postFiles("First", [2]string{"c.txt", "c"}, [2]string{"d.txt", "d"}, [2]string{"e.txt", "e"}); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("uploading more files than allowed at once: %d %s", w.Code, w.Body)
+	}
+	used, err := storageUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := postFile("Second", "big.bin", string(make([]byte, 1000-used+1))); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload over the storage quota: %d %s", w.Code, w.Body)
+	}
+	if w := postFile("Second", "fits.bin", string(make([]byte, 1000-used))); w.Code != http.StatusOK {
+		t.Errorf("upload up to the storage quota: %d %s", w.Code, w.Body)
+	}
+
+	for what, w := range map[string]*httptest.ResponseRecorder{
+		"no file":     postFiles("Third"),
+		"hidden name": postFile("Third", ".htaccess", "x"),
+		"dot dot":     postFile("Third", "..", "x"),
+	} {
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("upload with %s: %d %s", what, w.Code, w.Body)
+		}
+	}
+	r := httptest.NewRequest("POST", "/upload/Third", bytes.NewReader([]byte("file=x")))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	testUpload(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("upload that isn't multipart: %d %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	testUpload(w, httptest.NewRequest("GET", "/upload/Third", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET of the upload URL: %d", w.Code)
+	}
+	if _, err := os.Stat(pageFilename("Third")); !os.IsNotExist(err) {
+		t.Errorf("refused uploads created the page: %v", err)
+	}
+	for _, title := range []string{"First", "Second"} {
+		checkConsistent(t, title)
+	}
+}
+
+func TestUploadRequestLimit(t *testing.T) {
+	savedSize, savedFiles := maxFileSize, maxUploadFiles
+	t.Cleanup(func() { maxFileSize, maxUploadFiles = savedSize, savedFiles })
+	for _, tt := range []struct{ size, files, want int64 }{
+		{100, 2, 200 + 1<<20},
+		{0, 2, math.MaxInt64},
+		{100, 0, math.MaxInt64},
+		{math.MaxInt64 / 2, 20, math.MaxInt64},
+	} {
+		maxFileSize, maxUploadFiles = tt.size, tt.files
+		if got := uploadRequestLimit(); got != tt.want {
+			t.Errorf("request limit for %d files of %d bytes = %d, want %d", tt.files, tt.size, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Re-uploading an attachment keeps the file it replaces as a version in
+// files/.versions, as <file>@<stamp> under the page's encoded path, the same
+// layout as the thumbnail cache. The stamp is when the version was replaced
+// and doubles as its ID. Up to WIKI_MAX_VERSIONS versions are kept per file
+// (0 turns versioning off). Versions are backed up with the attachments,
+// and /versions/{title}/{file}?id= downloads one or, on POST, restores it.
+
+var versionsDir = filepath.Join(filesDir, ".versions")
+
+var maxVersions = envInt("WIKI_MAX_VERSIONS", 10)
+
+// versionStampFormat is fixed width, so stamps sort by time
+const versionStampFormat = "20060102T150405.000000000Z"
+
+// AttachmentVersion is an earlier copy of an attachment
+type AttachmentVersion struct {
+	ID       string
+	Replaced time.Time
+	Size     int64
+}
+
+// versionPageDir is where the versions of title's attachments are kept
+func versionPageDir(title string) string {
+	return filepath.Join(versionsDir, filepath.FromSlash(encodeTitle(title)))
+}
+
+func versionPath(title, file, id string) string {
+	return filepath.Join(versionPageDir(title), file+"@"+id)
+}
+
+// validVersionID reports whether id is a stamp, which also keeps it from
+// naming any other path
+func validVersionID(id string) bool {
+	_, err := time.Parse(versionStampFormat, id)
+	return err == nil && len(id) == len(versionStampFormat)
+}
+
+// splitVersionName splits the name of a version into the attachment's name
+// and the version's ID. The ID is what follows the last "@" and must be a
+// stamp, so a sibling attachment such as "a.txt@2.txt" is never taken for a
+// version of "a.txt".
+func splitVersionName(name string) (file, id string, ok bool) {
+	i := strings.LastIndex(name, "@")
+	if i <= 0 || !validVersionID(name[i+1:]) {
+		return "", "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+// listVersions returns the versions of file, newest first
+func listVersions(title, file string) []AttachmentVersion {
+	entries, err := os.ReadDir(versionPageDir(title))
+	if err != nil {
+		return nil
+	}
+	var versions []AttachmentVersion
+	for _, entry := range entries {
+		name, id, ok := splitVersionName(entry.Name())
+		if !ok || name != file || entry.IsDir() {
+			continue
+		}
+		size, err := storedSize(filepath.Join(versionPageDir(title), entry.Name()))
+		if err != nil {
+			continue
+		}
+		replaced, _ := time.Parse(versionStampFormat, id)
+		versions = append(versions, AttachmentVersion{ID: id, Replaced: replaced, Size: size})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ID > versions[j].ID })
+	return versions
+}
+
+// Versions lists the earlier versions of an attachment for the view
+func (p *Page) Versions(name string) []AttachmentVersion {
+	return listVersions(p.Title, name)
+}
+
+// keepVersion preserves the current file before it is replaced and returns
+// the new version's ID, or "" when there is nothing to keep. Writes replace
+// attachments by renaming, so a hard link holds on to the old contents
+// without copying them. Callers hold the page lock.
+func keepVersion(title, file string) (string, error) {
+	if maxVersions <= 0 {
+		return "", nil
+	}
+	current := filepath.Join(pageFilesDir(title), file)
+	if _, err := os.Stat(current); os.IsNotExist(err) {
+		return "", nil
+	}
+	if err := os.MkdirAll(versionPageDir(title), 0755); err != nil {
+		return "", err
+	}
+	id := time.Now().UTC().Format(versionStampFormat)
+	if err := os.Link(current, versionPath(title, file, id)); err != nil {
+		if err := copyFileAtomic(current, versionPath(title, file, id), 0644); err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+// replacedSize is how much of the space title's attachments take goes away
+// when file is uploaded again. Without versioning that is the current file.
+// With it the current file is kept as a version, so only the oldest
+// versions pruned to make room for it go, and the current file itself only
+// while it is also linked as the newest version, as it is once keepVersion
+// has run. Sizes are as stored, like attachmentUsage counts them.
+func replacedSize(title, file string) int64 {
+	current, err := os.Stat(filepath.Join(pageFilesDir(title), file))
+	if err != nil {
+		return 0
+	}
+	if maxVersions <= 0 {
+		return current.Size()
+	}
+	var freed int64
+	kept := []int64{current.Size()}
+	for i, v := range listVersions(title, file) {
+		info, err := os.Stat(versionPath(title, file, v.ID))
+		if err != nil {
+			continue
+		}
+		if i == 0 && os.SameFile(current, info) {
+			freed, kept = current.Size(), nil
+		}
+		kept = append(kept, info.Size())
+	}
+	for _, size := range kept[min(int(maxVersions), len(kept)):] {
+		freed += size
+	}
+	return freed
+}
+
+// pruneVersions drops the oldest versions of file beyond maxVersions
+func pruneVersions(title, file string) {
+	versions := listVersions(title, file)
+	for len(versions) > int(max(maxVersions, 0)) {
+		removeVersion(title, file, versions[len(versions)-1].ID)
+		versions = versions[:len(versions)-1]
+	}
+}
+
+// removeVersion deletes one version and its backup copy, so it doesn't
+// come back on the next restore
+func removeVersion(title, file, id string) {
+	path := versionPath(title, file, id)
+	os.Remove(path)
+	if backup, ok := backupAttachmentPath(path); ok {
+		os.Remove(backup)
+	}
+}
+
+// removeVersions deletes the versions of file, or of all of the page's
+// attachments when file is empty
+func removeVersions(title, file string) {
+	entries, err := os.ReadDir(versionPageDir(title))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name, id, ok := splitVersionName(entry.Name())
+		if entry.IsDir() || !ok {
+			continue
+		}
+		if file == "" || name == file {
+			removeVersion(title, name, id)
+		}
+	}
+}
+
+// restoreVersions copies title's versions back from persistent storage.
+// Versions never change, so ones already present are left alone.
+func restoreVersions(title string) {
+	srcDir := filepath.Join(persistentDir, "files", ".versions", filepath.FromSlash(encodeTitle(title)))
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		dst := filepath.Join(versionPageDir(title), entry.Name())
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(versionPageDir(title), 0755); err != nil {
+			log.Printf("Error restoring versions for %s: %v", title, err)
+			return
+		}
+		if err := copyFile(filepath.Join(srcDir, entry.Name()), dst); err != nil {
+			log.Printf("Error restoring version %s of %s: %v", entry.Name(), title, err)
+		}
+	}
+}
+
+// versionsHandler serves /versions/{title}/{file}?id=<stamp>: GET downloads
+// that version and POST makes it the current file again, keeping the one it
+// replaces as a version in turn
+func versionsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	title, file, ok := splitTitleFile(r.URL.Path, "/versions/")
+	id := r.URL.Query().Get("id")
+	if !ok || !validVersionID(id) {
+		http.NotFound(w, r)
+		return
+	}
+	if attachmentGone(title, file) {
+		goneError(w)
+		return
+	}
+	if pageLocked(r, title) {
+		lockedError(w, r, title)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if pageProtected(title) {
+			w.Header().Set("Cache-Control", "private")
+		}
+		f, err := openStored(versionPath(title, file, id))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(f, head)
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		setAttachmentHeaders(w, file, attachmentContentType(file, head[:n]))
+		http.ServeContent(w, r, file, info.ModTime(), f)
+
+	case "POST":
+		err := storeAttachment(title, file, time.Time{}, func(path string) error {
+			src, err := openStored(versionPath(title, file, id))
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			return writeAttachment(title, path, src)
+		})
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			uploadError(w, err, http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/view/"+title, http.StatusFound)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
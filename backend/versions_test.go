@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestSiblingNamesWithAt checks that the versions and thumbnails of a.png
+// are told apart from those of its sibling a.png@2.png
+func TestSiblingNamesWithAt(t *testing.T) {
+	testWiki(t)
+	title := "Gallery"
+	stamp := func(d time.Duration) string {
+		return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC).Add(d).Format(versionStampFormat)
+	}
+	touch := func(path string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	touch(versionPath(title, "a.png", stamp(0)))
+	touch(versionPath(title, "a.png@2.png", stamp(time.Second)))
+	touch(thumbPath(title, "a.png", 128))
+	touch(thumbPath(title, "a.png@2.png", 128))
+	touch(thumbPath(title, "a.png@2.png", 256))
+
+	ids := func(file string) []string {
+		var ids []string
+		for _, v := range listVersions(title, file) {
+			ids = append(ids, v.ID)
+		}
+		return ids
+	}
+	if got := ids("a.png"); !slices.Equal(got, []string{stamp(0)}) {
+		t.Errorf("versions of a.png = %q", got)
+	}
+	if got := ids("a.png@2.png"); !slices.Equal(got, []string{stamp(time.Second)}) {
+		t.Errorf("versions of a.png@2.png = %q", got)
+	}
+
+	removeVersions(title, "a.png")
+	removeThumbnails(title, "a.png")
+	for _, path := range []string{versionPath(title, "a.png", stamp(0)), thumbPath(title, "a.png", 128)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was kept", path)
+		}
+	}
+	for _, path := range []string{versionPath(title, "a.png@2.png", stamp(time.Second)), thumbPath(title, "a.png@2.png", 128), thumbPath(title, "a.png@2.png", 256)} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s went with a.png: %v", path, err)
+		}
+	}
+}
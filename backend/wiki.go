@@ -2,6 +2,8 @@ package main
 
 import (
 	//"fmt"
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
@@ -21,18 +23,51 @@ type Page struct {
   Title string
   Body []byte // byte slice. what is expected by the io lib
   Files []string // Array of file names associated with this page
+  Meta PageMeta // Tags, timestamps and other metadata from the .meta.json sidecar
+  Share string // Share token the page is being viewed with, not saved
 }
 
-// For the index page to display all available pages
+// For the index page to display the pages and sub-namespaces of one namespace
 type IndexPage struct {
-  Pages []string // List of page titles
+  Namespace string // Namespace being listed, "" for the top level
+  Crumbs []Crumb // Breadcrumb trail leading to Namespace
+  Tag string // When set, only pages with this tag are listed
+  Filter string // When set, only titles containing this text are listed
+  Namespaces []IndexEntry // Child namespaces
+  Pages []IndexEntry // Pages directly inside Namespace, one page of results
+  Total int // Number of matching pages across all result pages
+  PageNum int
+  PageCount int
+  SortLinks []SortLink
+  PrevURL string // Links to the neighbouring result pages, "" at either end
+  NextURL string
+}
+
+// SortLink switches the index to another sort order
+type SortLink struct {
+  Label string
+  URL string
+  Active bool
+}
+
+// IndexEntry is a single link on the index page
+type IndexEntry struct {
+  Title string `json:"title"` // Full slash-separated path
+  Name string `json:"name"` // Last path segment, shown as the link text
+  Tags []string `json:"tags,omitempty"`
+  Pinned bool `json:"pinned,omitempty"`
+  Size int64 `json:"size"`
+  Created time.Time `json:"created"`
+  Modified time.Time `json:"modified"`
+  Expires time.Time `json:"expires,omitzero"`
 }
 
 // GLOBAL VARIABLES
-var templates = template.Must(template.ParseFiles("edit.html", "view.html", "index.html"))
-var validPath = regexp.MustCompile("^/(edit|save|view|upload|delete|delete-file)/([a-zA-Z0-9-]+)$")
+var templates = template.Must(template.ParseFiles("edit.html", "view.html", "index.html", "preview.html", "burn.html", "unlock.html"))
+var validPath = regexp.MustCompile("^/(edit|save|view|raw|unlock|upload|delete|delete-file|events|collab|tus)/(.+)$")
 var filesDir = "./files" // Directory to store uploaded files
 var persistentDir = "/app/persistence" // Directory to store persistent storage
+var filesListSeparator = regexp.MustCompile(`\r?\n`) // Line breaks in .files.txt
 
 // enableCORS adds CORS headers to allow requests from the frontend
 func enableCORS(w http.ResponseWriter) {
@@ -53,6 +88,29 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// adminToken guards the maintenance endpoints (/api/fsck, /api/rekey); they
+// are off while it is unset
+var adminToken = envString("WIKI_ADMIN_TOKEN", "")
+
+// requireAdmin lets a request through to next only when it carries
+// "Authorization: Bearer <WIKI_ADMIN_TOKEN>"
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		enableCORS(w)
+		if adminToken == "" {
+			http.Error(w, "Maintenance endpoints are off; set WIKI_ADMIN_TOKEN to use them", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="wiki maintenance"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
 /*
 func handler(w http.ResponseWriter, r *http.Request) {
   fmt.Fprintf(w, "Hi there, I love %s!", r.URL.Path[1:]) //slicing drops the leading /
@@ -65,7 +123,12 @@ func getTitle(w http.ResponseWriter, r *http.Request) (string, error) {
     http.NotFound(w, r)
     return "", errors.New("invalid Page Title")
   }
-  return m[2], nil // the title is the second subexpression.
+  title, err := normalizeTitle(m[2]) // the title is the second subexpression.
+  if err != nil {
+    http.NotFound(w, r)
+    return "", err
+  }
+  return title, nil
 }
 
 
@@ -89,18 +152,49 @@ func makeHandler(fn func (http.ResponseWriter, *http.Request, string)) http.Hand
       http.NotFound(w, r)
       return
     }
-    fn(w, r, m[2])
+    title, err := normalizeTitle(m[2])
+    if err != nil {
+      http.NotFound(w, r)
+      return
+    }
+    // Send browsers to the canonical spelling so each page has one URL
+    if title != m[2] && r.Method == "GET" {
+      http.Redirect(w, r, "/"+m[1]+"/"+title, http.StatusFound)
+      return
+    }
+    // An expired page is gone, though it can be written again from scratch
+    if pageGone(title) && !createsPage[m[1]] {
+      goneError(w)
+      return
+    }
+    // A page with a password needs it entered first, at /unlock/
+    if m[1] != "unlock" && pageLocked(r, title) {
+      lockedError(w, r, title)
+      return
+    }
+    fn(w, r, title)
   }
 }
 
 
+// createsPage are the routes that may create a page, including one that
+// has expired
+var createsPage = map[string]bool{"edit": true, "save": true, "upload": true, "tus": true}
+
 func viewHandler(w http.ResponseWriter,r *http.Request, title string) {
   /* transcended with the closures
   title, err := getTitle(w, r)
   if err != nil {
     return
   }*/
+  unlock := pageLocks.RLock(title)
   p, err := loadPage(title)
+  unlock()
+  // A burn-after-reading page read by someone else meanwhile is gone
+  if err != nil && pageGone(title) {
+    goneError(w)
+    return
+  }
   if err != nil {
     http.Redirect(w, r, "/edit/"+title, http.StatusFound)
     return
@@ -109,10 +203,45 @@ func viewHandler(w http.ResponseWriter,r *http.Request, title string) {
   title := r.URL.Path[len("/view/"):]
   p, _ := loadPage(title)
   */
+  if _, ok := sharedLink(r); ok {
+    p.Share = r.URL.Query().Get("share")
+  }
+  if p.Meta.BurnAfterReading {
+    serveBurnPage(w, r, p, false)
+    return
+  }
   renderTemplate(w, "view", p)
   //fmt.Fprintf(w, "<h1>%s</h1><div>%s</div>", p.Title, p.Body)
 }
 
+// rawHandler serves just the page body as plain text, for scripts and
+// phones
+func rawHandler(w http.ResponseWriter, r *http.Request, title string) {
+  unlock := pageLocks.RLock(title)
+  p, err := loadPage(title)
+  unlock()
+  if err != nil && pageGone(title) {
+    goneError(w)
+    return
+  }
+  if err != nil {
+    http.NotFound(w, r)
+    return
+  }
+  if p.Meta.BurnAfterReading {
+    serveBurnPage(w, r, p, true)
+    return
+  }
+  serveRaw(w, p)
+}
+
+// serveRaw writes the body of p as plain text
+func serveRaw(w http.ResponseWriter, p *Page) {
+  w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+  w.Header().Set("X-Content-Type-Options", "nosniff")
+  w.Write(p.Body)
+}
+
 func editHandler(w http.ResponseWriter, r *http.Request, title string) {
   /* same regex error handling as in other handlers.
   title := r.URL.Path[len("/edit/"):]
@@ -123,7 +252,9 @@ func editHandler(w http.ResponseWriter, r *http.Request, title string) {
   if err != nil {
     return
   }*/
+  unlock := pageLocks.RLock(title)
   p, err := loadPage(title)
+  unlock()
   if err != nil {
     p = &Page{Title: title}
   }
@@ -150,24 +281,98 @@ func saveHandler(w http.ResponseWriter, r *http.Request, title string) {
   }*/
   //title := r.URL.Path[len("/save/"):]
   body := r.FormValue("body")
-  p, err := loadPage(title)
+  // The editor doesn't show burn-after-reading text, so leaving it empty
+  // keeps what is there
+  var newBody []byte
+  if body != "" || r.FormValue("keep_body") == "" {
+    newBody = []byte(body)
+  }
+  // Encrypted pages only take ciphertext. The edit form says whether the
+  // page is encrypted; other saves keep what it was.
+  encrypted := r.FormValue("encrypted") != ""
+  if r.FormValue("meta") == "" {
+    encrypted = isEncrypted(title)
+  }
+  if encrypted && !validCiphertext(newBody) {
+    http.Error(w, errNotCiphertext.Error(), http.StatusBadRequest)
+    return
+  }
+  // A new password is hashed before taking the page lock, as that is slow
+  var password *PagePassword
+  if pw := r.FormValue("password"); pw != "" {
+    var err error
+    if password, err = hashPassword(pw); err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+  }
+  // expires_in sets a new lifetime, "never" removes it and leaving it out
+  // keeps the current one
+  expires, err := expiryFor(r.FormValue("expires_in"))
   if err != nil {
-    p = &Page{Title: title, Body: []byte(body)}
-  } else {
-    p.Body = []byte(body)
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
   }
-  err = p.save()
+  err = savePageBody(title, newBody, func(p *Page) {
+    applyMetaForm(r, &p.Meta)
+    if !expires.IsZero() || r.FormValue("expires_in") == "never" {
+      p.Meta.Expires = expires
+    }
+    if password != nil {
+      p.Meta.Password = password
+    } else if r.FormValue("remove_password") != "" {
+      p.Meta.Password = nil
+    }
+  })
   if err != nil {
       http.Error(w, err.Error(), http.StatusInternalServerError)
       return
   }
-  
-  // Immediately back up the file after saving
-  go BackupWikiFiles()
+
+  // Whoever sets the password doesn't have to enter it straight away
+  if password != nil {
+    if err := setUnlockCookie(w, r, title, password); err != nil {
+      log.Printf("Error unlocking %s after setting its password: %v", title, err)
+    }
+  }
+
+  // Bring anyone collaboratively editing the page up to date with this save
+  if newBody != nil {
+    collabs.reset(title, body)
+  }
   
   http.Redirect(w, r, "/view/"+title, http.StatusFound)
 }
 
+// savePageBody is the save path shared by the edit form and collaborative
+// editing. It replaces the page body, lets update adjust anything else,
+// saves, backs up and notifies event listeners. A nil body keeps the
+// current one.
+func savePageBody(title string, body []byte, update func(*Page)) error {
+  // Serialize this load-modify-save with other writers of the page
+  unlock := pageLocks.Lock(title)
+  defer unlock()
+
+  p, err := loadPage(title)
+  if err != nil {
+    p = &Page{Title: title}
+  }
+  if body != nil {
+    p.Body = body
+  }
+  if update != nil {
+    update(p)
+  }
+  if err := p.save(); err != nil {
+    return err
+  }
+  
+  // Immediately back up the file after saving
+  backupInBackground()
+  events.publish(eventSave, title, "")
+  return nil
+}
+
 // uploadHandler handles file uploads for a specific page
 func uploadHandler(w http.ResponseWriter, r *http.Request, title string) {
   if r.Method != "POST" {
@@ -175,67 +380,216 @@ func uploadHandler(w http.ResponseWriter, r *http.Request, title string) {
     return
   }
 
-  // Ensure files directory exists
-  pageDirPath := filepath.Join(filesDir, title)
-  if err := os.MkdirAll(pageDirPath, 0755); err != nil {
-    http.Error(w, err.Error(), http.StatusInternalServerError)
+  // Stream the form part by part instead of buffering it, so each file
+  // goes straight to disk and is cut off as soon as it passes a limit
+  r.Body = http.MaxBytesReader(w, r.Body, uploadRequestLimit())
+  reader, err := r.MultipartReader()
+  if err != nil {
+    http.Error(w, "Error reading upload: "+err.Error(), http.StatusBadRequest)
     return
   }
 
-  // Parse multipart form, 10 << 20 specifies maximum upload of 10 MB files
-  r.ParseMultipartForm(10 << 20)
-  
-  // Get file from form
-  file, handler, err := r.FormFile("file")
+  // Attachments expire when asked for in the query or in an expires_in
+  // field placed before the files
+  expires, err := expiryFor(r.URL.Query().Get("expires_in"))
   if err != nil {
-    http.Error(w, "Error retrieving file: "+err.Error(), http.StatusBadRequest)
+    http.Error(w, err.Error(), http.StatusBadRequest)
     return
   }
-  defer file.Close()
 
-  // Create file in the server
-  filePath := filepath.Join(pageDirPath, handler.Filename)
-  dst, err := os.Create(filePath)
-  if err != nil {
-    http.Error(w, err.Error(), http.StatusInternalServerError)
+  // The browser encrypts each file of an encrypted page, so there is
+  // nothing to strip and no folder to zip
+  encrypted := isEncrypted(title)
+
+  // A dropped or selected folder is kept together as one zip archive
+  if r.URL.Query().Get("folder") == "zip" {
+    if encrypted {
+      http.Error(w, errEncryptedPage.Error(), http.StatusBadRequest)
+      return
+    }
+    name, err := storeFolderZip(title, reader, r.URL.Query().Get("name"), expires)
+    if err != nil {
+      uploadError(w, err, http.StatusInternalServerError)
+      return
+    }
+    fmt.Fprintf(w, "Folder uploaded as %s", name)
     return
   }
-  defer dst.Close()
 
-  // Copy file contents
-  if _, err := io.Copy(dst, file); err != nil {
-    http.Error(w, err.Error(), http.StatusInternalServerError)
+  // Metadata is kept when asked for in the query or in a keep_metadata
+  // field placed before the files
+  keepMetadata := encrypted || !stripUploadMetadata || r.URL.Query().Get("keep_metadata") != ""
+
+  var stored []string
+  for {
+    part, err := reader.NextPart()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      uploadError(w, err, http.StatusBadRequest)
+      return
+    }
+    if part.FormName() == "keep_metadata" {
+      value, _ := io.ReadAll(io.LimitReader(part, 16))
+      keepMetadata = keepMetadata || len(value) > 0
+      part.Close()
+      continue
+    }
+    if part.FormName() == "expires_in" {
+      if expires, err = readExpiryField(part); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+      }
+      continue
+    }
+    if part.FormName() != "file" || part.FileName() == "" {
+      part.Close()
+      continue
+    }
+    if int64(len(stored)) >= maxUploadFiles {
+      part.Close()
+      http.Error(w, fmt.Sprintf("At most %d files can be uploaded at once", maxUploadFiles), http.StatusRequestEntityTooLarge)
+      return
+    }
+
+    filename, ok := cleanAttachmentName(part.FileName())
+    if !ok {
+      part.Close()
+      uploadError(w, errBadFileName, http.StatusBadRequest)
+      return
+    }
+
+    // Copy file contents into place on the server without exposing a partial file
+    src := io.ReadCloser(part)
+    if !keepMetadata {
+      src = withoutMetadata(part)
+    }
+    err = storeAttachment(title, filename, expires, func(filePath string) error {
+      return writeAttachment(title, filePath, src)
+    })
+    src.Close()
+    part.Close()
+    if err != nil {
+      uploadError(w, err, http.StatusInternalServerError)
+      return
+    }
+    stored = append(stored, filename)
+  }
+  if len(stored) == 0 {
+    uploadError(w, errNoFiles, http.StatusBadRequest)
     return
   }
 
+  w.WriteHeader(http.StatusOK)
+  if len(stored) == 1 {
+    w.Write([]byte("File uploaded successfully"))
+  } else {
+    fmt.Fprintf(w, "%d files uploaded successfully", len(stored))
+  }
+}
+
+// cleanAttachmentName reduces an uploaded file name to a plain name inside
+// the page's directory. Hidden names are refused: dot-files are reserved
+// for temporary files and are not backed up.
+func cleanAttachmentName(name string) (string, bool) {
+  name = filepath.Base(filepath.FromSlash(strings.ReplaceAll(name, "\\", "/")))
+  if name == "." || name == ".." || name == string(filepath.Separator) || strings.HasPrefix(name, ".") {
+    return "", false
+  }
+  return name, true
+}
+
+// storeAttachment is where every kind of upload ends. place writes the file
+// to a path in the staging area with no lock held, so a slow upload doesn't
+// hold up everyone reading the page. Then, with the page locked, the file
+// is checked against the limits again, moved into the page's directory and
+// added to the page's Files (creating the page if needed), and the page is
+// saved, backed up and event listeners notified. A non-zero expires sets
+// when the file expires.
+func storeAttachment(title, filename string, expires time.Time, place func(path string) error) error {
+  // Each upload gets a directory of its own, so the staged file already
+  // has its final name
+  if err := os.MkdirAll(stagingDir, 0755); err != nil {
+    return err
+  }
+  staging, err := os.MkdirTemp(stagingDir, "")
+  if err != nil {
+    return err
+  }
+  defer os.RemoveAll(staging)
+  stagedPath := filepath.Join(staging, filename)
+  if err := place(stagedPath); err != nil {
+    return err
+  }
+  attachment, err := detectAttachment(stagedPath)
+  if err != nil {
+    return err
+  }
+  attachment.Expires = expires
+
+  // Hold the page's lock from replacing the file until the Files list is saved
+  unlock := pageLocks.Lock(title)
+  defer unlock()
+
+  // Other uploads may have used up the limits in the meantime
+  allowance, limitErr, err := attachmentAllowance(title, filename)
+  if err != nil {
+    return err
+  }
+  if attachment.Size > allowance {
+    return limitErr
+  }
+
+  // Ensure files directory exists
+  pageDirPath := pageFilesDir(title)
+  if err := os.MkdirAll(pageDirPath, 0755); err != nil {
+    return err
+  }
+  filePath := filepath.Join(pageDirPath, filename)
+  version, err := keepVersion(title, filename)
+  if err != nil {
+    return err
+  }
+  if err := os.Rename(stagedPath, filePath); err != nil {
+    if version != "" {
+      removeVersion(title, filename, version)
+    }
+    return err
+  }
+  syncDir(pageDirPath)
+  pruneVersions(title, filename)
+
   // Update page to include the file
   p, err := loadPage(title)
   if err != nil {
-    p = &Page{Title: title, Body: []byte{}, Files: []string{handler.Filename}}
+    p = &Page{Title: title, Body: []byte{}, Files: []string{filename}}
   } else {
     // Check if file is already in the list
     found := false
     for _, f := range p.Files {
-      if f == handler.Filename {
+      if f == filename {
         found = true
         break
       }
     }
     if !found {
-      p.Files = append(p.Files, handler.Filename)
+      p.Files = append(p.Files, filename)
     }
   }
-  err = p.save()
-  if err != nil {
-    http.Error(w, err.Error(), http.StatusInternalServerError)
-    return
+  if p.Meta.Attachments == nil {
+    p.Meta.Attachments = make(map[string]AttachmentMeta)
+  }
+  p.Meta.Attachments[filename] = attachment
+  if err := p.save(); err != nil {
+    return err
   }
+  unbury(title, filename)
   
   // Immediately back up the files after uploading
-  go BackupWikiFiles()
-
-  w.WriteHeader(http.StatusOK)
-  w.Write([]byte("File uploaded successfully"))
+  backupInBackground()
+  events.publish(eventUpload, title, filename)
+  return nil
 }
 
 // apiGetPageHandler returns page content as JSON
@@ -246,15 +600,66 @@ func apiGetPageHandler(w http.ResponseWriter, r *http.Request) {
     http.Error(w, "Missing title parameter", http.StatusBadRequest)
     return
   }
+  title, err := normalizeTitle(title)
+  if err != nil {
+    http.Error(w, "Invalid title parameter", http.StatusBadRequest)
+    return
+  }
+  if pageGone(title) {
+    goneError(w)
+    return
+  }
+  if pageLocked(r, title) {
+    lockedError(w, r, title)
+    return
+  }
 
+  unlock := pageLocks.RLock(title)
   p, err := loadPage(title)
+  unlock()
   if err != nil {
     p = &Page{Title: title}
   }
+  if p.Meta.BurnAfterReading {
+    http.Error(w, errReadOnce.Error(), http.StatusForbidden)
+    return
+  }
+
+  files := p.Files
+  if files == nil {
+    files = []string{}
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(struct {
+    Title string `json:"title"`
+    Body string `json:"body"`
+    Files []string `json:"files"`
+    PublicMeta
+  }{p.Title, string(p.Body), files, p.Meta.Public()})
+}
+
+// apiListPagesHandler returns the pages of a namespace as JSON. It takes
+// the same ?ns=, ?q=, ?tag=, ?sort=, ?order=, ?page= and ?per_page=
+// parameters as the index page.
+func apiListPagesHandler(w http.ResponseWriter, r *http.Request) {
+  enableCORS(w)
+  indexPage, err := buildIndex(parseIndexQuery(r.URL.Query()))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
 
+  pages := indexPage.Pages
+  if pages == nil {
+    pages = []IndexEntry{}
+  }
   w.Header().Set("Content-Type", "application/json")
-  w.Write([]byte(`{"title":"` + p.Title + `","body":"` + string(p.Body) + `","files":["` + 
-    join(p.Files, `","`) + `"]}`))
+  json.NewEncoder(w).Encode(struct {
+    Total int `json:"total"`
+    Page int `json:"page"`
+    PageCount int `json:"page_count"`
+    Pages []IndexEntry `json:"pages"`
+  }{indexPage.Total, indexPage.PageNum, indexPage.PageCount, pages})
 }
 
 // Helper function to join strings with a separator
@@ -270,36 +675,57 @@ func join(s []string, sep string) string {
 }
 
 func (p *Page) save() error {
-  filename := p.Title + ".txt"
-  
-  // Write page data
-  err := os.WriteFile(filename, p.Body, 0600)
-  if err != nil {
-    return err
+  filename := pageFilename(p.Title)
+
+  // Stamp the metadata before writing it alongside the body
+  now := time.Now()
+  if p.Meta.Created.IsZero() {
+    p.Meta.Created = now
   }
-  
-  // Write files list if there are any
-  if len(p.Files) > 0 {
-    filesListFilename := p.Title + ".files.txt"
-    filesContent := join(p.Files, "\n")
-    err = os.WriteFile(filesListFilename, []byte(filesContent), 0600)
-    if err != nil {
+  p.Meta.Updated = now
+  if p.Meta.ContentType == "" {
+    p.Meta.ContentType = defaultContentType
+  }
+
+  // Namespaced pages live in nested directories
+  if dir := filepath.Dir(filename); dir != "." {
+    if err := os.MkdirAll(dir, 0755); err != nil {
       return err
     }
   }
   
+  // Write body, files list and metadata as one crash-safe unit
+  if err := commitPage(p); err != nil {
+    return err
+  }
+  
+  // Keep the index listing and the page cache in step with the disk
+  catalog.refresh(p.Title)
+  cache.put(p)
+  unbury(p.Title, "")
   return nil
 }
 
+// loadPage reads a page, restoring it from persistent storage if needed.
+// Callers should hold the page's lock in pageLocks.
 func loadPage(title string) (*Page, error) {
-  filename := title + ".txt"
-  body, err := os.ReadFile(filename)
+  if p, ok := cache.get(title); ok {
+    return p, nil
+  }
+
+  filename := pageFilename(title)
+  body, err := readStored(filename)
   if err != nil {
+    // A page that was just burnt or reaped stays gone, even if a backup
+    // run still had it in flight
+    if buried(title, "") {
+      return nil, err
+    }
     // Try to restore from persistent storage if file not found
     restoreErr := RestoreWikiFile(title)
     if restoreErr == nil {
       // Successfully restored, try reading again
-      body, err = os.ReadFile(filename)
+      body, err = readStored(filename)
       if err != nil {
         return nil, err
       }
@@ -309,47 +735,64 @@ func loadPage(title string) (*Page, error) {
   }
   
   // Load files list if it exists
-  filesListFilename := title + ".files.txt"
   var files []string
-  filesContent, err := os.ReadFile(filesListFilename)
+  filesContent, err := readStored(filesListFilename(title))
   if err == nil && len(filesContent) > 0 {
-    files = regexp.MustCompile(`\r?\n`).Split(string(filesContent), -1)
+    for _, f := range filesListSeparator.Split(string(filesContent), -1) {
+      if f != "" {
+        files = append(files, f)
+      }
+    }
   }
   
-  return &Page{Title: title, Body: body, Files: files}, nil
+  restoreMeta(title)
+  // Metadata that can't be decrypted mustn't pass for a page without a
+  // password
+  if _, err := readStored(metaFilename(title)); err != nil && !os.IsNotExist(err) {
+    return nil, err
+  }
+  p := &Page{Title: title, Body: body, Files: files, Meta: loadMeta(title)}
+  cache.put(p)
+  return p, nil
 }
 
+// getAllPages returns the titles of every page, including those in nested
+// namespaces, newest first
 func getAllPages() []string {
-  // Get all .txt files (wiki pages)
-  files, err := filepath.Glob("*.txt")
-  if err != nil {
-    return []string{}
-  }
-  
   // Create a slice to store file info for sorting
   type fileInfo struct {
     name    string
     modTime time.Time
   }
   
-  fileInfos := make([]fileInfo, 0, len(files))
+  var fileInfos []fileInfo
   
-  // Extract titles and get modification time for each file
-  for _, file := range files {
-    // Skip .files.txt metafiles
-    if !strings.HasSuffix(file, ".files.txt") {
-      info, err := os.Stat(file)
-      if err != nil {
-        continue
+  // Walk the working directory for page bodies, descending into namespaces
+  filepath.WalkDir(".", func(path string, d os.DirEntry, err error) error {
+    if err != nil {
+      return nil
+    }
+    if d.IsDir() {
+      // Skip the app's own directories (uploads, icons, persistence)
+      if path != "." && (reservedNamespaces[path] || !isEncodedSegment(d.Name())) {
+        return filepath.SkipDir
       }
-      
-      title := strings.TrimSuffix(file, ".txt")
-      fileInfos = append(fileInfos, fileInfo{
-        name:    title,
-        modTime: info.ModTime(),
-      })
+      return nil
     }
-  }
+    title, ok := titleFromFilename(path)
+    if !ok {
+      return nil
+    }
+    info, err := d.Info()
+    if err != nil {
+      return nil
+    }
+    fileInfos = append(fileInfos, fileInfo{
+      name:    title,
+      modTime: info.ModTime(),
+    })
+    return nil
+  })
   
   // Sort files by modification time (newest first)
   sort.Slice(fileInfos, func(i, j int) bool {
@@ -371,41 +814,162 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
     return
   }
   
-  // Get all available pages
-  pages := getAllPages()
-  indexPage := &IndexPage{Pages: pages}
+  // ?ns= selects the namespace to list; ?q=, ?tag=, ?sort= and ?page= refine it
+  indexPage, err := buildIndex(parseIndexQuery(r.URL.Query()))
+  if err != nil {
+    http.NotFound(w, r)
+    return
+  }
   
-  err := templates.ExecuteTemplate(w, "index.html", indexPage)
+  err = templates.ExecuteTemplate(w, "index.html", indexPage)
   if err != nil {
     http.Error(w, err.Error(), http.StatusInternalServerError)
   }
 }
 
+// tagHandler lists every page carrying the tag named in /tag/{name}
+func tagHandler(w http.ResponseWriter, r *http.Request) {
+  enableCORS(w)
+  tag := strings.TrimPrefix(r.URL.Path, "/tag/")
+  if _, ok := normalizeTag(tag); !ok {
+    http.NotFound(w, r)
+    return
+  }
+  
+  q := parseIndexQuery(r.URL.Query())
+  q.Tag = tag
+  indexPage, err := buildIndex(q)
+  if err != nil {
+    http.NotFound(w, r)
+    return
+  }
+  
+  err = templates.ExecuteTemplate(w, "index.html", indexPage)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+  }
+}
+
+// buildIndex lists the namespace q.Namespace from the page catalog. Without
+// a text or tag filter the pages directly inside it are returned along with
+// its sub-namespaces; with one, every matching page below it is returned.
+func buildIndex(q indexQuery) (*IndexPage, error) {
+  if q.Namespace != "" {
+    var err error
+    if q.Namespace, err = normalizeTitle(q.Namespace); err != nil {
+      return nil, err
+    }
+  }
+  if q.Tag != "" {
+    var ok bool
+    if q.Tag, ok = normalizeTag(q.Tag); !ok {
+      return nil, errors.New("invalid tag")
+    }
+  }
+  
+  entries, total, children := catalog.query(q)
+  indexPage := &IndexPage{
+    Namespace: q.Namespace,
+    Crumbs: breadcrumbs(q.Namespace),
+    Tag: q.Tag,
+    Filter: q.Filter,
+    Total: total,
+    PageNum: q.Page,
+    PageCount: (total + q.PerPage - 1) / q.PerPage,
+  }
+  
+  prefix := ""
+  if q.Namespace != "" {
+    prefix = q.Namespace + "/"
+  }
+  for _, child := range children {
+    indexPage.Namespaces = append(indexPage.Namespaces, IndexEntry{Title: prefix + child, Name: child})
+  }
+  for _, entry := range entries {
+    indexPage.Pages = append(indexPage.Pages, IndexEntry{
+      Title: entry.Title,
+      Name: strings.TrimPrefix(entry.Title, prefix),
+      Tags: entry.Tags,
+      Pinned: entry.Pinned,
+      Size: entry.Size,
+      Created: entry.Created,
+      Modified: entry.Modified,
+      Expires: entry.Expires,
+    })
+  }
+  
+  // Sort links reset to the first result page; clicking the active one flips the order
+  for _, key := range []string{sortModified, sortCreated, sortName, sortSize} {
+    link := q
+    link.Sort, link.Page = key, 1
+    link.Desc = key != sortName
+    if key == q.Sort {
+      link.Desc = !q.Desc
+    }
+    indexPage.SortLinks = append(indexPage.SortLinks, SortLink{Label: key, URL: "/?" + link.values().Encode(), Active: key == q.Sort})
+  }
+  if q.Page > 1 {
+    prev := q
+    prev.Page--
+    indexPage.PrevURL = "/?" + prev.values().Encode()
+  }
+  if q.Page < indexPage.PageCount {
+    next := q
+    next.Page++
+    indexPage.NextURL = "/?" + next.values().Encode()
+  }
+  
+  return indexPage, nil
+}
+
 // deleteHandler handles the deletion of a wiki page
 func deleteHandler(w http.ResponseWriter, r *http.Request, title string) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if err := deletePage(title); err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting page: %v", err), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
 
+// deletePage removes a page, its attachments and everything kept about
+// them, here and in persistent storage. It is shared by the delete button
+// and the expiry reaper.
+func deletePage(title string) error {
+	// Close any collaborative session first so it can't save the page back
+	collabs.drop(title)
+
+	unlock := pageLocks.Lock(title)
+	defer unlock()
+	return removePage(title)
+}
+
+// removePage does the work of deletePage for callers that already hold the
+// page's lock
+func removePage(title string) error {
 	// Delete the main text file
-	filename := title + ".txt"
+	filename := pageFilename(title)
 	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
-		http.Error(w, fmt.Sprintf("Error deleting page: %v", err), http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	// Delete files list if it exists
-	filesListFilename := title + ".files.txt"
+	// Delete files list and metadata if they exist
+	filesListFilename := filesListFilename(title)
 	os.Remove(filesListFilename) // Ignore errors as the file might not exist
+	metaFilename := metaFilename(title)
+	os.Remove(metaFilename)
 
-	// Delete the files directory if it exists
-	pageDirPath := filepath.Join(filesDir, title)
-	if _, err := os.Stat(pageDirPath); err == nil {
-		if err := os.RemoveAll(pageDirPath); err != nil {
-			log.Printf("Error removing files directory for %s: %v", title, err)
-		}
+	// Delete the page's attachments. Sub-directories belong to pages nested
+	// below this one, so only the files themselves are removed.
+	pageDirPath := pageFilesDir(title)
+	if err := removeAttachmentDir(pageDirPath); err != nil {
+		log.Printf("Error removing files directory for %s: %v", title, err)
 	}
+	removeThumbnails(title, "")
+	removeVersions(title, "")
 
 	// Also remove from persistence if possible
 	persistentPath := filepath.Join(persistentDir, filename)
@@ -413,11 +977,55 @@ func deleteHandler(w http.ResponseWriter, r *http.Request, title string) {
 	
 	persistentFilesList := filepath.Join(persistentDir, filesListFilename)
 	os.Remove(persistentFilesList) // Ignore errors
+	os.Remove(filepath.Join(persistentDir, metaFilename)) // Ignore errors
 	
-	persistentFilesDir := filepath.Join(persistentDir, "files", title)
-	os.RemoveAll(persistentFilesDir) // Ignore errors
+	persistentFilesDir, _ := backupAttachmentPath(pageDirPath)
+	removeAttachmentDir(persistentFilesDir) // Ignore errors
 
-	http.Redirect(w, r, "/", http.StatusFound)
+	catalog.remove(title)
+	cache.invalidate(title)
+
+	// Drop namespace directories the page leaves empty
+	removeEmptyParents(filename, ".")
+	removeEmptyParents(persistentPath, persistentDir)
+	removeEmptyParents(pageDirPath, filesDir)
+	removeEmptyParents(persistentFilesDir, filepath.Join(persistentDir, "files"))
+
+	events.publish(eventPageDelete, title, "")
+	return nil
+}
+
+// removeAttachmentDir deletes the regular files in dir and then dir itself
+// if nothing else (such as a nested page's directory) is left inside it
+func removeAttachmentDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	os.Remove(dir) // Fails harmlessly while nested pages still have files
+	return nil
+}
+
+// removeEmptyParents removes the now-empty namespace directories above
+// path, stopping at root
+func removeEmptyParents(path, root string) {
+	root = filepath.Clean(root)
+	for dir := filepath.Dir(path); dir != root && dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
 }
 
 // deleteFileHandler handles the deletion of a specific file attachment
@@ -433,18 +1041,38 @@ func deleteFileHandler(w http.ResponseWriter, r *http.Request, title string) {
 		return
 	}
 
-	// First, remove the file from the filesystem
-	filePath := filepath.Join(filesDir, title, fileName)
-	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+	if err := deleteAttachment(title, fileName); os.IsNotExist(err) {
+		// The page itself is gone
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
 		http.Error(w, fmt.Sprintf("Error deleting file: %v", err), http.StatusInternalServerError)
 		return
 	}
+	http.Redirect(w, r, "/view/"+title, http.StatusFound)
+}
+
+// deleteAttachment removes one attachment of a page along with its
+// thumbnails, versions and backup copy
+func deleteAttachment(title, fileName string) error {
+	unlock := pageLocks.Lock(title)
+	defer unlock()
+
+	// First, remove the file from the filesystem
+	filePath := filepath.Join(pageFilesDir(title), filepath.Base(fileName))
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if backup, ok := backupAttachmentPath(filePath); ok {
+		os.Remove(backup)
+	}
+	removeThumbnails(title, filepath.Base(fileName))
+	removeVersions(title, filepath.Base(fileName))
 
 	// Then, update the page's files list
 	p, err := loadPage(title)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	// Remove the file from the Files slice
@@ -455,17 +1083,17 @@ func deleteFileHandler(w http.ResponseWriter, r *http.Request, title string) {
 		}
 	}
 	p.Files = updatedFiles
+	delete(p.Meta.Attachments, fileName)
 
 	// Save the updated page
 	if err := p.save(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	// Immediately back up the files after deletion
-	go BackupWikiFiles()
-
-	http.Redirect(w, r, "/view/"+title, http.StatusFound)
+	backupInBackground()
+	events.publish(eventFileDelete, title, fileName)
+	return nil
 }
 
 func main() {
@@ -473,13 +1101,32 @@ func main() {
   if err := os.MkdirAll(filesDir, 0755); err != nil {
     log.Fatal(err)
   }
+  // Uploads cut off by the last shutdown are of no use
+  os.RemoveAll(stagingDir)
+
+  // Load the at-rest encryption keys before anything is read from disk
+  if err := loadKeyring(); err != nil {
+    log.Fatal(err)
+  }
 
   // Set up file watcher to periodically backup wiki files
   SetupFileWatcher()
 
+  // Load every page into the in-memory catalog that serves the index
+  catalog.rebuild()
+
+  // Check attachments against their digests and the backup in the
+  // background. Repairs are left to POST /api/fsck.
+  go logFsck()
+
+  // Delete expired pages and attachments as their time comes
+  startReaper()
+
   // Set up static file server for uploaded files
-  fileServer := http.FileServer(http.Dir(filesDir))
-  http.Handle("/files/", http.StripPrefix("/files/", corsMiddleware(fileServer)))
+  http.HandleFunc("/files/", checkShare(filesHandler))
+  http.HandleFunc("/thumb/", thumbHandler)
+  http.HandleFunc("/preview/", previewHandler)
+  http.HandleFunc("/versions/", versionsHandler)
 
   // Set up static file server for icon files
   iconServer := http.FileServer(http.Dir("./icon"))
@@ -495,14 +1142,31 @@ func main() {
 
   // API endpoints
   http.HandleFunc("/api/page", apiGetPageHandler)
+  http.HandleFunc("/api/pages", apiListPagesHandler)
+  http.HandleFunc("/api/cache", apiCacheHandler)
+  http.HandleFunc("/api/attachment", apiAttachmentHandler)
+  http.HandleFunc("/api/fsck", requireAdmin(apiFsckHandler))
+  http.HandleFunc("/api/share", apiShareHandler)
+  http.HandleFunc("/api/rekey", requireAdmin(apiRekeyHandler))
 
   // Traditional wiki endpoints
-  http.HandleFunc("/view/", makeHandler(viewHandler))
+  http.HandleFunc("/view/", checkShare(makeHandler(viewHandler)))
+  http.HandleFunc("/raw/", checkShare(makeHandler(rawHandler)))
+  http.HandleFunc("/unlock/", makeHandler(unlockHandler))
   http.HandleFunc("/edit/", makeHandler(editHandler))
   http.HandleFunc("/save/", makeHandler(saveHandler))
   http.HandleFunc("/upload/", makeHandler(uploadHandler))
   http.HandleFunc("/delete/", makeHandler(deleteHandler))
   http.HandleFunc("/delete-file/", makeHandler(deleteFileHandler))
+  http.HandleFunc("/tus/", makeHandler(tusHandler))
+  http.HandleFunc("/tag/", tagHandler)
+
+  // Live updates over Server-Sent Events
+  http.HandleFunc("/events", eventsHandler)
+  http.HandleFunc("/events/", makeHandler(pageEventsHandler))
+
+  // Collaborative editing
+  http.HandleFunc("/collab/", makeHandler(collabHandler))
   
   log.Println("Starting server on http://localhost:21313")
   log.Fatal(http.ListenAndServe(":21313", nil))